@@ -4,14 +4,20 @@ import (
 	"context"
 	"flag"
 	"fmt"
-	"github.com/go-logr/logr"
-	"github.com/spiffe/go-spiffe/spiffe"
 	"github.com/spiffe/spire/proto/spire/api/registration"
 	"github.com/transferwise/spire-k8s-operator/pkg/controller/clusterspiffeid"
+	"github.com/transferwise/spire-k8s-operator/pkg/controller/clusterspiffeidtemplate"
 	"github.com/transferwise/spire-k8s-operator/pkg/controller/pod"
 	SpiffeId "github.com/transferwise/spire-k8s-operator/pkg/controller/spiffeid"
+	"github.com/transferwise/spire-k8s-operator/pkg/controller/workload"
+	"github.com/transferwise/spire-k8s-operator/pkg/health"
+	"github.com/transferwise/spire-k8s-operator/pkg/spireconn"
+	"github.com/transferwise/spire-k8s-operator/pkg/spiremgr"
+	spiffeidwebhook "github.com/transferwise/spire-k8s-operator/pkg/webhook/spiffeid"
 	"os"
 	"runtime"
+	"strings"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
@@ -28,7 +34,9 @@ import (
 	sdkVersion "github.com/operator-framework/operator-sdk/version"
 	"github.com/spf13/pflag"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/config"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
@@ -43,6 +51,12 @@ var (
 )
 var log = logf.Log.WithName("cmd")
 
+// Spire server APIs which entries can be managed with
+const (
+	spireApiRegistration = "registration"
+	spireApiEntryV1      = "entry-v1"
+)
+
 func printVersion() {
 	log.Info(fmt.Sprintf("Go Version: %s", runtime.Version()))
 	log.Info(fmt.Sprintf("Go OS/Arch: %s/%s", runtime.GOOS, runtime.GOARCH))
@@ -64,6 +78,27 @@ func main() {
 	var enablePodController bool
 	var podLabel string
 	var podAnnotation string
+	var podNamespacedSpiffeIds bool
+	var enableWorkloadController bool
+	var workloadKinds []string
+	var workloadIdTemplate string
+	var enableTemplateController bool
+	var podIdTemplate string
+	var podIdTemplateConfigMap string
+	var podIdTemplatePreview string
+	var resyncInterval time.Duration
+	var gcInterval time.Duration
+	var gcDryRun bool
+	var enableWebhook bool
+	var webhookPort int
+	var webhookCertDir string
+	var allowablePatterns []string
+	var allowablePatternsConfigMap string
+	var spireApi string
+	var maxConcurrentReconciles int
+	var spireConnConfig spireconn.Config
+	var healthProbeAddr string
+	var healthSpireMaxAge time.Duration
 
 	pflag.StringVar(&spireHost, "spire-server", "", "Host and port of the spire server to connect to")
 	pflag.StringVar(&trustDomain, "trust-domain", "", "Spire trust domain to create IDs for")
@@ -71,6 +106,38 @@ func main() {
 	pflag.BoolVar(&enablePodController, "enable-pod-controller", false, "Enable support for old controller style spiffe ID creation")
 	pflag.StringVar(&podLabel, "pod-label", "", "Pod label to use for old auto-creation mechanism")
 	pflag.StringVar(&podAnnotation, "pod-annotation", "", "Pod annotation to use for old auto-creation mechanism")
+	pflag.StringVar(&podIdTemplate, "pod-id-template", "", "Go text/template generating the spiffe ID, or its path, for each pod, e.g. ns/{{.Namespace}}/sa/{{.ServiceAccount}}")
+	pflag.StringVar(&podIdTemplateConfigMap, "pod-id-template-configmap", "", "ConfigMap (namespace/name) whose 'template' key holds the --pod-id-template")
+	pflag.StringVar(&podIdTemplatePreview, "pod-id-template-preview", "", "Print the spiffe ID the template generates for the given pod (namespace/name) and exit")
+	pflag.BoolVar(&podNamespacedSpiffeIds, "pod-namespaced-spiffeids", false, "Have the pod controller create SpiffeIds in each pod's namespace rather than ClusterSpiffeIds")
+	pflag.BoolVar(&enableWorkloadController, "enable-workload-controller", false, "Create one SpiffeId per workload, selecting its pods by label and service account")
+	pflag.StringSliceVar(&workloadKinds, "workload-kinds", workload.KindNames(), "Workload kinds to create SpiffeIds for")
+	pflag.StringVar(&workloadIdTemplate, "workload-id-template", workload.DefaultIdTemplate, "Go text/template generating the spiffe ID, or its path, for each workload")
+	pflag.BoolVar(&enableTemplateController, "enable-template-controller", false, "Create ClusterSpiffeIds for the pods selected by ClusterSpiffeIdTemplates")
+	pflag.DurationVar(&resyncInterval, "resync-interval", 10*time.Minute, "How often to check spire entries for out-of-band changes and repair them, 0 to disable")
+	pflag.DurationVar(&gcInterval, "gc-interval", time.Hour, "How often to delete spire entries created by the operator which no longer belong to a SpiffeId, 0 to disable")
+	pflag.BoolVar(&gcDryRun, "gc-dry-run", true, "Only log the spire entries the garbage collector would delete. Pass --gc-dry-run=false to delete them")
+	pflag.BoolVar(&enableWebhook, "enable-webhook", false, "Serve the validating admission webhook for SpiffeIds")
+	pflag.IntVar(&webhookPort, "webhook-port", 9443, "Port to serve the validating admission webhook on")
+	pflag.StringSliceVar(&allowablePatterns, "allowable-pattern", nil, "Pattern the spiffe IDs of namespaced SpiffeIds must match, e.g. spiffe://{trustDomain}/ns/{namespace}/*. May be repeated")
+	pflag.StringVar(&allowablePatternsConfigMap, "allowable-patterns-configmap", "", "ConfigMap (namespace/name) whose 'patterns' key holds additional newline separated allowable patterns")
+	pflag.StringVar(&spireApi, "spire-api", spireApiRegistration, "Spire server API to manage entries with, either 'registration' or 'entry-v1'")
+	pflag.IntVar(&maxConcurrentReconciles, "max-concurrent-reconciles", 1, "Number of SpiffeIds and ClusterSpiffeIds to reconcile in parallel")
+	pflag.StringVar(&spireConnConfig.Auth, "spire-auth", spireconn.AuthWorkloadAPI, "How to authenticate to the spire server: workload-api, files or admin-socket")
+	pflag.StringVar(&spireConnConfig.CertFile, "spire-cert-file", "", "Client certificate chain PEM file for --spire-auth files")
+	pflag.StringVar(&spireConnConfig.KeyFile, "spire-key-file", "", "Client key PEM file for --spire-auth files")
+	pflag.StringVar(&spireConnConfig.BundleFile, "spire-bundle-file", "", "CA bundle PEM file to verify the spire server with for --spire-auth files")
+	pflag.StringVar(&spireConnConfig.AdminSocket, "spire-admin-socket", spireconn.DefaultAdminSocket, "Spire server's local registration socket for --spire-auth admin-socket")
+	pflag.StringVar(&spireConnConfig.WorkloadAPISocket, "spire-agent-socket", spireconn.DefaultWorkloadAPISocket, "Address of the spire agent workload API used to fetch the operator's SVID")
+	pflag.StringVar(&spireConnConfig.ServerID, "spire-server-id", "", "Spiffe ID the spire server must present, defaults to spiffe://<trust-domain>/spire/server")
+	pflag.DurationVar(&spireConnConfig.CallTimeout, "spire-call-timeout", spiremgr.DefaultCallTimeout, "Deadline for each call to the spire server")
+	pflag.DurationVar(&spireConnConfig.KeepaliveTime, "spire-keepalive", 30*time.Second, "How often to ping an idle spire server connection, 0 to disable")
+	pflag.DurationVar(&spireConnConfig.KeepaliveTimeout, "spire-keepalive-timeout", 10*time.Second, "How long to wait for a keepalive ping before reconnecting")
+	pflag.DurationVar(&spireConnConfig.MaxBackoff, "spire-max-backoff", 30*time.Second, "Longest wait between attempts to reconnect to the spire server")
+	pflag.DurationVar(&spireConnConfig.DialTimeout, "spire-dial-timeout", 2*time.Minute, "How long to retry the initial spire server connection before exiting, 0 to retry forever")
+	pflag.StringVar(&healthProbeAddr, "health-probe-addr", ":8081", "Address to serve the /healthz and /readyz endpoints on")
+	pflag.DurationVar(&healthSpireMaxAge, "health-spire-max-age", 5*time.Minute, "How long the spire server may go without answering before the operator is reported not ready")
+	pflag.StringVar(&webhookCertDir, "webhook-cert-dir", "/tmp/k8s-webhook-server/serving-certs", "Directory containing tls.crt and tls.key for the admission webhook")
 
 	pflag.Parse()
 
@@ -86,8 +153,15 @@ func main() {
 
 	printVersion()
 
-	if len(spireHost) <= 0 {
-		log.Error(fmt.Errorf("--spire-server flag must be provided"), "")
+	switch spireConnConfig.Auth {
+	case spireconn.AuthWorkloadAPI, spireconn.AuthFiles:
+		if len(spireHost) <= 0 {
+			log.Error(fmt.Errorf("--spire-server flag must be provided"), "")
+			os.Exit(1)
+		}
+	case spireconn.AuthAdminSocket:
+	default:
+		log.Error(fmt.Errorf("--spire-auth must be one of %s, %s or %s", spireconn.AuthWorkloadAPI, spireconn.AuthFiles, spireconn.AuthAdminSocket), "")
 		os.Exit(1)
 	}
 
@@ -101,6 +175,36 @@ func main() {
 		os.Exit(1)
 	}
 
+	if len(spireConnConfig.ServerID) == 0 {
+		spireConnConfig.ServerID = spiremgr.ServerID(trustDomain)
+	}
+	if _, err := spiremgr.ParseSpiffeId(spireConnConfig.ServerID); err != nil {
+		log.Error(err, "--spire-server-id must be a spiffe ID", "serverID", spireConnConfig.ServerID)
+		os.Exit(1)
+	}
+
+	if spireApi != spireApiRegistration && spireApi != spireApiEntryV1 {
+		log.Error(fmt.Errorf("--spire-api must be either %s or %s", spireApiRegistration, spireApiEntryV1), "")
+		os.Exit(1)
+	}
+
+	if healthSpireMaxAge <= 0 {
+		log.Error(fmt.Errorf("--health-spire-max-age must be positive"), "")
+		os.Exit(1)
+	}
+
+	stop := signals.SetupSignalHandler()
+
+	// Serve the health endpoints before waiting to become leader, so that standby replicas stay live
+	healthServer := health.NewServer(healthProbeAddr, logf.Log.WithName("health"))
+	go func() {
+		if err := healthServer.Start(stop); err != nil {
+			log.Error(err, "Health endpoints exited")
+			os.Exit(1)
+		}
+	}()
+	spireHealth := &spireconn.Health{}
+
 	// Get a config to talk to the apiserver
 	cfg, err := config.GetConfig()
 	if err != nil {
@@ -108,6 +212,50 @@ func main() {
 		os.Exit(1)
 	}
 
+	var idTemplate *spiremgr.IdTemplate
+	if len(podIdTemplate) > 0 || len(podIdTemplateConfigMap) > 0 {
+		if len(podLabel) > 0 || len(podAnnotation) > 0 {
+			log.Error(fmt.Errorf("a pod ID template can't be combined with --pod-label or --pod-annotation"), "")
+			os.Exit(1)
+		}
+		reader, err := client.New(cfg, client.Options{})
+		if err != nil {
+			log.Error(err, "")
+			os.Exit(1)
+		}
+		idTemplate, err = loadIdTemplate(reader, podIdTemplate, podIdTemplateConfigMap, trustDomain)
+		if err != nil {
+			log.Error(err, "Invalid pod ID template")
+			os.Exit(1)
+		}
+		// The sample pod lacks most labels, so an invalid sample ID is only worth a mention
+		sampleId, err := idTemplate.Execute(spiremgr.SamplePod)
+		if err != nil {
+			sampleId = err.Error()
+		}
+		log.Info("Loaded pod ID template", "template", idTemplate.Text, "samplePod", spiremgr.SamplePod.Name, "sampleId", sampleId)
+
+		if len(podIdTemplatePreview) > 0 {
+			if err := previewIdTemplate(reader, idTemplate, podIdTemplatePreview); err != nil {
+				log.Error(err, "Failed to preview pod ID template")
+				os.Exit(1)
+			}
+			os.Exit(0)
+		}
+	} else if len(podIdTemplatePreview) > 0 {
+		log.Error(fmt.Errorf("--pod-id-template-preview needs --pod-id-template or --pod-id-template-configmap"), "")
+		os.Exit(1)
+	}
+
+	var workloadTemplate *spiremgr.IdTemplate
+	if enableWorkloadController {
+		workloadTemplate, err = spiremgr.ParseIdTemplate(workloadIdTemplate, trustDomain)
+		if err != nil {
+			log.Error(err, "Invalid workload ID template")
+			os.Exit(1)
+		}
+	}
+
 	ctx := context.TODO()
 	// Become the leader before proceeding
 	err = leader.Become(ctx, "spire-k8s-operator-lock")
@@ -135,34 +283,100 @@ func main() {
 		os.Exit(1)
 	}
 
+	if len(allowablePatternsConfigMap) > 0 {
+		patterns, err := loadAllowablePatterns(mgr.GetAPIReader(), allowablePatternsConfigMap)
+		if err != nil {
+			log.Error(err, "Failed to load allowable patterns", "configMap", allowablePatternsConfigMap)
+			os.Exit(1)
+		}
+		allowablePatterns = append(allowablePatterns, patterns...)
+	}
+	for _, pattern := range allowablePatterns {
+		if err := spiremgr.ValidatePattern(pattern); err != nil {
+			log.Error(err, "")
+			os.Exit(1)
+		}
+	}
+
 	// Setup all Controllers
-	spireClient, err := ConnectSpire(spireHost)
+	spireConnConfig.ServerAddress = spireHost
+	spireConnConfig.Log = logf.Log.WithName("spire")
+	spireConnConfig.Health = spireHealth
+	healthServer.AddReadinessCheck("spire", spireHealth.CheckSpire(healthSpireMaxAge))
+	healthServer.AddReadinessCheck("svid", spireHealth.CheckSVID())
+	spireConn, err := spireconn.Connect(spireConnConfig)
 	if err != nil {
 		log.Error(err, "")
 		os.Exit(1)
 	}
-	log.Info("Connected to spire server.")
+	log.Info("Connected to spire server.", "api", spireApi, "serverID", spireConnConfig.ServerID)
+	var backend spiremgr.Backend = &spiremgr.RegistrationBackend{Client: registration.NewRegistrationClient(spireConn)}
+	if spireApi == spireApiEntryV1 {
+		backend = spiremgr.NewEntryV1Client(spireConn, 0, 0)
+	}
+
+	// Restart the operator if the spire server stays unreachable well past the point it became unready
+	healthServer.AddLivenessCheck("spire", spireHealth.CheckSpire(3*healthSpireMaxAge))
+	go spireHealth.Probe(healthSpireMaxAge/5, func(ctx context.Context) error {
+		_, err := backend.GetEntry(ctx, "spire-k8s-operator-health-probe")
+		return err
+	}, stop)
 
 	clusterReconcilerConfig := clusterspiffeid.ReconcileClusterSpiffeIdConfig{
-		TrustDomain: trustDomain,
-		Cluster:     cluster,
+		TrustDomain:             trustDomain,
+		Cluster:                 cluster,
+		ResyncInterval:          resyncInterval,
+		MaxConcurrentReconciles: maxConcurrentReconciles,
+		CallTimeout:             spireConnConfig.CallTimeout,
 	}
 
-	if err := clusterspiffeid.Add(mgr, spireClient, clusterReconcilerConfig); err != nil {
+	if err := clusterspiffeid.Add(mgr, backend, clusterReconcilerConfig); err != nil {
 		log.Error(err, "")
 		os.Exit(1)
 	}
 
 	reconcilerConfig := SpiffeId.ReconcileSpiffeIdConfig{
-		TrustDomain: trustDomain,
-		Cluster:     cluster,
+		TrustDomain:             trustDomain,
+		Cluster:                 cluster,
+		AllowablePatterns:       allowablePatterns,
+		ResyncInterval:          resyncInterval,
+		MaxConcurrentReconciles: maxConcurrentReconciles,
+		CallTimeout:             spireConnConfig.CallTimeout,
 	}
 
-	if err := SpiffeId.Add(mgr, spireClient, reconcilerConfig); err != nil {
+	if err := SpiffeId.Add(mgr, backend, reconcilerConfig); err != nil {
 		log.Error(err, "")
 		os.Exit(1)
 	}
 
+	if enableWebhook {
+		webhookServer := mgr.GetWebhookServer()
+		webhookServer.Port = webhookPort
+		webhookServer.CertDir = webhookCertDir
+		validatorConfig := spiffeidwebhook.SpiffeIdValidatorConfig{
+			TrustDomain:       trustDomain,
+			AllowablePatterns: allowablePatterns,
+		}
+		if err := spiffeidwebhook.Add(mgr, validatorConfig); err != nil {
+			log.Error(err, "")
+			os.Exit(1)
+		}
+	}
+
+	if gcInterval > 0 {
+		gc := &spiremgr.GarbageCollector{
+			Reader:   mgr.GetAPIReader(),
+			Utils:    spiremgr.SpireUtils{Backend: spiremgr.InstrumentBackend(backend, spiremgr.GarbageCollectorName), TrustDomain: trustDomain, Cluster: cluster, CallTimeout: spireConnConfig.CallTimeout},
+			Log:      logf.Log.WithName("spire_gc"),
+			Interval: gcInterval,
+			DryRun:   gcDryRun,
+		}
+		if err := mgr.Add(gc); err != nil {
+			log.Error(err, "")
+			os.Exit(1)
+		}
+	}
+
 	if enablePodController {
 		mode := pod.PodReconcilerModeServiceAccount
 		value := ""
@@ -174,10 +388,15 @@ func main() {
 			mode = pod.PodReconcilerModeAnnotation
 			value = podAnnotation
 		}
+		if idTemplate != nil {
+			mode = pod.PodReconcilerModeTemplate
+		}
 		podControllerConfig := pod.PodReconcilerConfig{
 			TrustDomain: trustDomain,
 			Mode:        mode,
 			Value:       value,
+			Template:    idTemplate,
+			Namespaced:  podNamespacedSpiffeIds,
 		}
 		if err := pod.Add(mgr, podControllerConfig); err != nil {
 			log.Error(err, "")
@@ -185,6 +404,28 @@ func main() {
 		}
 	}
 
+	if enableWorkloadController {
+		workloadConfig := workload.ReconcileWorkloadConfig{
+			TrustDomain: trustDomain,
+			Kinds:       workloadKinds,
+			Template:    workloadTemplate,
+		}
+		if err := workload.Add(mgr, workloadConfig); err != nil {
+			log.Error(err, "")
+			os.Exit(1)
+		}
+	}
+
+	if enableTemplateController {
+		templateConfig := clusterspiffeidtemplate.ReconcileClusterSpiffeIdTemplateConfig{
+			TrustDomain: trustDomain,
+		}
+		if err := clusterspiffeidtemplate.Add(mgr, templateConfig); err != nil {
+			log.Error(err, "")
+			os.Exit(1)
+		}
+	}
+
 	if err = serveCRMetrics(cfg); err != nil {
 		log.Info("Could not generate and serve custom resource metrics", "error", err.Error())
 	}
@@ -225,41 +466,72 @@ func main() {
 	log.Info("Starting the Cmd.")
 
 	// Start the Cmd
-	if err := mgr.Start(signals.SetupSignalHandler()); err != nil {
+	if err := mgr.Start(stop); err != nil {
 		log.Error(err, "Manager exited non-zero")
 		os.Exit(1)
 	}
 }
 
-type SpiffeLogWrapper struct {
-	delegate logr.Logger
+// loadAllowablePatterns reads the patterns from the 'patterns' key of the given namespace/name ConfigMap
+func loadAllowablePatterns(reader client.Reader, configMapName string) ([]string, error) {
+	configMap, err := getConfigMap(reader, configMapName)
+	if err != nil {
+		return nil, err
+	}
+	return spiremgr.ParsePatterns(configMap.Data["patterns"]), nil
 }
 
-func (slw SpiffeLogWrapper) Debugf(format string, args ...interface{}) {
-	slw.delegate.V(1).Info(fmt.Sprintf(format, args))
-}
-func (slw SpiffeLogWrapper) Infof(format string, args ...interface{}) {
-	slw.delegate.Info(fmt.Sprintf(format, args))
-}
-func (slw SpiffeLogWrapper) Warnf(format string, args ...interface{}) {
-	slw.delegate.Info(fmt.Sprintf(format, args))
-}
-func (slw SpiffeLogWrapper) Errorf(format string, args ...interface{}) {
-	slw.delegate.Info(fmt.Sprintf(format, args))
+// getConfigMap reads the ConfigMap given as namespace/name
+func getConfigMap(reader client.Reader, configMapName string) (*v1.ConfigMap, error) {
+	parts := strings.SplitN(configMapName, "/", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("ConfigMap must be given as namespace/name")
+	}
+	configMap := &v1.ConfigMap{}
+	if err := reader.Get(context.TODO(), types.NamespacedName{Namespace: parts[0], Name: parts[1]}, configMap); err != nil {
+		return nil, err
+	}
+	return configMap, nil
 }
 
-func ConnectSpire(serviceName string) (registration.RegistrationClient, error) {
+// loadIdTemplate parses the pod ID template given by flag, or by the 'template' key of the namespace/name ConfigMap
+func loadIdTemplate(reader client.Reader, text string, configMapName string, trustDomain string) (*spiremgr.IdTemplate, error) {
+	if len(configMapName) > 0 {
+		if len(text) > 0 {
+			return nil, fmt.Errorf("only one of --pod-id-template and --pod-id-template-configmap may be given")
+		}
+		configMap, err := getConfigMap(reader, configMapName)
+		if err != nil {
+			return nil, err
+		}
+		text = configMap.Data["template"]
+		if len(strings.TrimSpace(text)) == 0 {
+			return nil, fmt.Errorf("ConfigMap %s has no template", configMapName)
+		}
+	}
+	return spiremgr.ParseIdTemplate(text, trustDomain)
+}
 
-	tlsPeer, err := spiffe.NewTLSPeer(spiffe.WithWorkloadAPIAddr("unix:///run/spire/sockets/agent.sock"), spiffe.WithLogger(SpiffeLogWrapper{log}))
-	if err != nil {
-		return nil, err
+// previewIdTemplate prints the spiffe ID the template generates for the namespace/name pod
+func previewIdTemplate(reader client.Reader, idTemplate *spiremgr.IdTemplate, podName string) error {
+	parts := strings.SplitN(podName, "/", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("pod must be given as namespace/name")
 	}
-	conn, err := tlsPeer.DialGRPC(context.TODO(), serviceName, spiffe.ExpectAnyPeer())
+	previewPod := &v1.Pod{}
+	if err := reader.Get(context.TODO(), types.NamespacedName{Namespace: parts[0], Name: parts[1]}, previewPod); err != nil {
+		return err
+	}
+	id, err := idTemplate.Execute(previewPod)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if len(id) == 0 {
+		fmt.Printf("%s: no spiffe ID\n", podName)
+		return nil
 	}
-	spireClient := registration.NewRegistrationClient(conn)
-	return spireClient, nil
+	fmt.Printf("%s: %s\n", podName, id)
+	return nil
 }
 
 // serveCRMetrics gets the Operator/CustomResource GVKs and generates metrics based on those types.
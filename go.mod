@@ -3,11 +3,14 @@ module github.com/transferwise/spire-k8s-operator
 require (
 	github.com/go-logr/logr v0.1.0
 	github.com/go-openapi/spec v0.17.2
+	github.com/golang/protobuf v1.5.2
 	github.com/operator-framework/operator-sdk v0.11.1-0.20191024224924-17d389050d46
+	github.com/prometheus/client_golang v1.0.0
 	github.com/spf13/pflag v1.0.3
 	github.com/spiffe/go-spiffe v0.0.0-20190922191205-018e7197ed1c
+	github.com/spiffe/spire-api-sdk v1.2.0
 	github.com/spiffe/spire/proto/spire v0.0.0-20191022221951-a7be5754706a
-	google.golang.org/grpc v1.22.0
+	google.golang.org/grpc v1.40.0
 	k8s.io/api v0.0.0-20190918155943-95b840bb6a1f
 	k8s.io/apimachinery v0.0.0-20190913080033-27d36303b655
 	k8s.io/client-go v11.0.1-0.20190409021438-1a26190bd76a+incompatible
@@ -25,6 +28,9 @@ replace (
 )
 
 replace (
+	// bitbucket.org/ww/goautoneg, required by operator-registry, is gone from
+	// bitbucket and the module proxy. Use the github mirror of the same code.
+	bitbucket.org/ww/goautoneg => github.com/munnerz/goautoneg v0.0.0-20120707110453-a547fc61f48d
 	// Indirect operator-sdk dependencies use git.apache.org, which is frequently
 	// down. The github mirror should be used instead.
 	// Locking to a specific version (from 'go mod graph'):
@@ -0,0 +1,80 @@
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ClusterSpiffeIdTemplateSpec describes the ClusterSpiffeIds to create for the pods a template selects
+// +k8s:openapi-gen=true
+type ClusterSpiffeIdTemplateSpec struct {
+	// Namespaces whose pods get IDs. Leave empty to select pods in all namespaces.
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+
+	// Pods which get IDs. Leave empty to select all pods in the selected namespaces.
+	PodSelector *metav1.LabelSelector `json:"podSelector,omitempty"`
+
+	// Go text/template producing each pod's spiffe ID, or just its path, e.g.
+	// ns/{{.Namespace}}/sa/{{.ServiceAccount}}. Pods it produces nothing for get no ID.
+	SpiffeIdTemplate string `json:"spiffeIdTemplate"`
+
+	// Go text/templates producing DNS names to add to each pod's SVIDs. Empty results are left out.
+	DnsNameTemplates []string `json:"dnsNameTemplates,omitempty"`
+
+	// TTL of the SVIDs issued for the IDs, in seconds. Defaults to the spire server's default TTL.
+	// +kubebuilder:validation:Minimum=0
+	Ttl int32 `json:"ttl,omitempty"`
+}
+
+// ClusterSpiffeIdTemplateStatus defines the observed state of ClusterSpiffeIdTemplate
+// +k8s:openapi-gen=true
+type ClusterSpiffeIdTemplateStatus struct {
+	// The most recent generation observed by the operator
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Number of pods the template has created ClusterSpiffeIds for
+	Pods int32 `json:"pods"`
+
+	// Current state of the template
+	Conditions []SpiffeIdCondition `json:"conditions,omitempty"`
+}
+
+// SetCondition adds or updates the condition of the given type, like SpiffeIdStatus.SetCondition.
+// Returns true if anything was modified.
+func (in *ClusterSpiffeIdTemplateStatus) SetCondition(conditionType SpiffeIdConditionType, status corev1.ConditionStatus, reason, message string) bool {
+	conditions := SpiffeIdStatus{Conditions: in.Conditions}
+	changed := conditions.SetCondition(conditionType, status, reason, message)
+	in.Conditions = conditions.Conditions
+	return changed
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// ClusterSpiffeIdTemplate creates a ClusterSpiffeId for each pod matching its selectors
+// +k8s:openapi-gen=true
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Template",type="string",JSONPath=".spec.spiffeIdTemplate"
+// +kubebuilder:printcolumn:name="Pods",type="integer",JSONPath=".status.pods"
+// +kubebuilder:printcolumn:name="Ready",type="string",JSONPath=".status.conditions[?(@.type==\"Ready\")].status"
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
+// +kubebuilder:resource:path=clusterspiffeidtemplates,scope=Cluster
+type ClusterSpiffeIdTemplate struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ClusterSpiffeIdTemplateSpec   `json:"spec,omitempty"`
+	Status ClusterSpiffeIdTemplateStatus `json:"status,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// ClusterSpiffeIdTemplateList contains a list of ClusterSpiffeIdTemplate
+type ClusterSpiffeIdTemplateList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ClusterSpiffeIdTemplate `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ClusterSpiffeIdTemplate{}, &ClusterSpiffeIdTemplateList{})
+}
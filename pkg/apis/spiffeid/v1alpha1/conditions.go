@@ -0,0 +1,48 @@
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// GetCondition returns the condition of the given type, or nil if it isn't set.
+func (in *SpiffeIdStatus) GetCondition(conditionType SpiffeIdConditionType) *SpiffeIdCondition {
+	for i := range in.Conditions {
+		if in.Conditions[i].Type == conditionType {
+			return &in.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// SetCondition adds or updates the condition of the given type. LastTransitionTime is only
+// moved when the status actually changes. Returns true if anything was modified.
+func (in *SpiffeIdStatus) SetCondition(conditionType SpiffeIdConditionType, status corev1.ConditionStatus, reason, message string) bool {
+	existing := in.GetCondition(conditionType)
+	if existing == nil {
+		in.Conditions = append(in.Conditions, SpiffeIdCondition{
+			Type:               conditionType,
+			Status:             status,
+			LastTransitionTime: metav1.Now(),
+			Reason:             reason,
+			Message:            message,
+		})
+		return true
+	}
+	if existing.Status == status && existing.Reason == reason && existing.Message == message {
+		return false
+	}
+	if existing.Status != status {
+		existing.LastTransitionTime = metav1.Now()
+	}
+	existing.Status = status
+	existing.Reason = reason
+	existing.Message = message
+	return true
+}
+
+// IsConditionTrue returns true if the condition of the given type is set and True.
+func (in *SpiffeIdStatus) IsConditionTrue(conditionType SpiffeIdConditionType) bool {
+	condition := in.GetCondition(conditionType)
+	return condition != nil && condition.Status == corev1.ConditionTrue
+}
@@ -1,6 +1,7 @@
 package v1alpha1
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 )
@@ -14,6 +15,7 @@ type runtimeObject = runtime.Object
 type CommonSpiffeId interface {
 	v1Object
 	runtimeObject
+	GetSpec() *SpiffeIdSpec
 	GetStatus() *SpiffeIdStatus
 }
 
@@ -39,6 +41,22 @@ type SpiffeIdSpec struct {
 
 	// Selectors to match for this ID
 	Selector Selector `json:"selector"`
+
+	// TTL of the SVIDs issued for this ID, in seconds. Defaults to the spire server's default TTL.
+	// +kubebuilder:validation:Minimum=0
+	Ttl int32 `json:"ttl,omitempty"`
+
+	// DNS names to add to the SVIDs issued for this ID
+	DnsNames []string `json:"dnsNames,omitempty"`
+
+	// Allow workloads with this ID to use the spire server's registration API
+	Admin bool `json:"admin,omitempty"`
+
+	// Mark this ID as belonging to a downstream spire server
+	Downstream bool `json:"downstream,omitempty"`
+
+	// Trust domains whose bundles are given to workloads with this ID, e.g. spiffe://example.org
+	FederatesWith []string `json:"federatesWith,omitempty"`
 }
 
 // SpiffeIdStatus defines the observed state of SpiffeId
@@ -50,6 +68,45 @@ type SpiffeIdStatus struct {
 
 	// The spire Entry ID created for this Spiffe ID
 	EntryId string `json:"entryId"`
+
+	// Trust domains whose bundles the spire entry is federated with
+	FederatesWith []string `json:"federatesWith,omitempty"`
+
+	// The most recent generation applied to the spire entry. Failed reconciles don't change it.
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Last time the spire entry was successfully synced with this Spiffe ID
+	LastSyncTime *metav1.Time `json:"lastSyncTime,omitempty"`
+
+	// Current state of the Spiffe ID
+	Conditions []SpiffeIdCondition `json:"conditions,omitempty"`
+}
+
+// SpiffeIdConditionType is a valid value for SpiffeIdCondition.Type
+type SpiffeIdConditionType string
+
+const (
+	// SpiffeIdReady means the spire entry exists and matches the spec
+	SpiffeIdReady SpiffeIdConditionType = "Ready"
+	// SpiffeIdSynced means the last reconcile against the spire server succeeded
+	SpiffeIdSynced SpiffeIdConditionType = "Synced"
+	// SpiffeIdDegraded means the last reconcile failed and the entry may be stale or missing
+	SpiffeIdDegraded SpiffeIdConditionType = "Degraded"
+)
+
+// SpiffeIdCondition describes the state of a Spiffe ID at a certain point
+// +k8s:openapi-gen=true
+type SpiffeIdCondition struct {
+	// Type of condition
+	Type SpiffeIdConditionType `json:"type"`
+	// Status of the condition, one of True, False, Unknown
+	Status corev1.ConditionStatus `json:"status"`
+	// Last time the condition transitioned from one status to another
+	LastTransitionTime metav1.Time `json:"lastTransitionTime,omitempty"`
+	// Machine readable reason for the condition's last transition
+	Reason string `json:"reason,omitempty"`
+	// Human readable message indicating details about the last transition
+	Message string `json:"message,omitempty"`
 }
 
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
@@ -57,6 +114,10 @@ type SpiffeIdStatus struct {
 // ClusterSpiffeId is the Schema for the spiffeids API
 // +k8s:openapi-gen=true
 // +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Spiffe ID",type="string",JSONPath=".spec.spiffeId"
+// +kubebuilder:printcolumn:name="Entry ID",type="string",JSONPath=".status.entryId"
+// +kubebuilder:printcolumn:name="Ready",type="string",JSONPath=".status.conditions[?(@.type==\"Ready\")].status"
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
 // +kubebuilder:resource:path=clusterspiffeids,scope=Cluster
 type ClusterSpiffeId struct {
 	metav1.TypeMeta   `json:",inline"`
@@ -66,6 +127,10 @@ type ClusterSpiffeId struct {
 	Status SpiffeIdStatus `json:"status,omitempty"`
 }
 
+func (in *ClusterSpiffeId) GetSpec() *SpiffeIdSpec {
+	return &in.Spec
+}
+
 func (in *ClusterSpiffeId) GetStatus() *SpiffeIdStatus {
 	return &in.Status
 }
@@ -84,6 +149,10 @@ type ClusterSpiffeIdList struct {
 // SpiffeId is the Schema for the spiffeids API
 // +k8s:openapi-gen=true
 // +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Spiffe ID",type="string",JSONPath=".spec.spiffeId"
+// +kubebuilder:printcolumn:name="Entry ID",type="string",JSONPath=".status.entryId"
+// +kubebuilder:printcolumn:name="Ready",type="string",JSONPath=".status.conditions[?(@.type==\"Ready\")].status"
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
 // +kubebuilder:resource:path=spiffeids,scope=Namespaced
 type SpiffeId struct {
 	metav1.TypeMeta   `json:",inline"`
@@ -95,6 +164,10 @@ type SpiffeId struct {
 
 }
 
+func (in *SpiffeId) GetSpec() *SpiffeIdSpec {
+	return &in.Spec
+}
+
 func (in *SpiffeId) GetStatus() *SpiffeIdStatus {
 	return &in.Status
 }
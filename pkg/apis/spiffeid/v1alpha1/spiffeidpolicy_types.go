@@ -0,0 +1,69 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Selector types which can be allowed by a SpiffeIdPolicy
+const (
+	SelectorTypePodLabel       = "podLabel"
+	SelectorTypePodName        = "podName"
+	SelectorTypeNamespace      = "namespace"
+	SelectorTypeServiceAccount = "serviceAccount"
+)
+
+// SpiffeIdPolicySpec defines the guardrails for SpiffeIds in the selected namespaces
+// +k8s:openapi-gen=true
+type SpiffeIdPolicySpec struct {
+	// Namespaces this policy applies to. ClusterSpiffeIds are matched using the namespace in their selector,
+	// and those without one are only covered by policies which apply to all namespaces.
+	// Leave empty to apply to all namespaces.
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+
+	// Selector types which may be used, out of podLabel, podName, namespace and serviceAccount.
+	// Leave empty to allow all of them.
+	AllowedSelectorTypes []string `json:"allowedSelectorTypes,omitempty"`
+
+	// Allow ClusterSpiffeIds to use arbitrary selectors. SpiffeIds don't use them, so aren't restricted.
+	AllowArbitrarySelectors bool `json:"allowArbitrarySelectors,omitempty"`
+
+	// Maximum TTL which may be requested, in seconds. IDs using the spire server's default TTL are always
+	// allowed. Leave empty for no limit.
+	// +kubebuilder:validation:Minimum=0
+	MaxTtl int32 `json:"maxTtl,omitempty"`
+
+	// Trust domains which IDs may federate with, e.g. spiffe://example.org. Leave empty to allow any.
+	AllowedFederatedDomains []string `json:"allowedFederatedDomains,omitempty"`
+}
+
+// SpiffeIdPolicyStatus defines the observed state of SpiffeIdPolicy
+// +k8s:openapi-gen=true
+type SpiffeIdPolicyStatus struct {
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// SpiffeIdPolicy restricts what SpiffeIds and ClusterSpiffeIds in the selected namespaces may request
+// +k8s:openapi-gen=true
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:path=spiffeidpolicies,scope=Cluster
+type SpiffeIdPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   SpiffeIdPolicySpec   `json:"spec,omitempty"`
+	Status SpiffeIdPolicyStatus `json:"status,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// SpiffeIdPolicyList contains a list of SpiffeIdPolicy
+type SpiffeIdPolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []SpiffeIdPolicy `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&SpiffeIdPolicy{}, &SpiffeIdPolicyList{})
+}
@@ -5,6 +5,7 @@
 package v1alpha1
 
 import (
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
@@ -14,7 +15,7 @@ func (in *ClusterSpiffeId) DeepCopyInto(out *ClusterSpiffeId) {
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
 	in.Spec.DeepCopyInto(&out.Spec)
-	out.Status = in.Status
+	in.Status.DeepCopyInto(&out.Status)
 	return
 }
 
@@ -69,6 +70,121 @@ func (in *ClusterSpiffeIdList) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClusterSpiffeIdTemplate) DeepCopyInto(out *ClusterSpiffeIdTemplate) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClusterSpiffeIdTemplate.
+func (in *ClusterSpiffeIdTemplate) DeepCopy() *ClusterSpiffeIdTemplate {
+	if in == nil {
+		return nil
+	}
+	out := new(ClusterSpiffeIdTemplate)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *ClusterSpiffeIdTemplate) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClusterSpiffeIdTemplateList) DeepCopyInto(out *ClusterSpiffeIdTemplateList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	out.ListMeta = in.ListMeta
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]ClusterSpiffeIdTemplate, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClusterSpiffeIdTemplateList.
+func (in *ClusterSpiffeIdTemplateList) DeepCopy() *ClusterSpiffeIdTemplateList {
+	if in == nil {
+		return nil
+	}
+	out := new(ClusterSpiffeIdTemplateList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *ClusterSpiffeIdTemplateList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClusterSpiffeIdTemplateSpec) DeepCopyInto(out *ClusterSpiffeIdTemplateSpec) {
+	*out = *in
+	if in.NamespaceSelector != nil {
+		in, out := &in.NamespaceSelector, &out.NamespaceSelector
+		*out = new(v1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.PodSelector != nil {
+		in, out := &in.PodSelector, &out.PodSelector
+		*out = new(v1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.DnsNameTemplates != nil {
+		in, out := &in.DnsNameTemplates, &out.DnsNameTemplates
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClusterSpiffeIdTemplateSpec.
+func (in *ClusterSpiffeIdTemplateSpec) DeepCopy() *ClusterSpiffeIdTemplateSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ClusterSpiffeIdTemplateSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClusterSpiffeIdTemplateStatus) DeepCopyInto(out *ClusterSpiffeIdTemplateStatus) {
+	*out = *in
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]SpiffeIdCondition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClusterSpiffeIdTemplateStatus.
+func (in *ClusterSpiffeIdTemplateStatus) DeepCopy() *ClusterSpiffeIdTemplateStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(ClusterSpiffeIdTemplateStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Selector) DeepCopyInto(out *Selector) {
 	*out = *in
@@ -103,7 +219,7 @@ func (in *SpiffeId) DeepCopyInto(out *SpiffeId) {
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
 	in.Spec.DeepCopyInto(&out.Spec)
-	out.Status = in.Status
+	in.Status.DeepCopyInto(&out.Status)
 	return
 }
 
@@ -125,6 +241,23 @@ func (in *SpiffeId) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SpiffeIdCondition) DeepCopyInto(out *SpiffeIdCondition) {
+	*out = *in
+	in.LastTransitionTime.DeepCopyInto(&out.LastTransitionTime)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SpiffeIdCondition.
+func (in *SpiffeIdCondition) DeepCopy() *SpiffeIdCondition {
+	if in == nil {
+		return nil
+	}
+	out := new(SpiffeIdCondition)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *SpiffeIdList) DeepCopyInto(out *SpiffeIdList) {
 	*out = *in
@@ -158,10 +291,128 @@ func (in *SpiffeIdList) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SpiffeIdPolicy) DeepCopyInto(out *SpiffeIdPolicy) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	out.Status = in.Status
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SpiffeIdPolicy.
+func (in *SpiffeIdPolicy) DeepCopy() *SpiffeIdPolicy {
+	if in == nil {
+		return nil
+	}
+	out := new(SpiffeIdPolicy)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *SpiffeIdPolicy) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SpiffeIdPolicyList) DeepCopyInto(out *SpiffeIdPolicyList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	out.ListMeta = in.ListMeta
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]SpiffeIdPolicy, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SpiffeIdPolicyList.
+func (in *SpiffeIdPolicyList) DeepCopy() *SpiffeIdPolicyList {
+	if in == nil {
+		return nil
+	}
+	out := new(SpiffeIdPolicyList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *SpiffeIdPolicyList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SpiffeIdPolicySpec) DeepCopyInto(out *SpiffeIdPolicySpec) {
+	*out = *in
+	if in.NamespaceSelector != nil {
+		in, out := &in.NamespaceSelector, &out.NamespaceSelector
+		*out = new(v1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.AllowedSelectorTypes != nil {
+		in, out := &in.AllowedSelectorTypes, &out.AllowedSelectorTypes
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.AllowedFederatedDomains != nil {
+		in, out := &in.AllowedFederatedDomains, &out.AllowedFederatedDomains
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SpiffeIdPolicySpec.
+func (in *SpiffeIdPolicySpec) DeepCopy() *SpiffeIdPolicySpec {
+	if in == nil {
+		return nil
+	}
+	out := new(SpiffeIdPolicySpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SpiffeIdPolicyStatus) DeepCopyInto(out *SpiffeIdPolicyStatus) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SpiffeIdPolicyStatus.
+func (in *SpiffeIdPolicyStatus) DeepCopy() *SpiffeIdPolicyStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(SpiffeIdPolicyStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *SpiffeIdSpec) DeepCopyInto(out *SpiffeIdSpec) {
 	*out = *in
 	in.Selector.DeepCopyInto(&out.Selector)
+	if in.DnsNames != nil {
+		in, out := &in.DnsNames, &out.DnsNames
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.FederatesWith != nil {
+		in, out := &in.FederatesWith, &out.FederatesWith
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
 	return
 }
 
@@ -178,6 +429,22 @@ func (in *SpiffeIdSpec) DeepCopy() *SpiffeIdSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *SpiffeIdStatus) DeepCopyInto(out *SpiffeIdStatus) {
 	*out = *in
+	if in.FederatesWith != nil {
+		in, out := &in.FederatesWith, &out.FederatesWith
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.LastSyncTime != nil {
+		in, out := &in.LastSyncTime, &out.LastSyncTime
+		*out = (*in).DeepCopy()
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]SpiffeIdCondition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 	return
 }
 
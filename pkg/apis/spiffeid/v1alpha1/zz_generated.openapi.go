@@ -11,10 +11,17 @@ import (
 
 func GetOpenAPIDefinitions(ref common.ReferenceCallback) map[string]common.OpenAPIDefinition {
 	return map[string]common.OpenAPIDefinition{
-		"github.com/transferwise/spire-k8s-operator/pkg/apis/spiffeid/v1alpha1.ClusterSpiffeId": schema_pkg_apis_spiffeid_v1alpha1_ClusterSpiffeId(ref),
-		"github.com/transferwise/spire-k8s-operator/pkg/apis/spiffeid/v1alpha1.SpiffeId":        schema_pkg_apis_spiffeid_v1alpha1_SpiffeId(ref),
-		"github.com/transferwise/spire-k8s-operator/pkg/apis/spiffeid/v1alpha1.SpiffeIdSpec":    schema_pkg_apis_spiffeid_v1alpha1_SpiffeIdSpec(ref),
-		"github.com/transferwise/spire-k8s-operator/pkg/apis/spiffeid/v1alpha1.SpiffeIdStatus":  schema_pkg_apis_spiffeid_v1alpha1_SpiffeIdStatus(ref),
+		"github.com/transferwise/spire-k8s-operator/pkg/apis/spiffeid/v1alpha1.ClusterSpiffeId":               schema_pkg_apis_spiffeid_v1alpha1_ClusterSpiffeId(ref),
+		"github.com/transferwise/spire-k8s-operator/pkg/apis/spiffeid/v1alpha1.ClusterSpiffeIdTemplate":       schema_pkg_apis_spiffeid_v1alpha1_ClusterSpiffeIdTemplate(ref),
+		"github.com/transferwise/spire-k8s-operator/pkg/apis/spiffeid/v1alpha1.ClusterSpiffeIdTemplateSpec":   schema_pkg_apis_spiffeid_v1alpha1_ClusterSpiffeIdTemplateSpec(ref),
+		"github.com/transferwise/spire-k8s-operator/pkg/apis/spiffeid/v1alpha1.ClusterSpiffeIdTemplateStatus": schema_pkg_apis_spiffeid_v1alpha1_ClusterSpiffeIdTemplateStatus(ref),
+		"github.com/transferwise/spire-k8s-operator/pkg/apis/spiffeid/v1alpha1.SpiffeId":                      schema_pkg_apis_spiffeid_v1alpha1_SpiffeId(ref),
+		"github.com/transferwise/spire-k8s-operator/pkg/apis/spiffeid/v1alpha1.SpiffeIdCondition":             schema_pkg_apis_spiffeid_v1alpha1_SpiffeIdCondition(ref),
+		"github.com/transferwise/spire-k8s-operator/pkg/apis/spiffeid/v1alpha1.SpiffeIdPolicy":                schema_pkg_apis_spiffeid_v1alpha1_SpiffeIdPolicy(ref),
+		"github.com/transferwise/spire-k8s-operator/pkg/apis/spiffeid/v1alpha1.SpiffeIdPolicySpec":            schema_pkg_apis_spiffeid_v1alpha1_SpiffeIdPolicySpec(ref),
+		"github.com/transferwise/spire-k8s-operator/pkg/apis/spiffeid/v1alpha1.SpiffeIdPolicyStatus":          schema_pkg_apis_spiffeid_v1alpha1_SpiffeIdPolicyStatus(ref),
+		"github.com/transferwise/spire-k8s-operator/pkg/apis/spiffeid/v1alpha1.SpiffeIdSpec":                  schema_pkg_apis_spiffeid_v1alpha1_SpiffeIdSpec(ref),
+		"github.com/transferwise/spire-k8s-operator/pkg/apis/spiffeid/v1alpha1.SpiffeIdStatus":                schema_pkg_apis_spiffeid_v1alpha1_SpiffeIdStatus(ref),
 	}
 }
 
@@ -62,6 +69,149 @@ func schema_pkg_apis_spiffeid_v1alpha1_ClusterSpiffeId(ref common.ReferenceCallb
 	}
 }
 
+func schema_pkg_apis_spiffeid_v1alpha1_ClusterSpiffeIdTemplate(ref common.ReferenceCallback) common.OpenAPIDefinition {
+	return common.OpenAPIDefinition{
+		Schema: spec.Schema{
+			SchemaProps: spec.SchemaProps{
+				Description: "ClusterSpiffeIdTemplate creates a ClusterSpiffeId for each pod matching its selectors",
+				Type:        []string{"object"},
+				Properties: map[string]spec.Schema{
+					"kind": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Kind is a string value representing the REST resource this object represents. Servers may infer this from the endpoint the client submits requests to. Cannot be updated. In CamelCase. More info: https://git.k8s.io/community/contributors/devel/api-conventions.md#types-kinds",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"apiVersion": {
+						SchemaProps: spec.SchemaProps{
+							Description: "APIVersion defines the versioned schema of this representation of an object. Servers should convert recognized schemas to the latest internal value, and may reject unrecognized values. More info: https://git.k8s.io/community/contributors/devel/api-conventions.md#resources",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"metadata": {
+						SchemaProps: spec.SchemaProps{
+							Ref: ref("k8s.io/apimachinery/pkg/apis/meta/v1.ObjectMeta"),
+						},
+					},
+					"spec": {
+						SchemaProps: spec.SchemaProps{
+							Ref: ref("github.com/transferwise/spire-k8s-operator/pkg/apis/spiffeid/v1alpha1.ClusterSpiffeIdTemplateSpec"),
+						},
+					},
+					"status": {
+						SchemaProps: spec.SchemaProps{
+							Ref: ref("github.com/transferwise/spire-k8s-operator/pkg/apis/spiffeid/v1alpha1.ClusterSpiffeIdTemplateStatus"),
+						},
+					},
+				},
+			},
+		},
+		Dependencies: []string{
+			"github.com/transferwise/spire-k8s-operator/pkg/apis/spiffeid/v1alpha1.ClusterSpiffeIdTemplateSpec", "github.com/transferwise/spire-k8s-operator/pkg/apis/spiffeid/v1alpha1.ClusterSpiffeIdTemplateStatus", "k8s.io/apimachinery/pkg/apis/meta/v1.ObjectMeta"},
+	}
+}
+
+func schema_pkg_apis_spiffeid_v1alpha1_ClusterSpiffeIdTemplateSpec(ref common.ReferenceCallback) common.OpenAPIDefinition {
+	return common.OpenAPIDefinition{
+		Schema: spec.Schema{
+			SchemaProps: spec.SchemaProps{
+				Description: "ClusterSpiffeIdTemplateSpec describes the ClusterSpiffeIds to create for the pods a template selects",
+				Type:        []string{"object"},
+				Properties: map[string]spec.Schema{
+					"namespaceSelector": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Namespaces whose pods get IDs. Leave empty to select pods in all namespaces.",
+							Ref:         ref("k8s.io/apimachinery/pkg/apis/meta/v1.LabelSelector"),
+						},
+					},
+					"podSelector": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Pods which get IDs. Leave empty to select all pods in the selected namespaces.",
+							Ref:         ref("k8s.io/apimachinery/pkg/apis/meta/v1.LabelSelector"),
+						},
+					},
+					"spiffeIdTemplate": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Go text/template producing each pod's spiffe ID, or just its path, e.g. ns/{{.Namespace}}/sa/{{.ServiceAccount}}. Pods it produces nothing for get no ID.",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"dnsNameTemplates": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Go text/templates producing DNS names to add to each pod's SVIDs. Empty results are left out.",
+							Type:        []string{"array"},
+							Items: &spec.SchemaOrArray{
+								Schema: &spec.Schema{
+									SchemaProps: spec.SchemaProps{
+										Type:   []string{"string"},
+										Format: "",
+									},
+								},
+							},
+						},
+					},
+					"ttl": {
+						SchemaProps: spec.SchemaProps{
+							Description: "TTL of the SVIDs issued for the IDs, in seconds. Defaults to the spire server's default TTL.",
+							Type:        []string{"integer"},
+							Format:      "int32",
+						},
+					},
+				},
+				Required: []string{"spiffeIdTemplate"},
+			},
+		},
+		Dependencies: []string{
+			"k8s.io/apimachinery/pkg/apis/meta/v1.LabelSelector"},
+	}
+}
+
+func schema_pkg_apis_spiffeid_v1alpha1_ClusterSpiffeIdTemplateStatus(ref common.ReferenceCallback) common.OpenAPIDefinition {
+	return common.OpenAPIDefinition{
+		Schema: spec.Schema{
+			SchemaProps: spec.SchemaProps{
+				Description: "ClusterSpiffeIdTemplateStatus defines the observed state of ClusterSpiffeIdTemplate",
+				Type:        []string{"object"},
+				Properties: map[string]spec.Schema{
+					"observedGeneration": {
+						SchemaProps: spec.SchemaProps{
+							Description: "The most recent generation observed by the operator",
+							Type:        []string{"integer"},
+							Format:      "int64",
+						},
+					},
+					"pods": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Number of pods the template has created ClusterSpiffeIds for",
+							Type:        []string{"integer"},
+							Format:      "int32",
+						},
+					},
+					"conditions": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Current state of the template",
+							Type:        []string{"array"},
+							Items: &spec.SchemaOrArray{
+								Schema: &spec.Schema{
+									SchemaProps: spec.SchemaProps{
+										Ref: ref("github.com/transferwise/spire-k8s-operator/pkg/apis/spiffeid/v1alpha1.SpiffeIdCondition"),
+									},
+								},
+							},
+						},
+					},
+				},
+				Required: []string{"pods"},
+			},
+		},
+		Dependencies: []string{
+			"github.com/transferwise/spire-k8s-operator/pkg/apis/spiffeid/v1alpha1.SpiffeIdCondition"},
+	}
+}
+
 func schema_pkg_apis_spiffeid_v1alpha1_SpiffeId(ref common.ReferenceCallback) common.OpenAPIDefinition {
 	return common.OpenAPIDefinition{
 		Schema: spec.Schema{
@@ -106,6 +256,174 @@ func schema_pkg_apis_spiffeid_v1alpha1_SpiffeId(ref common.ReferenceCallback) co
 	}
 }
 
+func schema_pkg_apis_spiffeid_v1alpha1_SpiffeIdCondition(ref common.ReferenceCallback) common.OpenAPIDefinition {
+	return common.OpenAPIDefinition{
+		Schema: spec.Schema{
+			SchemaProps: spec.SchemaProps{
+				Description: "SpiffeIdCondition describes the state of a Spiffe ID at a certain point",
+				Type:        []string{"object"},
+				Properties: map[string]spec.Schema{
+					"type": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Type of condition",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"status": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Status of the condition, one of True, False, Unknown",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"lastTransitionTime": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Last time the condition transitioned from one status to another",
+							Ref:         ref("k8s.io/apimachinery/pkg/apis/meta/v1.Time"),
+						},
+					},
+					"reason": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Machine readable reason for the condition's last transition",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"message": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Human readable message indicating details about the last transition",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+				},
+				Required: []string{"type", "status"},
+			},
+		},
+		Dependencies: []string{
+			"k8s.io/apimachinery/pkg/apis/meta/v1.Time"},
+	}
+}
+
+func schema_pkg_apis_spiffeid_v1alpha1_SpiffeIdPolicy(ref common.ReferenceCallback) common.OpenAPIDefinition {
+	return common.OpenAPIDefinition{
+		Schema: spec.Schema{
+			SchemaProps: spec.SchemaProps{
+				Description: "SpiffeIdPolicy restricts what SpiffeIds and ClusterSpiffeIds in the selected namespaces may request",
+				Type:        []string{"object"},
+				Properties: map[string]spec.Schema{
+					"kind": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Kind is a string value representing the REST resource this object represents. Servers may infer this from the endpoint the client submits requests to. Cannot be updated. In CamelCase. More info: https://git.k8s.io/community/contributors/devel/api-conventions.md#types-kinds",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"apiVersion": {
+						SchemaProps: spec.SchemaProps{
+							Description: "APIVersion defines the versioned schema of this representation of an object. Servers should convert recognized schemas to the latest internal value, and may reject unrecognized values. More info: https://git.k8s.io/community/contributors/devel/api-conventions.md#resources",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"metadata": {
+						SchemaProps: spec.SchemaProps{
+							Ref: ref("k8s.io/apimachinery/pkg/apis/meta/v1.ObjectMeta"),
+						},
+					},
+					"spec": {
+						SchemaProps: spec.SchemaProps{
+							Ref: ref("github.com/transferwise/spire-k8s-operator/pkg/apis/spiffeid/v1alpha1.SpiffeIdPolicySpec"),
+						},
+					},
+					"status": {
+						SchemaProps: spec.SchemaProps{
+							Ref: ref("github.com/transferwise/spire-k8s-operator/pkg/apis/spiffeid/v1alpha1.SpiffeIdPolicyStatus"),
+						},
+					},
+				},
+			},
+		},
+		Dependencies: []string{
+			"github.com/transferwise/spire-k8s-operator/pkg/apis/spiffeid/v1alpha1.SpiffeIdPolicySpec", "github.com/transferwise/spire-k8s-operator/pkg/apis/spiffeid/v1alpha1.SpiffeIdPolicyStatus", "k8s.io/apimachinery/pkg/apis/meta/v1.ObjectMeta"},
+	}
+}
+
+func schema_pkg_apis_spiffeid_v1alpha1_SpiffeIdPolicySpec(ref common.ReferenceCallback) common.OpenAPIDefinition {
+	return common.OpenAPIDefinition{
+		Schema: spec.Schema{
+			SchemaProps: spec.SchemaProps{
+				Description: "SpiffeIdPolicySpec defines the guardrails for SpiffeIds in the selected namespaces",
+				Type:        []string{"object"},
+				Properties: map[string]spec.Schema{
+					"namespaceSelector": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Namespaces this policy applies to. ClusterSpiffeIds are matched using the namespace in their selector, and those without one are only covered by policies which apply to all namespaces. Leave empty to apply to all namespaces.",
+							Ref:         ref("k8s.io/apimachinery/pkg/apis/meta/v1.LabelSelector"),
+						},
+					},
+					"allowedSelectorTypes": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Selector types which may be used, out of podLabel, podName, namespace and serviceAccount. Leave empty to allow all of them.",
+							Type:        []string{"array"},
+							Items: &spec.SchemaOrArray{
+								Schema: &spec.Schema{
+									SchemaProps: spec.SchemaProps{
+										Type:   []string{"string"},
+										Format: "",
+									},
+								},
+							},
+						},
+					},
+					"allowArbitrarySelectors": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Allow ClusterSpiffeIds to use arbitrary selectors. SpiffeIds don't use them, so aren't restricted.",
+							Type:        []string{"boolean"},
+							Format:      "",
+						},
+					},
+					"maxTtl": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Maximum TTL which may be requested, in seconds. IDs using the spire server's default TTL are always allowed. Leave empty for no limit.",
+							Type:        []string{"integer"},
+							Format:      "int32",
+						},
+					},
+					"allowedFederatedDomains": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Trust domains which IDs may federate with, e.g. spiffe://example.org. Leave empty to allow any.",
+							Type:        []string{"array"},
+							Items: &spec.SchemaOrArray{
+								Schema: &spec.Schema{
+									SchemaProps: spec.SchemaProps{
+										Type:   []string{"string"},
+										Format: "",
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		Dependencies: []string{
+			"k8s.io/apimachinery/pkg/apis/meta/v1.LabelSelector"},
+	}
+}
+
+func schema_pkg_apis_spiffeid_v1alpha1_SpiffeIdPolicyStatus(ref common.ReferenceCallback) common.OpenAPIDefinition {
+	return common.OpenAPIDefinition{
+		Schema: spec.Schema{
+			SchemaProps: spec.SchemaProps{
+				Description: "SpiffeIdPolicyStatus defines the observed state of SpiffeIdPolicy",
+				Type:        []string{"object"},
+			},
+		},
+	}
+}
+
 func schema_pkg_apis_spiffeid_v1alpha1_SpiffeIdSpec(ref common.ReferenceCallback) common.OpenAPIDefinition {
 	return common.OpenAPIDefinition{
 		Schema: spec.Schema{
@@ -126,6 +444,55 @@ func schema_pkg_apis_spiffeid_v1alpha1_SpiffeIdSpec(ref common.ReferenceCallback
 							Ref:         ref("github.com/transferwise/spire-k8s-operator/pkg/apis/spiffeid/v1alpha1.Selector"),
 						},
 					},
+					"ttl": {
+						SchemaProps: spec.SchemaProps{
+							Description: "TTL of the SVIDs issued for this ID, in seconds. Defaults to the spire server's default TTL.",
+							Type:        []string{"integer"},
+							Format:      "int32",
+						},
+					},
+					"dnsNames": {
+						SchemaProps: spec.SchemaProps{
+							Description: "DNS names to add to the SVIDs issued for this ID",
+							Type:        []string{"array"},
+							Items: &spec.SchemaOrArray{
+								Schema: &spec.Schema{
+									SchemaProps: spec.SchemaProps{
+										Type:   []string{"string"},
+										Format: "",
+									},
+								},
+							},
+						},
+					},
+					"admin": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Allow workloads with this ID to use the spire server's registration API",
+							Type:        []string{"boolean"},
+							Format:      "",
+						},
+					},
+					"downstream": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Mark this ID as belonging to a downstream spire server",
+							Type:        []string{"boolean"},
+							Format:      "",
+						},
+					},
+					"federatesWith": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Trust domains whose bundles are given to workloads with this ID, e.g. spiffe://example.org",
+							Type:        []string{"array"},
+							Items: &spec.SchemaOrArray{
+								Schema: &spec.Schema{
+									SchemaProps: spec.SchemaProps{
+										Type:   []string{"string"},
+										Format: "",
+									},
+								},
+							},
+						},
+					},
 				},
 				Required: []string{"spiffeId", "selector"},
 			},
@@ -149,9 +516,51 @@ func schema_pkg_apis_spiffeid_v1alpha1_SpiffeIdStatus(ref common.ReferenceCallba
 							Format:      "",
 						},
 					},
+					"federatesWith": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Trust domains whose bundles the spire entry is federated with",
+							Type:        []string{"array"},
+							Items: &spec.SchemaOrArray{
+								Schema: &spec.Schema{
+									SchemaProps: spec.SchemaProps{
+										Type:   []string{"string"},
+										Format: "",
+									},
+								},
+							},
+						},
+					},
+					"observedGeneration": {
+						SchemaProps: spec.SchemaProps{
+							Description: "The most recent generation applied to the spire entry. Failed reconciles don't change it.",
+							Type:        []string{"integer"},
+							Format:      "int64",
+						},
+					},
+					"lastSyncTime": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Last time the spire entry was successfully synced with this Spiffe ID",
+							Ref:         ref("k8s.io/apimachinery/pkg/apis/meta/v1.Time"),
+						},
+					},
+					"conditions": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Current state of the Spiffe ID",
+							Type:        []string{"array"},
+							Items: &spec.SchemaOrArray{
+								Schema: &spec.Schema{
+									SchemaProps: spec.SchemaProps{
+										Ref: ref("github.com/transferwise/spire-k8s-operator/pkg/apis/spiffeid/v1alpha1.SpiffeIdCondition"),
+									},
+								},
+							},
+						},
+					},
 				},
 				Required: []string{"entryId"},
 			},
 		},
+		Dependencies: []string{
+			"github.com/transferwise/spire-k8s-operator/pkg/apis/spiffeid/v1alpha1.SpiffeIdCondition", "k8s.io/apimachinery/pkg/apis/meta/v1.Time"},
 	}
 }
@@ -4,12 +4,13 @@ import (
 	"context"
 	"fmt"
 	"github.com/go-logr/logr"
-	"github.com/spiffe/spire/proto/spire/api/registration"
 	"github.com/spiffe/spire/proto/spire/common"
 	spiffeidv1alpha1 "github.com/transferwise/spire-k8s-operator/pkg/apis/spiffeid/v1alpha1"
+	"github.com/transferwise/spire-k8s-operator/pkg/metrics"
 	"github.com/transferwise/spire-k8s-operator/pkg/spiremgr"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
 	k8errors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -19,27 +20,41 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/manager"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 	"sigs.k8s.io/controller-runtime/pkg/source"
+	"time"
 )
 
 const spiffeIdFinalizer = "finalizer.clusterspiffeid.spiffe.io"
 
+const controllerName = "clusterspiffeid-controller"
+
 var log = logf.Log.WithName("controller_clusterspiffeid")
 
 // Add creates a new SpiffeId Controller and adds it to the Manager. The Manager will set fields on the Controller
 // and Start it when the Manager is Started.
-func Add(mgr manager.Manager, r registration.RegistrationClient, conf ReconcileClusterSpiffeIdConfig) error {
-	return add(mgr, newReconciler(mgr, r, conf))
+func Add(mgr manager.Manager, backend spiremgr.Backend, conf ReconcileClusterSpiffeIdConfig) error {
+	return add(mgr, newReconciler(mgr, backend, conf), conf.MaxConcurrentReconciles)
 }
 
 // newReconciler returns a new reconcile.Reconciler
-func newReconciler(mgr manager.Manager, r registration.RegistrationClient, conf ReconcileClusterSpiffeIdConfig) reconcile.Reconciler {
-    return &ReconcileClusterSpiffeId{client: mgr.GetClient(), scheme: mgr.GetScheme(), spireClient: r, conf: conf, utils: spiremgr.SpireUtils{SpireClient: r}, finalizer: spiremgr.Finalizer{Client: mgr.GetClient(), FinalizerName: spiffeIdFinalizer}}
+func newReconciler(mgr manager.Manager, backend spiremgr.Backend, conf ReconcileClusterSpiffeIdConfig) reconcile.Reconciler {
+	return &ReconcileClusterSpiffeId{
+		client:    mgr.GetClient(),
+		scheme:    mgr.GetScheme(),
+		conf:      conf,
+		utils:     spiremgr.SpireUtils{Backend: spiremgr.InstrumentBackend(backend, controllerName), TrustDomain: conf.TrustDomain, Cluster: conf.Cluster, CallTimeout: conf.CallTimeout},
+		finalizer: spiremgr.Finalizer{Client: mgr.GetClient(), FinalizerName: spiffeIdFinalizer},
+		status:    spiremgr.StatusUpdater{Client: mgr.GetClient(), Controller: controllerName, RefreshInterval: conf.ResyncInterval},
+		resync:    spiremgr.Resyncer{Interval: conf.ResyncInterval},
+		recorder:  spiremgr.EventRecorder{Recorder: mgr.GetEventRecorderFor(controllerName)},
+		validator: spiremgr.Validator{TrustDomain: conf.TrustDomain},
+		policy:    spiremgr.PolicyEvaluator{Client: mgr.GetClient()},
+	}
 }
 
 // add adds a new Controller to mgr with r as the reconcile.Reconciler
-func add(mgr manager.Manager, r reconcile.Reconciler) error {
+func add(mgr manager.Manager, r reconcile.Reconciler, maxConcurrentReconciles int) error {
 	// Create a new controller
-	c, err := controller.New("clusterspiffeid-controller", mgr, controller.Options{Reconciler: r})
+	c, err := controller.New(controllerName, mgr, controller.Options{Reconciler: metrics.InstrumentReconciler(controllerName, r), MaxConcurrentReconciles: maxConcurrentReconciles})
 	if err != nil {
 		return err
 	}
@@ -50,6 +65,16 @@ func add(mgr manager.Manager, r reconcile.Reconciler) error {
 		return err
 	}
 
+	// Check the ClusterSpiffeIds a SpiffeIdPolicy applies to again when it changes. Both the old and new versions of
+	// updated policies are mapped, so ClusterSpiffeIds the policy stops applying to are checked too.
+	policies := &policyMapper{client: mgr.GetClient(), policy: spiremgr.PolicyEvaluator{Client: mgr.GetClient()}}
+	err = c.Watch(&source.Kind{Type: &spiffeidv1alpha1.SpiffeIdPolicy{}}, &handler.EnqueueRequestsFromMapFunc{
+		ToRequests: handler.ToRequestsFunc(policies.forPolicy),
+	})
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -59,18 +84,28 @@ var _ reconcile.Reconciler = &ReconcileClusterSpiffeId{}
 type ReconcileClusterSpiffeIdConfig struct {
 	TrustDomain string
 	Cluster     string
+	// How often to check the spire entry for drift. Zero disables periodic checks.
+	ResyncInterval time.Duration
+	// Number of SpiffeIds reconciled in parallel, which lets entry/v1 calls be batched together
+	MaxConcurrentReconciles int
+	// Deadline for each call to the spire server. Zero uses spiremgr.DefaultCallTimeout.
+	CallTimeout time.Duration
 }
 
 // ReconcileClusterSpiffeId reconciles a SpiffeId object
 type ReconcileClusterSpiffeId struct {
 	// This client, initialized using mgr.Client() above, is a split client
 	// that reads objects from the cache and writes to the apiserver
-	client      client.Client
-	scheme      *runtime.Scheme
-	spireClient registration.RegistrationClient
-	conf        ReconcileClusterSpiffeIdConfig
-	utils       spiremgr.SpireUtils
-	finalizer   spiremgr.Finalizer
+	client    client.Client
+	scheme    *runtime.Scheme
+	conf      ReconcileClusterSpiffeIdConfig
+	utils     spiremgr.SpireUtils
+	finalizer spiremgr.Finalizer
+	status    spiremgr.StatusUpdater
+	resync    spiremgr.Resyncer
+	recorder  spiremgr.EventRecorder
+	validator spiremgr.Validator
+	policy    spiremgr.PolicyEvaluator
 }
 
 // Reconcile reads that state of the cluster for a SpiffeId object and makes changes based on the state read
@@ -91,46 +126,116 @@ func (r *ReconcileClusterSpiffeId) Reconcile(request reconcile.Request) (reconci
 			// the finalizers have been removed, and the
 			// resource has been deleted, so there is nothing left
 			// to do.
+			metrics.ForgetOutOfSync(controllerName, request.NamespacedName)
 			return reconcile.Result{}, nil
 		}
 		// Error reading the object - requeue the request.
 		return reconcile.Result{}, err
 	}
 
-    if r.finalizer.Finalizable(instance) {
-        if err := r.finalizer.Finalize(log, instance, func() error {
-          return r.utils.DeleteEntry(log, instance.Status.EntryId)
-        }); err != nil {
-            return reconcile.Result{}, err
-        }
-        return reconcile.Result{}, nil
-    }
+	if r.finalizer.Finalizable(instance) {
+		if err := r.finalizer.Finalize(log, instance, func() error {
+			if err := r.utils.DeleteEntry(log, instance.Status.EntryId); err != nil {
+				return err
+			}
+			if len(instance.Status.EntryId) > 0 {
+				metrics.EntryOperations.WithLabelValues(controllerName, "deleted").Inc()
+				r.recorder.Event(instance, corev1.EventTypeNormal, spiremgr.EventEntryDeleted, "Deleted spire entry "+instance.Status.EntryId)
+			}
+			return nil
+		}); err != nil {
+			metrics.FinalizerFailures.WithLabelValues(controllerName).Inc()
+			r.recorder.Event(instance, corev1.EventTypeWarning, spiremgr.ReasonFinalizerFailed, "Failed to finalize: "+err.Error())
+			r.status.SetFailed(reqLogger, instance, spiremgr.ReasonFinalizerFailed, err)
+			return reconcile.Result{}, err
+		}
+		r.status.Forget(instance)
+		return reconcile.Result{}, nil
+	}
 
 	if err := r.finalizer.AddFinalizer(reqLogger, instance); err != nil {
+		metrics.FinalizerFailures.WithLabelValues(controllerName).Inc()
+		r.recorder.Event(instance, corev1.EventTypeWarning, spiremgr.ReasonFinalizerFailed, "Failed to add finalizer: "+err.Error())
+		r.status.SetFailed(reqLogger, instance, spiremgr.ReasonFinalizerFailed, err)
+		return reconcile.Result{}, err
+	}
+
+	if errs := r.validator.Validate(instance); len(errs) > 0 {
+		// Retrying won't help, so wait for the spec to be fixed rather than requeueing
+		err := errs.ToAggregate()
+		reqLogger.Info("Invalid SpiffeId spec", "error", err.Error())
+		r.recorder.Event(instance, corev1.EventTypeWarning, spiremgr.ReasonInvalidSpec, err.Error())
+		if err := r.reject(reqLogger, instance, spiremgr.ReasonInvalidSpec, err); err != nil {
+			return reconcile.Result{}, err
+		}
+		return reconcile.Result{}, nil
+	}
+
+	denials, err := r.policy.Evaluate(instance)
+	if err != nil {
+		reqLogger.Error(err, "Failed to evaluate SpiffeIdPolicies")
+		return reconcile.Result{}, err
+	}
+	if len(denials) > 0 {
+		// Policy changes are watched, but check again on the next resync in case one was missed
+		err := denials.ToAggregate()
+		reqLogger.Info("SpiffeId denied by policy", "error", err.Error())
+		r.recorder.Event(instance, corev1.EventTypeWarning, spiremgr.ReasonPolicyDenied, err.Error())
+		if err := r.reject(reqLogger, instance, spiremgr.ReasonPolicyDenied, err); err != nil {
 			return reconcile.Result{}, err
 		}
+		return r.resync.Result(), nil
+	}
 
-	entryId, err := r.createSpireEntry(reqLogger, instance)
+	entryId, outcome, err := r.createSpireEntry(reqLogger, instance)
 	if err != nil {
 		if status.Code(err) == codes.AlreadyExists && instance.Status.EntryId == entryId {
 			return reconcile.Result{}, nil
 		}
+		r.recorder.SpireError(instance, err)
+		r.status.SetFailed(reqLogger, instance, spiremgr.ReasonSpireError, err)
 		return reconcile.Result{}, err
 	}
+	if outcome != spiremgr.EntryUnchanged {
+		metrics.EntryOperations.WithLabelValues(controllerName, outcome.String()).Inc()
+	}
+	r.recorder.EntrySynced(instance, entryId, outcome)
 
-	if instance.Status.EntryId != entryId {
-		instance.Status.EntryId = entryId
-		err = r.client.Status().Update(context.TODO(), instance)
-		if err != nil {
-			reqLogger.Error(err, "Failed to update SpiffeId to add entry ID", "entryID", entryId)
-			return reconcile.Result{}, err
-		}
+	reason, message := spiremgr.ReasonEntrySynced, ""
+	if r.resync.IsRepair(instance, outcome) {
+		message = fmt.Sprintf("Spire entry drifted from the spec and was %s as %s", outcome, entryId)
+		reqLogger.Info("Repaired spire entry", "entryID", entryId, "outcome", outcome.String())
+		r.recorder.Event(instance, corev1.EventTypeWarning, spiremgr.ReasonEntryRepaired, message)
+		reason = spiremgr.ReasonEntryRepaired
+	}
+
+	if err := r.status.SetSynced(reqLogger, instance, entryId, reason, message); err != nil {
+		return reconcile.Result{}, err
 	}
 
-	return reconcile.Result{}, nil
+	return r.resync.Result(), nil
+}
+
+// reject reports why the ClusterSpiffeId can't have a spire entry. Any entry it already has is deleted, so that it stops
+// being issued SVIDs.
+func (r *ReconcileClusterSpiffeId) reject(reqLogger logr.Logger, instance *spiffeidv1alpha1.ClusterSpiffeId, reason string, cause error) error {
+	if entryId := instance.Status.EntryId; len(entryId) > 0 {
+		reqLogger.Info("Deleting spire entry of rejected ClusterSpiffeId", "entryID", entryId)
+		if err := r.utils.DeleteEntry(reqLogger, entryId); err != nil {
+			r.recorder.SpireError(instance, err)
+			return err
+		}
+		metrics.EntryOperations.WithLabelValues(controllerName, "deleted").Inc()
+		r.recorder.Event(instance, corev1.EventTypeNormal, spiremgr.EventEntryDeleted, fmt.Sprintf("Deleted spire entry %s: %s", entryId, reason))
+		if err := r.status.ClearEntry(reqLogger, instance); err != nil {
+			return err
+		}
+	}
+	r.status.SetFailed(reqLogger, instance, reason, cause)
+	return nil
 }
 
-func (r *ReconcileClusterSpiffeId) createSpireEntry(reqLogger logr.Logger, instance *spiffeidv1alpha1.ClusterSpiffeId) (string, error) {
+func (r *ReconcileClusterSpiffeId) createSpireEntry(reqLogger logr.Logger, instance *spiffeidv1alpha1.ClusterSpiffeId) (string, spiremgr.EntryOutcome, error) {
 
 	// TODO: sanitize!
 	selectors := make([]*common.Selector, 0, len(instance.Spec.Selector.PodLabel))
@@ -147,9 +252,37 @@ func (r *ReconcileClusterSpiffeId) createSpireEntry(reqLogger logr.Logger, insta
 		selectors = append(selectors, &common.Selector{Value: fmt.Sprintf("k8s:sa:%s", instance.Spec.Selector.ServiceAccount)})
 	}
 	for _, v := range instance.Spec.Selector.Arbitrary {
-		// TODO: Protect with some flag because this seems like it could be a really bad idea...
+		// Arbitrary selectors can be forbidden with a SpiffeIdPolicy
 		selectors = append(selectors, &common.Selector{Value: v})
 	}
 
-	return r.utils.GetOrCreateEntry(reqLogger, instance.Spec.SpiffeId, selectors)
+	return r.utils.EnsureEntry(reqLogger, instance.Status.EntryId, spiremgr.EntryFromSpec(&instance.Spec, selectors))
+}
+
+// policyMapper maps SpiffeIdPolicies to the ClusterSpiffeIds they apply to
+type policyMapper struct {
+	client client.Client
+	policy spiremgr.PolicyEvaluator
+}
+
+func (m *policyMapper) forPolicy(obj handler.MapObject) []reconcile.Request {
+	list := &spiffeidv1alpha1.ClusterSpiffeIdList{}
+	if err := m.client.List(context.TODO(), list); err != nil {
+		log.Error(err, "Failed to list ClusterSpiffeIds")
+		return nil
+	}
+	instances := make([]spiffeidv1alpha1.CommonSpiffeId, 0, len(list.Items))
+	for i := range list.Items {
+		instances = append(instances, &list.Items[i])
+	}
+	keys, err := m.policy.Affected(obj.Object.(*spiffeidv1alpha1.SpiffeIdPolicy), instances)
+	if err != nil {
+		log.Error(err, "Failed to find the ClusterSpiffeIds a SpiffeIdPolicy applies to", "SpiffeIdPolicy.Name", obj.Meta.GetName())
+		return nil
+	}
+	requests := make([]reconcile.Request, 0, len(keys))
+	for _, key := range keys {
+		requests = append(requests, reconcile.Request{NamespacedName: key})
+	}
+	return requests
 }
@@ -0,0 +1,60 @@
+//go:build integration
+// +build integration
+
+package clusterspiffeid_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	spiffeidv1alpha1 "github.com/transferwise/spire-k8s-operator/pkg/apis/spiffeid/v1alpha1"
+	"github.com/transferwise/spire-k8s-operator/pkg/testenv"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var env *testenv.Environment
+
+// TestMain runs the tests against a local kube-apiserver, which KUBEBUILDER_ASSETS must point at along with etcd
+func TestMain(m *testing.M) {
+	var err error
+	env, err = testenv.Start(testenv.CRDDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to start test environment: %v\n", err)
+		os.Exit(1)
+	}
+	code := m.Run()
+	if err := env.Stop(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to stop test environment: %v\n", err)
+	}
+	os.Exit(code)
+}
+
+// TestClusterSpiffeIdCreatesEntry checks that a ClusterSpiffeId gets a matching spire entry.
+func TestClusterSpiffeIdCreatesEntry(t *testing.T) {
+	clusterSpiffeId := &spiffeidv1alpha1.ClusterSpiffeId{
+		ObjectMeta: metav1.ObjectMeta{Name: "cluster-creates-entry"},
+		Spec: spiffeidv1alpha1.SpiffeIdSpec{
+			SpiffeId: fmt.Sprintf("spiffe://%s/cluster/creates-entry", env.TrustDomain),
+			Selector: spiffeidv1alpha1.Selector{
+				Namespace:      "default",
+				ServiceAccount: "creates-entry",
+			},
+		},
+	}
+	if err := env.Client.Create(context.TODO(), clusterSpiffeId); err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := env.WaitForEntry(clusterSpiffeId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.GetSpiffeId() != clusterSpiffeId.Spec.SpiffeId {
+		t.Errorf("expected entry for %s, got %s", clusterSpiffeId.Spec.SpiffeId, entry.GetSpiffeId())
+	}
+	if len(entry.GetSelectors()) != 2 {
+		t.Errorf("expected namespace and service account selectors, got %v", entry.GetSelectors())
+	}
+}
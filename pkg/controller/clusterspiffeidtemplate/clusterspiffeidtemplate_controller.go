@@ -0,0 +1,230 @@
+package clusterspiffeidtemplate
+
+import (
+	"context"
+	"fmt"
+
+	spiffeidv1alpha1 "github.com/transferwise/spire-k8s-operator/pkg/apis/spiffeid/v1alpha1"
+	"github.com/transferwise/spire-k8s-operator/pkg/spiremgr"
+	corev1 "k8s.io/api/core/v1"
+	k8errors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+const controllerName = "clusterspiffeidtemplate-controller"
+
+// ownerKey indexes ClusterSpiffeIds by the name of the ClusterSpiffeIdTemplate controlling them
+const ownerKey = ".metadata.controller"
+
+// Reasons for the Ready condition of a ClusterSpiffeIdTemplate
+const (
+	ReasonSynced          = "Synced"
+	ReasonInvalidTemplate = "InvalidTemplate"
+)
+
+var log = logf.Log.WithName("controller_clusterspiffeidtemplate")
+
+// Add creates the ClusterSpiffeIdTemplate Controllers and adds them to the Manager. The Manager will set fields on
+// the Controllers and Start them when the Manager is Started.
+func Add(mgr manager.Manager, conf ReconcileClusterSpiffeIdTemplateConfig) error {
+	err := mgr.GetFieldIndexer().IndexField(&spiffeidv1alpha1.ClusterSpiffeId{}, ownerKey, func(obj runtime.Object) []string {
+		owner := metav1.GetControllerOf(obj.(*spiffeidv1alpha1.ClusterSpiffeId))
+		if owner == nil || owner.Kind != "ClusterSpiffeIdTemplate" {
+			return nil
+		}
+		return []string{owner.Name}
+	})
+	if err != nil {
+		return err
+	}
+	if err := add(mgr, newReconciler(mgr, conf)); err != nil {
+		return err
+	}
+	return addPodController(mgr, newPodReconciler(mgr, conf))
+}
+
+// newReconciler returns a new reconcile.Reconciler
+func newReconciler(mgr manager.Manager, conf ReconcileClusterSpiffeIdTemplateConfig) reconcile.Reconciler {
+	return &ReconcileClusterSpiffeIdTemplate{
+		client:   mgr.GetClient(),
+		config:   conf,
+		recorder: mgr.GetEventRecorderFor(controllerName),
+	}
+}
+
+// add adds a new Controller to mgr with r as the reconcile.Reconciler
+func add(mgr manager.Manager, r reconcile.Reconciler) error {
+	// Create a new controller
+	c, err := controller.New(controllerName, mgr, controller.Options{Reconciler: r})
+	if err != nil {
+		return err
+	}
+
+	// Watch for changes to primary resource ClusterSpiffeIdTemplate
+	err = c.Watch(&source.Kind{Type: &spiffeidv1alpha1.ClusterSpiffeIdTemplate{}}, &handler.EnqueueRequestForObject{})
+	if err != nil {
+		return err
+	}
+
+	// Only ClusterSpiffeIds coming and going change the template's status
+	err = c.Watch(&source.Kind{Type: &spiffeidv1alpha1.ClusterSpiffeId{}}, &handler.EnqueueRequestForOwner{
+		IsController: true,
+		OwnerType:    &spiffeidv1alpha1.ClusterSpiffeIdTemplate{},
+	}, predicate.Funcs{
+		UpdateFunc: func(event.UpdateEvent) bool { return false },
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// blank assignment to verify that ReconcileClusterSpiffeIdTemplate implements reconcile.Reconciler
+var _ reconcile.Reconciler = &ReconcileClusterSpiffeIdTemplate{}
+
+type ReconcileClusterSpiffeIdTemplateConfig struct {
+	TrustDomain string
+}
+
+// ReconcileClusterSpiffeIdTemplate checks ClusterSpiffeIdTemplates and reports how many pods they cover. The
+// ClusterSpiffeIds themselves are managed a pod at a time by ReconcileTemplatePod.
+type ReconcileClusterSpiffeIdTemplate struct {
+	client   client.Client
+	config   ReconcileClusterSpiffeIdTemplateConfig
+	recorder record.EventRecorder
+}
+
+// Reconcile updates the status of a ClusterSpiffeIdTemplate
+func (r *ReconcileClusterSpiffeIdTemplate) Reconcile(request reconcile.Request) (reconcile.Result, error) {
+	reqLogger := log.WithValues("Request.Name", request.Name)
+	reqLogger.Info("Reconciling ClusterSpiffeIdTemplate")
+
+	instance := &spiffeidv1alpha1.ClusterSpiffeIdTemplate{}
+	err := r.client.Get(context.TODO(), request.NamespacedName, instance)
+	if err != nil {
+		if k8errors.IsNotFound(err) {
+			// The ClusterSpiffeIds are owned by the template, so are garbage collected with it
+			return reconcile.Result{}, nil
+		}
+		return reconcile.Result{}, err
+	}
+	if !instance.GetDeletionTimestamp().IsZero() {
+		return reconcile.Result{}, nil
+	}
+
+	clusterSpiffeIds := &spiffeidv1alpha1.ClusterSpiffeIdList{}
+	if err := r.client.List(context.TODO(), clusterSpiffeIds, client.MatchingField(ownerKey, instance.Name)); err != nil {
+		return reconcile.Result{}, err
+	}
+	pods := int32(len(clusterSpiffeIds.Items))
+
+	if _, err := parseTemplate(instance, r.config.TrustDomain); err != nil {
+		reqLogger.Info("Invalid template", "error", err.Error())
+		r.recorder.Event(instance, corev1.EventTypeWarning, ReasonInvalidTemplate, err.Error())
+		return reconcile.Result{}, r.setStatus(instance, pods, corev1.ConditionFalse, ReasonInvalidTemplate, err.Error())
+	}
+	return reconcile.Result{}, r.setStatus(instance, pods, corev1.ConditionTrue, ReasonSynced, fmt.Sprintf("ClusterSpiffeIds exist for %d pods", pods))
+}
+
+func (r *ReconcileClusterSpiffeIdTemplate) setStatus(instance *spiffeidv1alpha1.ClusterSpiffeIdTemplate, pods int32, status corev1.ConditionStatus, reason string, message string) error {
+	changed := instance.Status.SetCondition(spiffeidv1alpha1.SpiffeIdReady, status, reason, message)
+	if !changed && instance.Status.Pods == pods && instance.Status.ObservedGeneration == instance.Generation {
+		return nil
+	}
+	instance.Status.Pods = pods
+	instance.Status.ObservedGeneration = instance.Generation
+	return r.client.Status().Update(context.TODO(), instance)
+}
+
+// parsedTemplate is a ClusterSpiffeIdTemplate ready to be applied to pods
+type parsedTemplate struct {
+	instance          *spiffeidv1alpha1.ClusterSpiffeIdTemplate
+	namespaceSelector labels.Selector
+	podSelector       labels.Selector
+	idTemplate        *spiremgr.IdTemplate
+	dnsNameTemplates  []*spiremgr.DnsNameTemplate
+}
+
+func parseTemplate(instance *spiffeidv1alpha1.ClusterSpiffeIdTemplate, trustDomain string) (*parsedTemplate, error) {
+	idTemplate, err := spiremgr.ParseIdTemplate(instance.Spec.SpiffeIdTemplate, trustDomain)
+	if err != nil {
+		return nil, fmt.Errorf("spiffeIdTemplate: %v", err)
+	}
+	dnsNameTemplates := make([]*spiremgr.DnsNameTemplate, 0, len(instance.Spec.DnsNameTemplates))
+	for i, text := range instance.Spec.DnsNameTemplates {
+		dnsNameTemplate, err := spiremgr.ParseDnsNameTemplate(text)
+		if err != nil {
+			return nil, fmt.Errorf("dnsNameTemplates[%d]: %v", i, err)
+		}
+		dnsNameTemplates = append(dnsNameTemplates, dnsNameTemplate)
+	}
+	namespaceSelector, err := selectorOrEverything(instance.Spec.NamespaceSelector)
+	if err != nil {
+		return nil, fmt.Errorf("namespaceSelector: %v", err)
+	}
+	podSelector, err := selectorOrEverything(instance.Spec.PodSelector)
+	if err != nil {
+		return nil, fmt.Errorf("podSelector: %v", err)
+	}
+	return &parsedTemplate{
+		instance:          instance,
+		namespaceSelector: namespaceSelector,
+		podSelector:       podSelector,
+		idTemplate:        idTemplate,
+		dnsNameTemplates:  dnsNameTemplates,
+	}, nil
+}
+
+// selects returns true if the template selects the pod in the namespace
+func (t *parsedTemplate) selects(namespace *corev1.Namespace, pod *corev1.Pod) bool {
+	return t.namespaceSelector.Matches(labels.Set(namespace.Labels)) && t.podSelector.Matches(labels.Set(pod.Labels))
+}
+
+// podSpec returns the spec of the pod's ClusterSpiffeId, or nil if the template produces no ID for it
+func (t *parsedTemplate) podSpec(pod *corev1.Pod) (*spiffeidv1alpha1.SpiffeIdSpec, error) {
+	spiffeId, err := t.idTemplate.Execute(pod)
+	if err != nil || len(spiffeId) == 0 {
+		return nil, err
+	}
+
+	var dnsNames []string
+	for _, dnsNameTemplate := range t.dnsNameTemplates {
+		dnsName, err := dnsNameTemplate.Execute(pod)
+		if err != nil {
+			return nil, err
+		}
+		if len(dnsName) > 0 {
+			dnsNames = append(dnsNames, dnsName)
+		}
+	}
+
+	return &spiffeidv1alpha1.SpiffeIdSpec{
+		SpiffeId: spiffeId,
+		Selector: spiffeidv1alpha1.Selector{
+			Namespace: pod.Namespace,
+			PodName:   pod.Name,
+		},
+		DnsNames: dnsNames,
+		Ttl:      t.instance.Spec.Ttl,
+	}, nil
+}
+
+func selectorOrEverything(selector *metav1.LabelSelector) (labels.Selector, error) {
+	if selector == nil {
+		return labels.Everything(), nil
+	}
+	return metav1.LabelSelectorAsSelector(selector)
+}
@@ -0,0 +1,118 @@
+//go:build integration
+// +build integration
+
+package clusterspiffeidtemplate_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	spiffeidv1alpha1 "github.com/transferwise/spire-k8s-operator/pkg/apis/spiffeid/v1alpha1"
+	"github.com/transferwise/spire-k8s-operator/pkg/testenv"
+	corev1 "k8s.io/api/core/v1"
+	k8errors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var env *testenv.Environment
+
+// TestMain runs the tests against a local kube-apiserver, which KUBEBUILDER_ASSETS must point at along with etcd
+func TestMain(m *testing.M) {
+	var err error
+	env, err = testenv.Start(testenv.CRDDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to start test environment: %v\n", err)
+		os.Exit(1)
+	}
+	code := m.Run()
+	if err := env.Stop(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to stop test environment: %v\n", err)
+	}
+	os.Exit(code)
+}
+
+// TestTemplateCreatesClusterSpiffeIds checks that a ClusterSpiffeIdTemplate creates a ClusterSpiffeId, with a
+// spire entry, for each pod it selects, and deletes it once the pod stops matching.
+func TestTemplateCreatesClusterSpiffeIds(t *testing.T) {
+	namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name:   "template-creates-ids",
+		Labels: map[string]string{"team": "template-creates-ids"},
+	}}
+	if err := env.Client.Create(context.TODO(), namespace); err != nil && !k8errors.IsAlreadyExists(err) {
+		t.Fatal(err)
+	}
+	template := &spiffeidv1alpha1.ClusterSpiffeIdTemplate{
+		ObjectMeta: metav1.ObjectMeta{Name: "template-creates-ids"},
+		Spec: spiffeidv1alpha1.ClusterSpiffeIdTemplateSpec{
+			NamespaceSelector: &metav1.LabelSelector{MatchLabels: namespace.Labels},
+			PodSelector:       &metav1.LabelSelector{MatchLabels: map[string]string{"app": "api"}},
+			SpiffeIdTemplate:  "ns/{{.Namespace}}/app/{{.Labels.app}}",
+			DnsNameTemplates:  []string{"{{.Name}}.{{.Namespace}}.svc"},
+		},
+	}
+	if err := env.Client.Create(context.TODO(), template); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"api", "worker"} {
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace.Name, Name: name, Labels: map[string]string{"app": name}},
+			Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: name, Image: "nginx"}}},
+		}
+		if err := env.Client.Create(context.TODO(), pod); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var generated []spiffeidv1alpha1.ClusterSpiffeId
+	templateIds := func() ([]spiffeidv1alpha1.ClusterSpiffeId, error) {
+		list := &spiffeidv1alpha1.ClusterSpiffeIdList{}
+		if err := env.Client.List(context.TODO(), list); err != nil {
+			return nil, err
+		}
+		var ids []spiffeidv1alpha1.ClusterSpiffeId
+		for _, item := range list.Items {
+			if metav1.IsControlledBy(&item, template) {
+				ids = append(ids, item)
+			}
+		}
+		return ids, nil
+	}
+	err := env.WaitFor("template ClusterSpiffeId to be created", func() (bool, error) {
+		ids, err := templateIds()
+		generated = ids
+		return len(ids) > 0, err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(generated) != 1 {
+		t.Fatalf("expected one ClusterSpiffeId for the api pod, got %d", len(generated))
+	}
+	clusterSpiffeId := &generated[0]
+	expected := fmt.Sprintf("spiffe://%s/ns/%s/app/api", env.TrustDomain, namespace.Name)
+	if clusterSpiffeId.Spec.SpiffeId != expected || clusterSpiffeId.Spec.Selector.PodName != "api" {
+		t.Fatalf("expected ClusterSpiffeId for %s selecting pod api, got %v", expected, clusterSpiffeId.Spec)
+	}
+	if _, err := env.WaitForEntry(clusterSpiffeId); err != nil {
+		t.Fatal(err)
+	}
+
+	pod := &corev1.Pod{}
+	if err := env.Client.Get(context.TODO(), types.NamespacedName{Namespace: namespace.Name, Name: "api"}, pod); err != nil {
+		t.Fatal(err)
+	}
+	pod.Labels["app"] = "retired"
+	if err := env.Client.Update(context.TODO(), pod); err != nil {
+		t.Fatal(err)
+	}
+	err = env.WaitFor("template ClusterSpiffeId to be deleted", func() (bool, error) {
+		ids, err := templateIds()
+		return len(ids) == 0, err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,268 @@
+package clusterspiffeidtemplate
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+
+	spiffeidv1alpha1 "github.com/transferwise/spire-k8s-operator/pkg/apis/spiffeid/v1alpha1"
+	"github.com/transferwise/spire-k8s-operator/pkg/spiremgr"
+	corev1 "k8s.io/api/core/v1"
+	k8errors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+const podControllerName = "clusterspiffeidtemplate-pod-controller"
+
+// newPodReconciler returns a new reconcile.Reconciler
+func newPodReconciler(mgr manager.Manager, conf ReconcileClusterSpiffeIdTemplateConfig) reconcile.Reconciler {
+	return &ReconcileTemplatePod{
+		client:   mgr.GetClient(),
+		scheme:   mgr.GetScheme(),
+		config:   conf,
+		recorder: mgr.GetEventRecorderFor(controllerName),
+	}
+}
+
+// addPodController adds a new Controller to mgr with r as the reconcile.Reconciler
+func addPodController(mgr manager.Manager, r reconcile.Reconciler) error {
+	// Create a new controller
+	c, err := controller.New(podControllerName, mgr, controller.Options{Reconciler: r})
+	if err != nil {
+		return err
+	}
+
+	// Watch for changes to primary resource Pod
+	err = c.Watch(&source.Kind{Type: &corev1.Pod{}}, &handler.EnqueueRequestForObject{})
+	if err != nil {
+		return err
+	}
+
+	// Templates, namespaces and the ClusterSpiffeIds themselves changing map back to the pods they affect
+	pods := &podMapper{client: mgr.GetClient()}
+	err = c.Watch(&source.Kind{Type: &spiffeidv1alpha1.ClusterSpiffeIdTemplate{}}, &handler.EnqueueRequestsFromMapFunc{
+		ToRequests: handler.ToRequestsFunc(pods.forTemplate),
+	})
+	if err != nil {
+		return err
+	}
+	err = c.Watch(&source.Kind{Type: &corev1.Namespace{}}, &handler.EnqueueRequestsFromMapFunc{
+		ToRequests: handler.ToRequestsFunc(pods.forNamespace),
+	})
+	if err != nil {
+		return err
+	}
+	err = c.Watch(&source.Kind{Type: &spiffeidv1alpha1.ClusterSpiffeId{}}, &handler.EnqueueRequestsFromMapFunc{
+		ToRequests: handler.ToRequestsFunc(pods.forClusterSpiffeId),
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// blank assignment to verify that ReconcileTemplatePod implements reconcile.Reconciler
+var _ reconcile.Reconciler = &ReconcileTemplatePod{}
+
+// ReconcileTemplatePod keeps a ClusterSpiffeId for a pod for each ClusterSpiffeIdTemplate selecting it
+type ReconcileTemplatePod struct {
+	client   client.Client
+	scheme   *runtime.Scheme
+	config   ReconcileClusterSpiffeIdTemplateConfig
+	recorder record.EventRecorder
+}
+
+// Reconcile creates, updates and deletes a pod's ClusterSpiffeIds to match the templates selecting it
+func (r *ReconcileTemplatePod) Reconcile(request reconcile.Request) (reconcile.Result, error) {
+	reqLogger := log.WithValues("Request.Namespace", request.Namespace, "Request.Name", request.Name)
+
+	pod := &corev1.Pod{}
+	err := r.client.Get(context.TODO(), request.NamespacedName, pod)
+	if err != nil && !k8errors.IsNotFound(err) {
+		return reconcile.Result{}, err
+	}
+	if err != nil || pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed || !pod.GetDeletionTimestamp().IsZero() {
+		// Gone or going, so no template selects it
+		pod = nil
+	}
+
+	namespace := &corev1.Namespace{}
+	if pod != nil {
+		if err := r.client.Get(context.TODO(), types.NamespacedName{Name: request.Namespace}, namespace); err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+
+	templates := &spiffeidv1alpha1.ClusterSpiffeIdTemplateList{}
+	if err := r.client.List(context.TODO(), templates); err != nil {
+		return reconcile.Result{}, err
+	}
+	for i := range templates.Items {
+		instance := &templates.Items[i]
+		if !instance.GetDeletionTimestamp().IsZero() {
+			continue
+		}
+
+		var desired *spiffeidv1alpha1.SpiffeIdSpec
+		if pod != nil {
+			template, err := parseTemplate(instance, r.config.TrustDomain)
+			if err != nil {
+				// Reported in the template's status. Leave its ClusterSpiffeIds alone until it's fixed.
+				continue
+			}
+			if template.selects(namespace, pod) {
+				desired, err = template.podSpec(pod)
+				if err != nil {
+					// Retrying won't help until the pod or the template changes
+					reqLogger.Info("Failed to generate spiffe ID", "template", instance.Name, "error", err.Error())
+					r.recorder.Event(instance, corev1.EventTypeWarning, "SpiffeIdFailed", fmt.Sprintf("Failed to generate spiffe ID for pod %s/%s: %v", request.Namespace, request.Name, err))
+					continue
+				}
+			}
+		}
+
+		name := generatedName(instance.Name, request.Namespace, request.Name)
+		if err := r.sync(instance, name, desired); err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+
+	return reconcile.Result{}, nil
+}
+
+// sync creates, updates or deletes the template's ClusterSpiffeId with the given name to match desired
+func (r *ReconcileTemplatePod) sync(instance *spiffeidv1alpha1.ClusterSpiffeIdTemplate, name string, desired *spiffeidv1alpha1.SpiffeIdSpec) error {
+	reqLogger := log.WithValues("ClusterSpiffeIdTemplate.Name", instance.Name, "ClusterSpiffeId.Name", name)
+
+	existing := &spiffeidv1alpha1.ClusterSpiffeId{}
+	err := r.client.Get(context.TODO(), types.NamespacedName{Name: name}, existing)
+	if err != nil && k8errors.IsNotFound(err) {
+		if desired == nil {
+			return nil
+		}
+		clusterSpiffeId := &spiffeidv1alpha1.ClusterSpiffeId{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec:       *desired,
+		}
+		if err := controllerutil.SetControllerReference(instance, clusterSpiffeId, r.scheme); err != nil {
+			return err
+		}
+		reqLogger.Info("Creating ClusterSpiffeId", "spiffeId", desired.SpiffeId)
+		return r.client.Create(context.TODO(), clusterSpiffeId)
+	} else if err != nil {
+		return err
+	}
+
+	if !metav1.IsControlledBy(existing, instance) {
+		if desired != nil {
+			reqLogger.Info("ClusterSpiffeId already exists for something else, not changing it")
+			r.recorder.Event(instance, corev1.EventTypeWarning, "SpiffeIdConflict", fmt.Sprintf("ClusterSpiffeId %s already belongs to something else", name))
+		}
+		return nil
+	}
+	if !existing.GetDeletionTimestamp().IsZero() {
+		return nil
+	}
+
+	if desired == nil {
+		reqLogger.Info("Pod no longer selected, deleting ClusterSpiffeId")
+		if err := r.client.Delete(context.TODO(), existing); err != nil && !k8errors.IsNotFound(err) {
+			return err
+		}
+		return nil
+	}
+	if reflect.DeepEqual(existing.Spec, *desired) {
+		return nil
+	}
+	reqLogger.Info("Updating ClusterSpiffeId", "spiffeId", desired.SpiffeId)
+	existing.Spec = *desired
+	return r.client.Update(context.TODO(), existing)
+}
+
+// generatedName returns the name of the template's ClusterSpiffeId for a pod. The hash keeps names unique across
+// templates and namespaces, however their names are split by dashes.
+func generatedName(templateName string, namespace string, podName string) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s/%s/%s", templateName, namespace, podName)))
+	return spiremgr.GeneratedName(fmt.Sprintf("%s-%s-%s", templateName, podName, hex.EncodeToString(sum[:])[:8]))
+}
+
+// podMapper maps the objects the pod controller watches to the pods they affect
+type podMapper struct {
+	client client.Client
+}
+
+// forTemplate enqueues the pods selected by the template. Both the old and new versions of updated templates are
+// mapped, so pods which stop being selected are enqueued too.
+func (m *podMapper) forTemplate(obj handler.MapObject) []reconcile.Request {
+	template := obj.Object.(*spiffeidv1alpha1.ClusterSpiffeIdTemplate)
+	namespaceSelector, err := selectorOrEverything(template.Spec.NamespaceSelector)
+	if err != nil {
+		return nil
+	}
+	podSelector, err := selectorOrEverything(template.Spec.PodSelector)
+	if err != nil {
+		return nil
+	}
+
+	namespaces := &corev1.NamespaceList{}
+	if err := m.client.List(context.TODO(), namespaces, matchingSelector{namespaceSelector}); err != nil {
+		log.Error(err, "Failed to list namespaces")
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, namespace := range namespaces.Items {
+		requests = append(requests, m.podsIn(namespace.Name, podSelector)...)
+	}
+	return requests
+}
+
+// forNamespace enqueues all the namespace's pods, as its labels may change which templates select them
+func (m *podMapper) forNamespace(obj handler.MapObject) []reconcile.Request {
+	return m.podsIn(obj.Meta.GetName(), labels.Everything())
+}
+
+// forClusterSpiffeId enqueues the pod of a ClusterSpiffeId generated from a template, so changes to it are reverted
+func (m *podMapper) forClusterSpiffeId(obj handler.MapObject) []reconcile.Request {
+	owner := metav1.GetControllerOf(obj.Meta)
+	if owner == nil || owner.Kind != "ClusterSpiffeIdTemplate" {
+		return nil
+	}
+	selector := obj.Object.(*spiffeidv1alpha1.ClusterSpiffeId).Spec.Selector
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{Namespace: selector.Namespace, Name: selector.PodName}}}
+}
+
+func (m *podMapper) podsIn(namespace string, selector labels.Selector) []reconcile.Request {
+	pods := &corev1.PodList{}
+	if err := m.client.List(context.TODO(), pods, client.InNamespace(namespace), matchingSelector{selector}); err != nil {
+		log.Error(err, "Failed to list pods", "namespace", namespace)
+		return nil
+	}
+	requests := make([]reconcile.Request, 0, len(pods.Items))
+	for _, pod := range pods.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}})
+	}
+	return requests
+}
+
+// matchingSelector filters a list by a label selector, which may have expressions unlike client.MatchingLabels
+type matchingSelector struct {
+	labels.Selector
+}
+
+func (m matchingSelector) ApplyToList(opts *client.ListOptions) {
+	opts.LabelSelector = m.Selector
+}
@@ -0,0 +1,130 @@
+package clusterspiffeidtemplate
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/transferwise/spire-k8s-operator/pkg/apis"
+	spiffeidv1alpha1 "github.com/transferwise/spire-k8s-operator/pkg/apis/spiffeid/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	k8errors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func TestReconcileTemplatePod(t *testing.T) {
+	template := &spiffeidv1alpha1.ClusterSpiffeIdTemplate{
+		ObjectMeta: metav1.ObjectMeta{Name: "payments", UID: "payments-uid"},
+		Spec: spiffeidv1alpha1.ClusterSpiffeIdTemplateSpec{
+			NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "payments"}},
+			PodSelector: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{
+				{Key: "app", Operator: metav1.LabelSelectorOpExists},
+			}},
+			SpiffeIdTemplate: `{{with .Labels.app}}ns/{{$.Namespace}}/app/{{.}}{{end}}`,
+			DnsNameTemplates: []string{"{{.Labels.app}}.{{.Namespace}}.svc"},
+			Ttl:              3600,
+		},
+	}
+	desired := &spiffeidv1alpha1.SpiffeIdSpec{
+		SpiffeId: "spiffe://example.org/ns/default/app/web",
+		Selector: spiffeidv1alpha1.Selector{Namespace: "default", PodName: "web-0"},
+		DnsNames: []string{"web.default.svc"},
+		Ttl:      3600,
+	}
+	stale := desired.DeepCopy()
+	stale.SpiffeId = "spiffe://example.org/ns/default/app/old"
+	selected := map[string]string{"team": "payments"}
+
+	tests := []struct {
+		name            string
+		namespaceLabels map[string]string
+		// labels of the pod, which doesn't exist if nil
+		podLabels map[string]string
+		// spec of the pod's ClusterSpiffeId before the reconcile, if it has one
+		existing *spiffeidv1alpha1.SpiffeIdSpec
+		// whether the existing ClusterSpiffeId belongs to something other than the template
+		foreign bool
+		want    *spiffeidv1alpha1.SpiffeIdSpec
+	}{
+		{name: "selected", namespaceLabels: selected, podLabels: map[string]string{"app": "web"}, want: desired},
+		{name: "namespace not selected", podLabels: map[string]string{"app": "web"}},
+		{name: "pod not selected", namespaceLabels: selected, podLabels: map[string]string{"tier": "web"}, existing: desired},
+		{name: "no ID generated", namespaceLabels: selected, podLabels: map[string]string{"app": ""}},
+		{name: "changed", namespaceLabels: selected, podLabels: map[string]string{"app": "web"}, existing: stale, want: desired},
+		{name: "pod gone", namespaceLabels: selected, existing: desired},
+		{name: "foreign", namespaceLabels: selected, podLabels: map[string]string{"app": "web"}, existing: stale, foreign: true, want: stale},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scheme := runtime.NewScheme()
+			if err := clientgoscheme.AddToScheme(scheme); err != nil {
+				t.Fatal(err)
+			}
+			if err := apis.AddToScheme(scheme); err != nil {
+				t.Fatal(err)
+			}
+
+			name := generatedName(template.Name, "default", "web-0")
+			objs := []runtime.Object{
+				template.DeepCopy(),
+				&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default", Labels: tt.namespaceLabels}},
+			}
+			if tt.podLabels != nil {
+				objs = append(objs, &corev1.Pod{
+					ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web-0", Labels: tt.podLabels},
+					Status:     corev1.PodStatus{Phase: corev1.PodRunning},
+				})
+			}
+			if tt.existing != nil {
+				existing := &spiffeidv1alpha1.ClusterSpiffeId{
+					ObjectMeta: metav1.ObjectMeta{Name: name},
+					Spec:       *tt.existing.DeepCopy(),
+				}
+				if !tt.foreign {
+					if err := controllerutil.SetControllerReference(template, existing, scheme); err != nil {
+						t.Fatal(err)
+					}
+				}
+				objs = append(objs, existing)
+			}
+
+			c := fake.NewFakeClientWithScheme(scheme, objs...)
+			r := &ReconcileTemplatePod{
+				client:   c,
+				scheme:   scheme,
+				config:   ReconcileClusterSpiffeIdTemplateConfig{TrustDomain: "example.org"},
+				recorder: record.NewFakeRecorder(100),
+			}
+			request := reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "web-0"}}
+			if _, err := r.Reconcile(request); err != nil {
+				t.Fatalf("Reconcile() error = %v", err)
+			}
+
+			got := &spiffeidv1alpha1.ClusterSpiffeId{}
+			err := c.Get(context.TODO(), types.NamespacedName{Name: name}, got)
+			if tt.want == nil {
+				if !k8errors.IsNotFound(err) {
+					t.Errorf("ClusterSpiffeId %s exists with %v, want none", name, got.Spec)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got.Spec, *tt.want) {
+				t.Errorf("ClusterSpiffeId spec = %v, want %v", got.Spec, *tt.want)
+			}
+			if !tt.foreign && !metav1.IsControlledBy(got, template) {
+				t.Errorf("ClusterSpiffeId owners = %v, want it controlled by the template", got.OwnerReferences)
+			}
+		})
+	}
+}
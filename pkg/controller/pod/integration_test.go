@@ -0,0 +1,88 @@
+//go:build integration
+// +build integration
+
+package pod_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	spiffeidv1alpha1 "github.com/transferwise/spire-k8s-operator/pkg/apis/spiffeid/v1alpha1"
+	"github.com/transferwise/spire-k8s-operator/pkg/testenv"
+	corev1 "k8s.io/api/core/v1"
+	k8errors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var env *testenv.Environment
+
+// TestMain runs the tests against a local kube-apiserver, which KUBEBUILDER_ASSETS must point at along with etcd
+func TestMain(m *testing.M) {
+	var err error
+	env, err = testenv.Start(testenv.CRDDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to start test environment: %v\n", err)
+		os.Exit(1)
+	}
+	code := m.Run()
+	if err := env.Stop(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to stop test environment: %v\n", err)
+	}
+	os.Exit(code)
+}
+
+// TestPodCreatesClusterSpiffeId checks that the pod controller creates a ClusterSpiffeId owned by the pod, which
+// in turn gets a spire entry, and that deleting the pod removes the ClusterSpiffeId and its entry.
+func TestPodCreatesClusterSpiffeId(t *testing.T) {
+	namespace, err := env.CreateNamespace("pod-creates-id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "web"},
+		Spec: corev1.PodSpec{
+			ServiceAccountName: "web",
+			Containers:         []corev1.Container{{Name: "web", Image: "nginx"}},
+		},
+	}
+	if err := env.Client.Create(context.TODO(), pod); err != nil {
+		t.Fatal(err)
+	}
+
+	clusterSpiffeId := &spiffeidv1alpha1.ClusterSpiffeId{}
+	err = env.WaitFor("pod ClusterSpiffeId to be created", func() (bool, error) {
+		err := env.Client.Get(context.TODO(), types.NamespacedName{Name: "spire-operator-" + pod.Name}, clusterSpiffeId)
+		if k8errors.IsNotFound(err) {
+			return false, nil
+		}
+		return err == nil, err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner := metav1.GetControllerOf(clusterSpiffeId); owner == nil || owner.UID != pod.UID {
+		t.Fatalf("expected ClusterSpiffeId to be controlled by the pod, got %v", clusterSpiffeId.GetOwnerReferences())
+	}
+
+	entry, err := env.WaitForEntry(clusterSpiffeId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// envtest doesn't run the garbage collector, so this relies on the pod controller deleting the ClusterSpiffeId
+	if err := env.Client.Delete(context.TODO(), pod); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.WaitForDeletion(&spiffeidv1alpha1.ClusterSpiffeId{}, testenv.KeyOf(clusterSpiffeId)); err != nil {
+		t.Fatal(err)
+	}
+	err = env.WaitFor("pod entry to be deleted", func() (bool, error) {
+		return env.Spire.Entry(entry.GetEntryId()) == nil, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -3,16 +3,19 @@ package pod
 import (
 	"context"
 	"fmt"
+	"github.com/go-logr/logr"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"net/url"
 	"path"
+	"reflect"
 
-	"github.com/spiffe/spire/proto/spire/api/registration"
 	spiffeidv1alpha1 "github.com/transferwise/spire-k8s-operator/pkg/apis/spiffeid/v1alpha1"
+	"github.com/transferwise/spire-k8s-operator/pkg/spiremgr"
 	corev1 "k8s.io/api/core/v1"
 	k8errors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
@@ -28,16 +31,21 @@ var log = logf.Log.WithName("controller_pod")
 // Add creates a new SpiffeId Controller and adds it to the Manager. The Manager will set fields on the Controller
 // and Start it when the Manager is Started.
 func Add(mgr manager.Manager, conf PodReconcilerConfig) error {
-	return add(mgr, newReconciler(mgr, conf))
+	return add(mgr, newReconciler(mgr, conf), conf.Namespaced)
 }
 
 // newReconciler returns a new reconcile.Reconciler
 func newReconciler(mgr manager.Manager, conf PodReconcilerConfig) reconcile.Reconciler {
-	return &ReconcilePod{client: mgr.GetClient(), scheme: mgr.GetScheme(), config: conf}
+	return &ReconcilePod{
+		client:   mgr.GetClient(),
+		scheme:   mgr.GetScheme(),
+		config:   conf,
+		recorder: mgr.GetEventRecorderFor("pod-controller"),
+	}
 }
 
 // add adds a new Controller to mgr with r as the reconcile.Reconciler
-func add(mgr manager.Manager, r reconcile.Reconciler) error {
+func add(mgr manager.Manager, r reconcile.Reconciler, namespaced bool) error {
 	// Create a new controller
 	c, err := controller.New("pod-controller", mgr, controller.Options{Reconciler: r})
 	if err != nil {
@@ -50,10 +58,34 @@ func add(mgr manager.Manager, r reconcile.Reconciler) error {
 		return err
 	}
 
-	err = c.Watch(&source.Kind{Type: &spiffeidv1alpha1.ClusterSpiffeId{}}, &handler.EnqueueRequestForOwner{
-		IsController: true,
-		OwnerType:    &corev1.Pod{},
+	if namespaced {
+		err = c.Watch(&source.Kind{Type: &spiffeidv1alpha1.SpiffeId{}}, &handler.EnqueueRequestForOwner{
+			IsController: true,
+			OwnerType:    &corev1.Pod{},
+		})
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// ClusterSpiffeIds are cluster scoped, so EnqueueRequestForOwner can't find the namespace of their Pod. Map them
+	// back using the selector they were generated with instead.
+	err = c.Watch(&source.Kind{Type: &spiffeidv1alpha1.ClusterSpiffeId{}}, &handler.EnqueueRequestsFromMapFunc{
+		ToRequests: handler.ToRequestsFunc(func(obj handler.MapObject) []reconcile.Request {
+			clusterSpiffeId, ok := obj.Object.(*spiffeidv1alpha1.ClusterSpiffeId)
+			if !ok || !isGenerated(clusterSpiffeId) {
+				return nil
+			}
+			return []reconcile.Request{{NamespacedName: types.NamespacedName{
+				Namespace: clusterSpiffeId.Spec.Selector.Namespace,
+				Name:      clusterSpiffeId.Spec.Selector.PodName,
+			}}}
+		}),
 	})
+	if err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -67,22 +99,27 @@ const (
 	PodReconcilerModeServiceAccount PodReconcilerMode = iota
 	PodReconcilerModeLabel
 	PodReconcilerModeAnnotation
+	PodReconcilerModeTemplate
 )
 
 type PodReconcilerConfig struct {
 	TrustDomain string
 	Mode        PodReconcilerMode
 	Value       string
+	// Generates each pod's spiffe ID in PodReconcilerModeTemplate
+	Template *spiremgr.IdTemplate
+	// Generate namespaced SpiffeIds in the pod's namespace rather than ClusterSpiffeIds
+	Namespaced bool
 }
 
 // ReconcilePod reconciles a Pod object
 type ReconcilePod struct {
 	// This client, initialized using mgr.Client() above, is a split client
 	// that reads objects from the cache and writes to the apiserver
-	client      client.Client
-	scheme      *runtime.Scheme
-	spireClient registration.RegistrationClient
-	config      PodReconcilerConfig
+	client   client.Client
+	scheme   *runtime.Scheme
+	config   PodReconcilerConfig
+	recorder record.EventRecorder
 }
 
 // Reconcile reads that state of the cluster for a SpiffeId object and makes changes based on the state read
@@ -93,79 +130,214 @@ type ReconcilePod struct {
 func (r *ReconcilePod) Reconcile(request reconcile.Request) (reconcile.Result, error) {
 	reqLogger := log.WithValues("Request.Namespace", request.Namespace, "Request.Name", request.Name)
 
+	key := r.generatedKey(request.NamespacedName)
+	kind := r.generatedKind()
+
 	// Fetch the Pod instance
 	pod := &corev1.Pod{}
 	err := r.client.Get(context.TODO(), request.NamespacedName, pod)
 	if err != nil {
 		if k8errors.IsNotFound(err) {
-			// If the resource is not found, that means all of
-			// the finalizers have been removed, and the
-			// resource has been deleted, so there is nothing left
-			// to do.
-			return reconcile.Result{}, nil
+			// The pod is gone. Owner references from a cluster scoped object to a namespaced one aren't reliably
+			// garbage collected, so delete the generated object here.
+			return reconcile.Result{}, r.deleteGenerated(reqLogger, key, request.NamespacedName)
 		}
 		// Error reading the object - requeue the request.
 		return reconcile.Result{}, err
 	}
 
-	spiffeidname := fmt.Sprintf("spire-operator-%s", pod.GetName())
-
-	spiffeId := ""
-	switch r.config.Mode {
-	case PodReconcilerModeServiceAccount:
-		spiffeId = r.makeID("ns/%s/sa/%s", request.Namespace, pod.Spec.ServiceAccountName)
-	case PodReconcilerModeLabel:
-		if val, ok := pod.GetLabels()[r.config.Value]; ok {
-			spiffeId = r.makeID("%s", val)
-		} else {
-			// No relevant label
-			return reconcile.Result{}, nil
-		}
-	case PodReconcilerModeAnnotation:
-		if val, ok := pod.GetAnnotations()[r.config.Value]; ok {
-			spiffeId = r.makeID("%s", val)
-		} else {
-			// No relevant annotation
-			return reconcile.Result{}, nil
-		}
+	spiffeId, err := r.podSpiffeId(pod)
+	if err != nil {
+		// Retrying won't help until the pod or the template changes
+		reqLogger.Error(err, "Failed to generate spiffe ID")
+		r.recorder.Event(pod, corev1.EventTypeWarning, "SpiffeIdFailed", fmt.Sprintf("Failed to generate spiffe ID: %v", err))
+		return reconcile.Result{}, nil
 	}
 	reqLogger.Info("Reconciling Pod")
 
-	existing := &spiffeidv1alpha1.ClusterSpiffeId{}
-	err = r.client.Get(context.TODO(), types.NamespacedName{Name: spiffeidname}, existing)
+	existing := r.newGenerated()
+	err = r.client.Get(context.TODO(), key, existing)
 	if err != nil && k8errors.IsNotFound(err) {
-		clusterSpiffeId := &spiffeidv1alpha1.ClusterSpiffeId{
-			ObjectMeta: v1.ObjectMeta{
-				Name: spiffeidname,
-			},
-			Spec: spiffeidv1alpha1.SpiffeIdSpec{
-				SpiffeId: spiffeId,
-				Selector: spiffeidv1alpha1.Selector{
-					PodName: pod.Name,
-				},
-			},
+		if len(spiffeId) == 0 {
+			// No relevant label or annotation
+			return reconcile.Result{}, nil
 		}
-		err = controllerutil.SetControllerReference(pod, clusterSpiffeId, r.scheme)
+		generated := r.newGenerated()
+		generated.SetNamespace(key.Namespace)
+		generated.SetName(key.Name)
+		*generated.GetSpec() = r.podSpec(pod, spiffeId)
+		err = controllerutil.SetControllerReference(pod, generated, r.scheme)
 		if err != nil {
-			reqLogger.Error(err, "Failed to create new SpiffeID", "SpiffeID.Name", clusterSpiffeId.Name)
+			reqLogger.Error(err, "Failed to create new SpiffeID", "SpiffeID.Name", key.Name)
 			return reconcile.Result{}, err
 		}
-		reqLogger.Info("Creating a new SpiffeID", "SpiffeID.Name", clusterSpiffeId.Name)
-		err = r.client.Create(context.TODO(), clusterSpiffeId)
+		reqLogger.Info("Creating a new SpiffeID", "SpiffeID.Name", key.Name, "kind", kind)
+		err = r.client.Create(context.TODO(), generated)
 		if err != nil {
-			reqLogger.Error(err, "Failed to create new SpiffeID", "SpiffeID.Name", clusterSpiffeId.Name)
+			reqLogger.Error(err, "Failed to create new SpiffeID", "SpiffeID.Name", key.Name)
+			r.recorder.Event(pod, corev1.EventTypeWarning, "SpiffeIdFailed", fmt.Sprintf("Failed to create %s %s: %v", kind, key.Name, err))
 			return reconcile.Result{}, err
 		}
+		r.recorder.Event(pod, corev1.EventTypeNormal, "SpiffeIdCreated", fmt.Sprintf("Created %s %s for %s", kind, key.Name, spiffeId))
 		// SpiffeID created successfully
 		return reconcile.Result{}, nil
 	} else if err != nil {
-		reqLogger.Error(err, "Failed to get SpiffeID", "name", spiffeidname)
+		reqLogger.Error(err, "Failed to get SpiffeID", "name", key.Name)
+		return reconcile.Result{}, err
+	}
+
+	// ClusterSpiffeIds created before the namespace was added to the selector are only known by their owner
+	if !generatedFor(existing, request.NamespacedName) && !v1.IsControlledBy(existing, pod) {
+		// Most likely a pod with the same name in another namespace, or a SpiffeId created by hand
+		if len(spiffeId) > 0 {
+			reqLogger.Info("SpiffeID already exists for something else, not changing it", "SpiffeID.Name", key.Name)
+			r.recorder.Event(pod, corev1.EventTypeWarning, "SpiffeIdConflict", fmt.Sprintf("%s %s already belongs to something else", kind, key.Name))
+		}
+		return reconcile.Result{}, nil
+	}
+
+	if !existing.GetDeletionTimestamp().IsZero() {
+		// Wait for the old one to go, and create a new one when the deletion is seen
+		return reconcile.Result{}, nil
+	}
+
+	if len(spiffeId) == 0 {
+		// The label or annotation was removed
+		reqLogger.Info("Pod no longer has a spiffe ID, deleting SpiffeID", "SpiffeID.Name", key.Name)
+		if err := r.client.Delete(context.TODO(), existing); err != nil && !k8errors.IsNotFound(err) {
+			reqLogger.Error(err, "Failed to delete SpiffeID", "SpiffeID.Name", key.Name)
+			return reconcile.Result{}, err
+		}
+		r.recorder.Event(pod, corev1.EventTypeNormal, "SpiffeIdDeleted", fmt.Sprintf("Deleted %s %s", kind, key.Name))
+		return reconcile.Result{}, nil
+	}
+
+	desired := r.podSpec(pod, spiffeId)
+	controlled := v1.IsControlledBy(existing, pod)
+	if controlled && reflect.DeepEqual(*existing.GetSpec(), desired) {
+		return reconcile.Result{}, nil
+	}
+
+	oldSpiffeId := existing.GetSpec().SpiffeId
+	reqLogger.Info("Updating SpiffeID", "SpiffeID.Name", key.Name, "from", oldSpiffeId, "to", spiffeId)
+	*existing.GetSpec() = desired
+	if !controlled {
+		// Left behind by an earlier pod with the same name, e.g. from a StatefulSet
+		existing.SetOwnerReferences(nil)
+		if err := controllerutil.SetControllerReference(pod, existing, r.scheme); err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+	if err := r.client.Update(context.TODO(), existing); err != nil {
+		reqLogger.Error(err, "Failed to update SpiffeID", "SpiffeID.Name", key.Name)
+		r.recorder.Event(pod, corev1.EventTypeWarning, "SpiffeIdFailed", fmt.Sprintf("Failed to update %s %s: %v", kind, key.Name, err))
 		return reconcile.Result{}, err
 	}
+	if oldSpiffeId != spiffeId {
+		r.recorder.Event(pod, corev1.EventTypeNormal, "SpiffeIdUpdated", fmt.Sprintf("Updated %s %s from %s to %s", kind, key.Name, oldSpiffeId, spiffeId))
+	}
 
 	return reconcile.Result{}, nil
 }
 
+// podSpiffeId returns the spiffe ID the pod should have, or "" if it shouldn't have one
+func (r *ReconcilePod) podSpiffeId(pod *corev1.Pod) (string, error) {
+	switch r.config.Mode {
+	case PodReconcilerModeServiceAccount:
+		return r.makeID("ns/%s/sa/%s", pod.Namespace, pod.Spec.ServiceAccountName), nil
+	case PodReconcilerModeLabel:
+		if val, ok := pod.GetLabels()[r.config.Value]; ok {
+			return r.makeID("%s", val), nil
+		}
+	case PodReconcilerModeAnnotation:
+		if val, ok := pod.GetAnnotations()[r.config.Value]; ok {
+			return r.makeID("%s", val), nil
+		}
+	case PodReconcilerModeTemplate:
+		return r.config.Template.Execute(pod)
+	}
+	return "", nil
+}
+
+// deleteGenerated deletes the SpiffeId or ClusterSpiffeId with the given key if it was generated for the pod
+func (r *ReconcilePod) deleteGenerated(reqLogger logr.Logger, key types.NamespacedName, pod types.NamespacedName) error {
+	existing := r.newGenerated()
+	err := r.client.Get(context.TODO(), key, existing)
+	if err != nil {
+		if k8errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if !generatedFor(existing, pod) || !existing.GetDeletionTimestamp().IsZero() {
+		return nil
+	}
+	reqLogger.Info("Pod deleted, deleting SpiffeID", "SpiffeID.Name", key.Name)
+	if err := r.client.Delete(context.TODO(), existing); err != nil && !k8errors.IsNotFound(err) {
+		reqLogger.Error(err, "Failed to delete SpiffeID", "SpiffeID.Name", key.Name)
+		return err
+	}
+	return nil
+}
+
+// newGenerated returns an empty object of the kind generated for pods
+func (r *ReconcilePod) newGenerated() spiffeidv1alpha1.CommonSpiffeId {
+	if r.config.Namespaced {
+		return &spiffeidv1alpha1.SpiffeId{}
+	}
+	return &spiffeidv1alpha1.ClusterSpiffeId{}
+}
+
+func (r *ReconcilePod) generatedKind() string {
+	if r.config.Namespaced {
+		return "SpiffeId"
+	}
+	return "ClusterSpiffeId"
+}
+
+// generatedKey returns the key of the object generated for the pod. Namespaced SpiffeIds live alongside their
+// pod, so can't collide with those of pods in other namespaces.
+func (r *ReconcilePod) generatedKey(pod types.NamespacedName) types.NamespacedName {
+	if r.config.Namespaced {
+		return types.NamespacedName{Namespace: pod.Namespace, Name: spiremgr.GeneratedName(pod.Name)}
+	}
+	return types.NamespacedName{Name: spiremgr.GeneratedName(pod.Name)}
+}
+
+func (r *ReconcilePod) podSpec(pod *corev1.Pod, spiffeId string) spiffeidv1alpha1.SpiffeIdSpec {
+	spec := spiffeidv1alpha1.SpiffeIdSpec{
+		SpiffeId: spiffeId,
+		Selector: spiffeidv1alpha1.Selector{
+			PodName: pod.Name,
+		},
+	}
+	// Namespaced SpiffeIds always select their own namespace
+	if !r.config.Namespaced {
+		spec.Selector.Namespace = pod.Namespace
+	}
+	return spec
+}
+
+// isGenerated returns true if the ClusterSpiffeId was created by this controller
+func isGenerated(clusterSpiffeId *spiffeidv1alpha1.ClusterSpiffeId) bool {
+	return len(clusterSpiffeId.Spec.Selector.Namespace) > 0 && isOwnedByPod(clusterSpiffeId)
+}
+
+func isOwnedByPod(instance spiffeidv1alpha1.CommonSpiffeId) bool {
+	owner := v1.GetControllerOf(instance)
+	return owner != nil && owner.Kind == "Pod" && owner.APIVersion == "v1" && instance.GetSpec().Selector.PodName == owner.Name
+}
+
+// generatedFor returns true if the SpiffeId or ClusterSpiffeId was created by this controller for the named pod, or
+// for an earlier pod with the same name
+func generatedFor(instance spiffeidv1alpha1.CommonSpiffeId, pod types.NamespacedName) bool {
+	namespace := instance.GetNamespace()
+	if len(namespace) == 0 {
+		namespace = instance.GetSpec().Selector.Namespace
+	}
+	return isOwnedByPod(instance) && namespace == pod.Namespace && instance.GetSpec().Selector.PodName == pod.Name
+}
+
 func (r *ReconcilePod) makeID(pathFmt string, pathArgs ...interface{}) string {
 	id := url.URL{
 		Scheme: "spiffe",
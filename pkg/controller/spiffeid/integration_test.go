@@ -0,0 +1,124 @@
+//go:build integration
+// +build integration
+
+package SpiffeId_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	spiffeidv1alpha1 "github.com/transferwise/spire-k8s-operator/pkg/apis/spiffeid/v1alpha1"
+	"github.com/transferwise/spire-k8s-operator/pkg/spiremgr/fakespire"
+	"github.com/transferwise/spire-k8s-operator/pkg/testenv"
+)
+
+var env *testenv.Environment
+
+// TestMain runs the tests against a local kube-apiserver, which KUBEBUILDER_ASSETS must point at along with etcd
+func TestMain(m *testing.M) {
+	var err error
+	env, err = testenv.Start(testenv.CRDDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to start test environment: %v\n", err)
+		os.Exit(1)
+	}
+	code := m.Run()
+	if err := env.Stop(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to stop test environment: %v\n", err)
+	}
+	os.Exit(code)
+}
+
+// TestSpiffeIdCreatesEntry checks that a SpiffeId gets a matching spire entry and reports it in its status.
+func TestSpiffeIdCreatesEntry(t *testing.T) {
+	namespace, err := env.CreateNamespace("spiffeid-creates-entry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	spiffeId := env.NewSpiffeId(namespace, "web")
+	if err := env.Client.Create(context.TODO(), spiffeId); err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := env.WaitForEntry(spiffeId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.GetSpiffeId() != spiffeId.Spec.SpiffeId {
+		t.Errorf("expected entry for %s, got %s", spiffeId.Spec.SpiffeId, entry.GetSpiffeId())
+	}
+	if !spiffeId.Status.IsConditionTrue(spiffeidv1alpha1.SpiffeIdReady) {
+		t.Errorf("expected SpiffeId to be Ready, got conditions %v", spiffeId.Status.Conditions)
+	}
+}
+
+// TestDeleteRemovesFinalizerAndEntry checks that deleting a SpiffeId deletes its spire entry and that the
+// finalizer is removed so the SpiffeId goes away.
+func TestDeleteRemovesFinalizerAndEntry(t *testing.T) {
+	namespace, err := env.CreateNamespace("delete-removes-entry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	spiffeId := env.NewSpiffeId(namespace, "web")
+	if err := env.Client.Create(context.TODO(), spiffeId); err != nil {
+		t.Fatal(err)
+	}
+	entry, err := env.WaitForEntry(spiffeId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(spiffeId.GetFinalizers()) == 0 {
+		t.Fatal("expected SpiffeId to have a finalizer")
+	}
+
+	if err := env.Client.Delete(context.TODO(), spiffeId); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.WaitForDeletion(&spiffeidv1alpha1.SpiffeId{}, testenv.KeyOf(spiffeId)); err != nil {
+		t.Fatal(err)
+	}
+	if env.Spire.Entry(entry.GetEntryId()) != nil {
+		t.Errorf("expected entry %s to be deleted", entry.GetEntryId())
+	}
+}
+
+// TestRestartIsIdempotent checks that restarting the operator doesn't create, change or delete any entries.
+func TestRestartIsIdempotent(t *testing.T) {
+	namespace, err := env.CreateNamespace("restart-idempotent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	spiffeId := env.NewSpiffeId(namespace, "web")
+	if err := env.Client.Create(context.TODO(), spiffeId); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.WaitForEntry(spiffeId); err != nil {
+		t.Fatal(err)
+	}
+
+	before := env.Spire.Entries()
+	fetches := env.Spire.Calls(fakespire.MethodFetchEntry)
+	if err := env.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	// Every existing SpiffeId is reconciled on startup, fetching its entry
+	err = env.WaitFor("SpiffeIds to be reconciled after restart", func() (bool, error) {
+		return env.Spire.Calls(fakespire.MethodFetchEntry) > fetches, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	after := env.Spire.Entries()
+	if len(before) != len(after) {
+		t.Fatalf("entries changed across restart: before %v, after %v", before, after)
+	}
+	for i := range before {
+		if !proto.Equal(before[i], after[i]) {
+			t.Errorf("entry changed across restart: before %v, after %v", before[i], after[i])
+		}
+	}
+}
@@ -4,12 +4,13 @@ import (
 	"context"
 	"fmt"
 	"github.com/go-logr/logr"
-	"github.com/spiffe/spire/proto/spire/api/registration"
 	"github.com/spiffe/spire/proto/spire/common"
 	spiffeidv1alpha1 "github.com/transferwise/spire-k8s-operator/pkg/apis/spiffeid/v1alpha1"
+	"github.com/transferwise/spire-k8s-operator/pkg/metrics"
 	"github.com/transferwise/spire-k8s-operator/pkg/spiremgr"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
 	k8errors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -19,27 +20,41 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/manager"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 	"sigs.k8s.io/controller-runtime/pkg/source"
+	"time"
 )
 
 const spiffeIdFinalizer = "finalizer.spiffeid.spiffe.io"
 
+const controllerName = "spiffeid-controller"
+
 var log = logf.Log.WithName("controller_spiffeid")
 
 // Add creates a new SpiffeId Controller and adds it to the Manager. The Manager will set fields on the Controller
 // and Start it when the Manager is Started.
-func Add(mgr manager.Manager, r registration.RegistrationClient, conf ReconcileSpiffeIdConfig) error {
-	return add(mgr, newReconciler(mgr, r, conf))
+func Add(mgr manager.Manager, backend spiremgr.Backend, conf ReconcileSpiffeIdConfig) error {
+	return add(mgr, newReconciler(mgr, backend, conf), conf.MaxConcurrentReconciles)
 }
 
 // newReconciler returns a new reconcile.Reconciler
-func newReconciler(mgr manager.Manager, r registration.RegistrationClient, conf ReconcileSpiffeIdConfig) reconcile.Reconciler {
-	return &ReconcileSpiffeId{client: mgr.GetClient(), scheme: mgr.GetScheme(), spireClient: r, conf: conf, utils: spiremgr.SpireUtils{SpireClient: r}, finalizer: spiremgr.Finalizer{Client: mgr.GetClient(), FinalizerName: spiffeIdFinalizer}}
+func newReconciler(mgr manager.Manager, backend spiremgr.Backend, conf ReconcileSpiffeIdConfig) reconcile.Reconciler {
+	return &ReconcileSpiffeId{
+		client:    mgr.GetClient(),
+		scheme:    mgr.GetScheme(),
+		conf:      conf,
+		utils:     spiremgr.SpireUtils{Backend: spiremgr.InstrumentBackend(backend, controllerName), TrustDomain: conf.TrustDomain, Cluster: conf.Cluster, CallTimeout: conf.CallTimeout},
+		finalizer: spiremgr.Finalizer{Client: mgr.GetClient(), FinalizerName: spiffeIdFinalizer},
+		status:    spiremgr.StatusUpdater{Client: mgr.GetClient(), Controller: controllerName, RefreshInterval: conf.ResyncInterval},
+		resync:    spiremgr.Resyncer{Interval: conf.ResyncInterval},
+		recorder:  spiremgr.EventRecorder{Recorder: mgr.GetEventRecorderFor(controllerName)},
+		validator: spiremgr.Validator{TrustDomain: conf.TrustDomain, AllowablePatterns: conf.AllowablePatterns},
+		policy:    spiremgr.PolicyEvaluator{Client: mgr.GetClient()},
+	}
 }
 
 // add adds a new Controller to mgr with r as the reconcile.Reconciler
-func add(mgr manager.Manager, r reconcile.Reconciler) error {
+func add(mgr manager.Manager, r reconcile.Reconciler, maxConcurrentReconciles int) error {
 	// Create a new controller
-	c, err := controller.New("spiffeid-controller", mgr, controller.Options{Reconciler: r})
+	c, err := controller.New(controllerName, mgr, controller.Options{Reconciler: metrics.InstrumentReconciler(controllerName, r), MaxConcurrentReconciles: maxConcurrentReconciles})
 	if err != nil {
 		return err
 	}
@@ -50,6 +65,16 @@ func add(mgr manager.Manager, r reconcile.Reconciler) error {
 		return err
 	}
 
+	// Check the SpiffeIds a SpiffeIdPolicy applies to again when it changes. Both the old and new versions of
+	// updated policies are mapped, so SpiffeIds the policy stops applying to are checked too.
+	policies := &policyMapper{client: mgr.GetClient(), policy: spiremgr.PolicyEvaluator{Client: mgr.GetClient()}}
+	err = c.Watch(&source.Kind{Type: &spiffeidv1alpha1.SpiffeIdPolicy{}}, &handler.EnqueueRequestsFromMapFunc{
+		ToRequests: handler.ToRequestsFunc(policies.forPolicy),
+	})
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -59,20 +84,31 @@ var _ reconcile.Reconciler = &ReconcileSpiffeId{}
 type ReconcileSpiffeIdConfig struct {
 	TrustDomain string
 	Cluster     string
-	AllowablePatterns	[]string
+	// Patterns the spiffe IDs of SpiffeIds must match, e.g. spiffe://{trustDomain}/ns/{namespace}/*
+	AllowablePatterns []string
+	// How often to check the spire entry for drift. Zero disables periodic checks.
+	ResyncInterval time.Duration
+	// Number of SpiffeIds reconciled in parallel, which lets entry/v1 calls be batched together
+	MaxConcurrentReconciles int
+	// Deadline for each call to the spire server. Zero uses spiremgr.DefaultCallTimeout.
+	CallTimeout time.Duration
 }
 
 // ReconcileSpiffeId reconciles a SpiffeId object
 type ReconcileSpiffeId struct {
 	// This client, initialized using mgr.Client() above, is a split client
 	// that reads objects from the cache and writes to the apiserver
-	client      client.Client
-	scheme      *runtime.Scheme
-	spireClient registration.RegistrationClient
-	conf        ReconcileSpiffeIdConfig
-	myId        *string
-	utils       spiremgr.SpireUtils
-	finalizer   spiremgr.Finalizer
+	client    client.Client
+	scheme    *runtime.Scheme
+	conf      ReconcileSpiffeIdConfig
+	myId      *string
+	utils     spiremgr.SpireUtils
+	finalizer spiremgr.Finalizer
+	status    spiremgr.StatusUpdater
+	resync    spiremgr.Resyncer
+	recorder  spiremgr.EventRecorder
+	validator spiremgr.Validator
+	policy    spiremgr.PolicyEvaluator
 }
 
 // Reconcile reads that state of the cluster for a SpiffeId object and makes changes based on the state read
@@ -93,48 +129,126 @@ func (r *ReconcileSpiffeId) Reconcile(request reconcile.Request) (reconcile.Resu
 			// the finalizers have been removed, and the
 			// resource has been deleted, so there is nothing left
 			// to do.
+			metrics.ForgetOutOfSync(controllerName, request.NamespacedName)
 			return reconcile.Result{}, nil
 		}
 		// Error reading the object - requeue the request.
 		return reconcile.Result{}, err
 	}
 
-    if r.finalizer.Finalizable(instance) {
-        if err := r.finalizer.Finalize(log, instance, func() error {
-          return r.utils.DeleteEntry(log, instance.Status.EntryId)
-        }); err != nil {
-            return reconcile.Result{}, err
-        }
-        return reconcile.Result{}, nil
-    }
+	if r.finalizer.Finalizable(instance) {
+		if err := r.finalizer.Finalize(log, instance, func() error {
+			if err := r.utils.DeleteEntry(log, instance.Status.EntryId); err != nil {
+				return err
+			}
+			if len(instance.Status.EntryId) > 0 {
+				metrics.EntryOperations.WithLabelValues(controllerName, "deleted").Inc()
+				r.recorder.Event(instance, corev1.EventTypeNormal, spiremgr.EventEntryDeleted, "Deleted spire entry "+instance.Status.EntryId)
+			}
+			return nil
+		}); err != nil {
+			metrics.FinalizerFailures.WithLabelValues(controllerName).Inc()
+			r.recorder.Event(instance, corev1.EventTypeWarning, spiremgr.ReasonFinalizerFailed, "Failed to finalize: "+err.Error())
+			r.status.SetFailed(reqLogger, instance, spiremgr.ReasonFinalizerFailed, err)
+			return reconcile.Result{}, err
+		}
+		r.status.Forget(instance)
+		return reconcile.Result{}, nil
+	}
 
 	if err := r.finalizer.AddFinalizer(reqLogger, instance); err != nil {
+		metrics.FinalizerFailures.WithLabelValues(controllerName).Inc()
+		r.recorder.Event(instance, corev1.EventTypeWarning, spiremgr.ReasonFinalizerFailed, "Failed to add finalizer: "+err.Error())
+		r.status.SetFailed(reqLogger, instance, spiremgr.ReasonFinalizerFailed, err)
 		return reconcile.Result{}, err
 	}
 
-	entryId, err := r.createSpireEntry(reqLogger, instance)
+	if errs := r.validator.Validate(instance); len(errs) > 0 {
+		// Retrying won't help, so wait for the spec to be fixed rather than requeueing
+		err := errs.ToAggregate()
+		reqLogger.Info("Invalid SpiffeId spec", "error", err.Error())
+		r.recorder.Event(instance, corev1.EventTypeWarning, spiremgr.ReasonInvalidSpec, err.Error())
+		if err := r.reject(reqLogger, instance, spiremgr.ReasonInvalidSpec, err); err != nil {
+			return reconcile.Result{}, err
+		}
+		return reconcile.Result{}, nil
+	}
+
+	if errs := r.validator.CheckPolicy(instance); len(errs) > 0 {
+		err := errs.ToAggregate()
+		reqLogger.Info("SpiffeId violates policy", "error", err.Error())
+		r.recorder.Event(instance, corev1.EventTypeWarning, spiremgr.ReasonPolicyViolation, err.Error())
+		if err := r.reject(reqLogger, instance, spiremgr.ReasonPolicyViolation, err); err != nil {
+			return reconcile.Result{}, err
+		}
+		return reconcile.Result{}, nil
+	}
+
+	denials, err := r.policy.Evaluate(instance)
+	if err != nil {
+		reqLogger.Error(err, "Failed to evaluate SpiffeIdPolicies")
+		return reconcile.Result{}, err
+	}
+	if len(denials) > 0 {
+		// Policy changes are watched, but check again on the next resync in case one was missed
+		err := denials.ToAggregate()
+		reqLogger.Info("SpiffeId denied by policy", "error", err.Error())
+		r.recorder.Event(instance, corev1.EventTypeWarning, spiremgr.ReasonPolicyDenied, err.Error())
+		if err := r.reject(reqLogger, instance, spiremgr.ReasonPolicyDenied, err); err != nil {
+			return reconcile.Result{}, err
+		}
+		return r.resync.Result(), nil
+	}
+
+	entryId, outcome, err := r.createSpireEntry(reqLogger, instance)
 	if err != nil {
 		if status.Code(err) == codes.AlreadyExists && instance.Status.EntryId == entryId {
 			return reconcile.Result{}, nil
 		}
+		r.recorder.SpireError(instance, err)
+		r.status.SetFailed(reqLogger, instance, spiremgr.ReasonSpireError, err)
 		return reconcile.Result{}, err
 	}
+	if outcome != spiremgr.EntryUnchanged {
+		metrics.EntryOperations.WithLabelValues(controllerName, outcome.String()).Inc()
+	}
+	r.recorder.EntrySynced(instance, entryId, outcome)
 
-	if instance.Status.EntryId != entryId {
-		instance.Status.EntryId = entryId
-		err = r.client.Status().Update(context.TODO(), instance)
-		if err != nil {
-			reqLogger.Error(err, "Failed to update SpiffeId to add entry ID", "entryID", entryId)
-			return reconcile.Result{}, err
-		}
+	reason, message := spiremgr.ReasonEntrySynced, ""
+	if r.resync.IsRepair(instance, outcome) {
+		message = fmt.Sprintf("Spire entry drifted from the spec and was %s as %s", outcome, entryId)
+		reqLogger.Info("Repaired spire entry", "entryID", entryId, "outcome", outcome.String())
+		r.recorder.Event(instance, corev1.EventTypeWarning, spiremgr.ReasonEntryRepaired, message)
+		reason = spiremgr.ReasonEntryRepaired
 	}
 
-	return reconcile.Result{}, nil
-}
+	if err := r.status.SetSynced(reqLogger, instance, entryId, reason, message); err != nil {
+		return reconcile.Result{}, err
+	}
 
+	return r.resync.Result(), nil
+}
 
+// reject reports why the SpiffeId can't have a spire entry. Any entry it already has is deleted, so that it stops
+// being issued SVIDs.
+func (r *ReconcileSpiffeId) reject(reqLogger logr.Logger, instance *spiffeidv1alpha1.SpiffeId, reason string, cause error) error {
+	if entryId := instance.Status.EntryId; len(entryId) > 0 {
+		reqLogger.Info("Deleting spire entry of rejected SpiffeId", "entryID", entryId)
+		if err := r.utils.DeleteEntry(reqLogger, entryId); err != nil {
+			r.recorder.SpireError(instance, err)
+			return err
+		}
+		metrics.EntryOperations.WithLabelValues(controllerName, "deleted").Inc()
+		r.recorder.Event(instance, corev1.EventTypeNormal, spiremgr.EventEntryDeleted, fmt.Sprintf("Deleted spire entry %s: %s", entryId, reason))
+		if err := r.status.ClearEntry(reqLogger, instance); err != nil {
+			return err
+		}
+	}
+	r.status.SetFailed(reqLogger, instance, reason, cause)
+	return nil
+}
 
-func (r *ReconcileSpiffeId) createSpireEntry(reqLogger logr.Logger, instance *spiffeidv1alpha1.SpiffeId) (string, error) {
+func (r *ReconcileSpiffeId) createSpireEntry(reqLogger logr.Logger, instance *spiffeidv1alpha1.SpiffeId) (string, spiremgr.EntryOutcome, error) {
 	// TODO: sanitize!
 	selectors := make([]*common.Selector, 0, len(instance.Spec.Selector.PodLabel))
 	for k, v := range instance.Spec.Selector.PodLabel {
@@ -148,9 +262,37 @@ func (r *ReconcileSpiffeId) createSpireEntry(reqLogger logr.Logger, instance *sp
 	}
 	selectors = append(selectors, &common.Selector{Value: fmt.Sprintf("k8s:ns:%s", instance.GetNamespace())})
 
-	return r.utils.GetOrCreateEntry(reqLogger, instance.Spec.SpiffeId, selectors)
+	return r.utils.EnsureEntry(reqLogger, instance.Status.EntryId, spiremgr.EntryFromSpec(&instance.Spec, selectors))
 }
 
 func (r *ReconcileSpiffeId) finalizeSpiffeId(reqLogger logr.Logger, instance *spiffeidv1alpha1.SpiffeId) error {
 	return r.utils.DeleteEntry(reqLogger, instance.Status.EntryId)
 }
+
+// policyMapper maps SpiffeIdPolicies to the SpiffeIds they apply to
+type policyMapper struct {
+	client client.Client
+	policy spiremgr.PolicyEvaluator
+}
+
+func (m *policyMapper) forPolicy(obj handler.MapObject) []reconcile.Request {
+	list := &spiffeidv1alpha1.SpiffeIdList{}
+	if err := m.client.List(context.TODO(), list); err != nil {
+		log.Error(err, "Failed to list SpiffeIds")
+		return nil
+	}
+	instances := make([]spiffeidv1alpha1.CommonSpiffeId, 0, len(list.Items))
+	for i := range list.Items {
+		instances = append(instances, &list.Items[i])
+	}
+	keys, err := m.policy.Affected(obj.Object.(*spiffeidv1alpha1.SpiffeIdPolicy), instances)
+	if err != nil {
+		log.Error(err, "Failed to find the SpiffeIds a SpiffeIdPolicy applies to", "SpiffeIdPolicy.Name", obj.Meta.GetName())
+		return nil
+	}
+	requests := make([]reconcile.Request, 0, len(keys))
+	for _, key := range keys {
+		requests = append(requests, reconcile.Request{NamespacedName: key})
+	}
+	return requests
+}
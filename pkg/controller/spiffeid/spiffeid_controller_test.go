@@ -0,0 +1,193 @@
+package SpiffeId
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/spiffe/spire/proto/spire/common"
+	"github.com/transferwise/spire-k8s-operator/pkg/apis"
+	spiffeidv1alpha1 "github.com/transferwise/spire-k8s-operator/pkg/apis/spiffeid/v1alpha1"
+	"github.com/transferwise/spire-k8s-operator/pkg/spiremgr"
+	"github.com/transferwise/spire-k8s-operator/pkg/spiremgr/fakespire"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+const testSpiffeId = "spiffe://example.org/ns/default/app/web"
+
+func TestReconcile(t *testing.T) {
+	tests := []struct {
+		name string
+		// spiffe ID of the SpiffeId, testSpiffeId if empty
+		spiffeId string
+		// TTL of the existing spire entry, if there is one
+		existingTtl int32
+		// whether the existing entry is removed from spire behind the operator's back
+		removed bool
+		// whether the SpiffeId is being deleted
+		deleting bool
+		policy   *spiffeidv1alpha1.SpiffeIdPolicySpec
+		// whether the SpiffeId should end up with a spire entry
+		wantEntry  bool
+		wantReason string
+	}{
+		{name: "create", wantEntry: true, wantReason: spiremgr.ReasonEntrySynced},
+		{name: "unchanged", existingTtl: 3600, wantEntry: true, wantReason: spiremgr.ReasonEntrySynced},
+		{name: "drifted", existingTtl: 60, wantEntry: true, wantReason: spiremgr.ReasonEntrySynced},
+		{name: "removed", existingTtl: 3600, removed: true, wantEntry: true, wantReason: spiremgr.ReasonEntrySynced},
+		{name: "finalize", existingTtl: 3600, deleting: true},
+		{
+			name:        "invalid spec",
+			spiffeId:    "spiffe://other.org/ns/default/app/web",
+			existingTtl: 3600,
+			wantReason:  spiremgr.ReasonInvalidSpec,
+		},
+		{
+			name:        "denied by policy",
+			existingTtl: 3600,
+			policy:      &spiffeidv1alpha1.SpiffeIdPolicySpec{MaxTtl: 60},
+			wantReason:  spiremgr.ReasonPolicyDenied,
+		},
+		{
+			name:       "allowed by policy",
+			policy:     &spiffeidv1alpha1.SpiffeIdPolicySpec{MaxTtl: 3600},
+			wantEntry:  true,
+			wantReason: spiremgr.ReasonEntrySynced,
+		},
+	}
+
+	for _, backend := range fakespire.Backends {
+		for _, tt := range tests {
+			t.Run(backend.Name+"/"+tt.name, func(t *testing.T) {
+				server := fakespire.New()
+				conn, err := server.Start()
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer server.Stop()
+				defer conn.Close()
+
+				spiffeId := tt.spiffeId
+				if len(spiffeId) == 0 {
+					spiffeId = testSpiffeId
+				}
+				instance := &spiffeidv1alpha1.SpiffeId{
+					ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+					Spec: spiffeidv1alpha1.SpiffeIdSpec{
+						SpiffeId: spiffeId,
+						Selector: spiffeidv1alpha1.Selector{PodLabel: map[string]string{"app": "web"}},
+						Ttl:      3600,
+					},
+				}
+				if tt.existingTtl > 0 {
+					instance.Status.EntryId = server.AddEntry(&common.RegistrationEntry{
+						ParentId: "spiffe://example.org/spire-k8s-operator/test/node",
+						SpiffeId: testSpiffeId,
+						Selectors: []*common.Selector{
+							{Type: "k8s", Value: "pod-label:app:web"},
+							{Type: "k8s", Value: "ns:default"},
+						},
+						Ttl: tt.existingTtl,
+					})
+					instance.Finalizers = []string{spiffeIdFinalizer}
+					if tt.removed {
+						server.RemoveEntry(instance.Status.EntryId)
+					}
+				}
+				if tt.deleting {
+					instance.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+				}
+				objs := []runtime.Object{
+					instance,
+					&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}},
+				}
+				if tt.policy != nil {
+					objs = append(objs, &spiffeidv1alpha1.SpiffeIdPolicy{
+						ObjectMeta: metav1.ObjectMeta{Name: "policy"},
+						Spec:       *tt.policy,
+					})
+				}
+
+				c := fake.NewFakeClientWithScheme(newScheme(t), objs...)
+				r := newTestReconciler(c, backend.Connect(conn))
+				key := types.NamespacedName{Namespace: "default", Name: "web"}
+				if _, err := r.Reconcile(reconcile.Request{NamespacedName: key}); err != nil {
+					t.Fatalf("Reconcile() error = %v", err)
+				}
+
+				got := &spiffeidv1alpha1.SpiffeId{}
+				if err := c.Get(context.TODO(), key, got); err != nil {
+					t.Fatal(err)
+				}
+				entries := entriesFor(server, testSpiffeId)
+				if !tt.wantEntry {
+					if len(entries) > 0 {
+						t.Errorf("spire has entries %v, want none", entries)
+					}
+					if len(got.Status.EntryId) > 0 && !tt.deleting {
+						t.Errorf("status entry ID = %q, want it cleared", got.Status.EntryId)
+					}
+				} else {
+					if len(entries) != 1 || entries[0].EntryId != got.Status.EntryId || entries[0].Ttl != 3600 {
+						t.Errorf("spire has entries %v, want one with ID %q and TTL 3600", entries, got.Status.EntryId)
+					}
+					if len(got.Finalizers) != 1 {
+						t.Errorf("finalizers = %v, want %s", got.Finalizers, spiffeIdFinalizer)
+					}
+				}
+				if tt.deleting && len(got.Finalizers) > 0 {
+					t.Errorf("finalizers = %v, want none", got.Finalizers)
+				}
+				if condition := got.Status.GetCondition(spiffeidv1alpha1.SpiffeIdReady); len(tt.wantReason) > 0 &&
+					(condition == nil || condition.Reason != tt.wantReason) {
+					t.Errorf("Ready condition = %v, want reason %s", condition, tt.wantReason)
+				}
+			})
+		}
+	}
+}
+
+func newScheme(t *testing.T) *runtime.Scheme {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := apis.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	return scheme
+}
+
+// newTestReconciler returns a ReconcileSpiffeId like newReconciler's, without needing a manager
+func newTestReconciler(c client.Client, backend spiremgr.Backend) *ReconcileSpiffeId {
+	conf := ReconcileSpiffeIdConfig{TrustDomain: "example.org", Cluster: "test"}
+	return &ReconcileSpiffeId{
+		client:    c,
+		conf:      conf,
+		utils:     spiremgr.SpireUtils{Backend: backend, TrustDomain: conf.TrustDomain, Cluster: conf.Cluster},
+		finalizer: spiremgr.Finalizer{Client: c, FinalizerName: spiffeIdFinalizer},
+		status:    spiremgr.StatusUpdater{Client: c, Controller: controllerName},
+		recorder:  spiremgr.EventRecorder{Recorder: record.NewFakeRecorder(100)},
+		validator: spiremgr.Validator{TrustDomain: conf.TrustDomain},
+		policy:    spiremgr.PolicyEvaluator{Client: c},
+	}
+}
+
+// entriesFor returns the spire entries with the spiffe ID
+func entriesFor(server *fakespire.Server, spiffeId string) []*common.RegistrationEntry {
+	var entries []*common.RegistrationEntry
+	for _, entry := range server.Entries() {
+		if entry.SpiffeId == spiffeId {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
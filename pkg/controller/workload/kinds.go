@@ -0,0 +1,75 @@
+package workload
+
+import (
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// Object is a workload resource
+type Object interface {
+	metav1.Object
+	runtime.Object
+}
+
+// Kind describes how to find the pod template of a kind of workload
+type Kind struct {
+	// Kind name, e.g. Deployment
+	Name string
+	// Returns an empty object of the kind
+	New func() Object
+	// Returns the workload's pod template, and its pod selector if it has one
+	PodTemplate func(obj Object) (*corev1.PodTemplateSpec, *metav1.LabelSelector)
+}
+
+// Kinds are the workload kinds the controller supports, by name
+var Kinds = map[string]Kind{
+	"Deployment": {
+		Name: "Deployment",
+		New:  func() Object { return &appsv1.Deployment{} },
+		PodTemplate: func(obj Object) (*corev1.PodTemplateSpec, *metav1.LabelSelector) {
+			deployment := obj.(*appsv1.Deployment)
+			return &deployment.Spec.Template, deployment.Spec.Selector
+		},
+	},
+	"StatefulSet": {
+		Name: "StatefulSet",
+		New:  func() Object { return &appsv1.StatefulSet{} },
+		PodTemplate: func(obj Object) (*corev1.PodTemplateSpec, *metav1.LabelSelector) {
+			statefulSet := obj.(*appsv1.StatefulSet)
+			return &statefulSet.Spec.Template, statefulSet.Spec.Selector
+		},
+	},
+	"DaemonSet": {
+		Name: "DaemonSet",
+		New:  func() Object { return &appsv1.DaemonSet{} },
+		PodTemplate: func(obj Object) (*corev1.PodTemplateSpec, *metav1.LabelSelector) {
+			daemonSet := obj.(*appsv1.DaemonSet)
+			return &daemonSet.Spec.Template, daemonSet.Spec.Selector
+		},
+	},
+	"Job": {
+		Name: "Job",
+		New:  func() Object { return &batchv1.Job{} },
+		PodTemplate: func(obj Object) (*corev1.PodTemplateSpec, *metav1.LabelSelector) {
+			job := obj.(*batchv1.Job)
+			return &job.Spec.Template, job.Spec.Selector
+		},
+	},
+	"CronJob": {
+		Name: "CronJob",
+		New:  func() Object { return &batchv1beta1.CronJob{} },
+		PodTemplate: func(obj Object) (*corev1.PodTemplateSpec, *metav1.LabelSelector) {
+			cronJob := obj.(*batchv1beta1.CronJob)
+			return &cronJob.Spec.JobTemplate.Spec.Template, cronJob.Spec.JobTemplate.Spec.Selector
+		},
+	},
+}
+
+// KindNames lists the names of the supported kinds
+func KindNames() []string {
+	return []string{"Deployment", "StatefulSet", "DaemonSet", "Job", "CronJob"}
+}
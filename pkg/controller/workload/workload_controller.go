@@ -0,0 +1,268 @@
+package workload
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+
+	spiffeidv1alpha1 "github.com/transferwise/spire-k8s-operator/pkg/apis/spiffeid/v1alpha1"
+	"github.com/transferwise/spire-k8s-operator/pkg/spiremgr"
+	corev1 "k8s.io/api/core/v1"
+	k8errors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+const controllerName = "workload-controller"
+
+// DefaultIdTemplate gives each workload an ID from its namespace, kind and name
+const DefaultIdTemplate = "ns/{{.Namespace}}/{{.OwnerKind | lower}}/{{.OwnerName}}"
+
+var log = logf.Log.WithName("controller_workload")
+
+// Add creates a Controller for each configured workload kind and adds them to the Manager. The Manager will set
+// fields on the Controllers and Start them when the Manager is Started.
+func Add(mgr manager.Manager, conf ReconcileWorkloadConfig) error {
+	for _, name := range conf.Kinds {
+		kind, ok := Kinds[name]
+		if !ok {
+			return fmt.Errorf("unknown workload kind %s, must be one of %s", name, strings.Join(KindNames(), ", "))
+		}
+		if err := add(mgr, newReconciler(mgr, kind, conf), kind); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newReconciler returns a new reconcile.Reconciler
+func newReconciler(mgr manager.Manager, kind Kind, conf ReconcileWorkloadConfig) reconcile.Reconciler {
+	return &ReconcileWorkload{
+		client:   mgr.GetClient(),
+		scheme:   mgr.GetScheme(),
+		kind:     kind,
+		config:   conf,
+		recorder: mgr.GetEventRecorderFor(controllerName),
+	}
+}
+
+// add adds a new Controller to mgr with r as the reconcile.Reconciler
+func add(mgr manager.Manager, r reconcile.Reconciler, kind Kind) error {
+	// Create a new controller
+	c, err := controller.New(fmt.Sprintf("%s-%s", strings.ToLower(kind.Name), controllerName), mgr, controller.Options{Reconciler: r})
+	if err != nil {
+		return err
+	}
+
+	// Watch for changes to primary resource
+	err = c.Watch(&source.Kind{Type: kind.New()}, &handler.EnqueueRequestForObject{})
+	if err != nil {
+		return err
+	}
+
+	err = c.Watch(&source.Kind{Type: &spiffeidv1alpha1.SpiffeId{}}, &handler.EnqueueRequestForOwner{
+		IsController: true,
+		OwnerType:    kind.New(),
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// blank assignment to verify that ReconcileWorkload implements reconcile.Reconciler
+var _ reconcile.Reconciler = &ReconcileWorkload{}
+
+type ReconcileWorkloadConfig struct {
+	TrustDomain string
+	// Names of the workload kinds to create SpiffeIds for
+	Kinds []string
+	// Generates each workload's spiffe ID. It is executed against a pod built from the workload's pod template, whose
+	// owner is the workload.
+	Template *spiremgr.IdTemplate
+}
+
+// ReconcileWorkload creates one SpiffeId for each workload of a kind, selecting its pods by label and service account,
+// so that rollouts and scaling don't create and delete spire entries
+type ReconcileWorkload struct {
+	client   client.Client
+	scheme   *runtime.Scheme
+	kind     Kind
+	config   ReconcileWorkloadConfig
+	recorder record.EventRecorder
+}
+
+// Reconcile reads the state of a workload and creates, updates or deletes its SpiffeId to match
+func (r *ReconcileWorkload) Reconcile(request reconcile.Request) (reconcile.Result, error) {
+	reqLogger := log.WithValues("Request.Namespace", request.Namespace, "Request.Name", request.Name, "Kind", r.kind.Name)
+
+	workload := r.kind.New()
+	err := r.client.Get(context.TODO(), request.NamespacedName, workload)
+	if err != nil {
+		if k8errors.IsNotFound(err) {
+			// The SpiffeId is owned by the workload, so is garbage collected with it
+			return reconcile.Result{}, nil
+		}
+		return reconcile.Result{}, err
+	}
+	if !workload.GetDeletionTimestamp().IsZero() {
+		return reconcile.Result{}, nil
+	}
+
+	key := types.NamespacedName{
+		Namespace: request.Namespace,
+		Name:      spiremgr.GeneratedName(fmt.Sprintf("%s-%s", strings.ToLower(r.kind.Name), request.Name)),
+	}
+
+	desired, err := r.workloadSpec(workload)
+	if err != nil {
+		// Retrying won't help until the workload or the template changes
+		reqLogger.Error(err, "Failed to generate spiffe ID")
+		r.recorder.Event(workload, corev1.EventTypeWarning, "SpiffeIdFailed", fmt.Sprintf("Failed to generate spiffe ID: %v", err))
+		return reconcile.Result{}, nil
+	}
+
+	existing := &spiffeidv1alpha1.SpiffeId{}
+	err = r.client.Get(context.TODO(), key, existing)
+	if err != nil && k8errors.IsNotFound(err) {
+		if desired == nil {
+			return reconcile.Result{}, nil
+		}
+		spiffeId := &spiffeidv1alpha1.SpiffeId{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: key.Namespace,
+				Name:      key.Name,
+			},
+			Spec: *desired,
+		}
+		if err := controllerutil.SetControllerReference(workload, spiffeId, r.scheme); err != nil {
+			return reconcile.Result{}, err
+		}
+		reqLogger.Info("Creating a new SpiffeID", "SpiffeID.Name", key.Name)
+		if err := r.client.Create(context.TODO(), spiffeId); err != nil {
+			reqLogger.Error(err, "Failed to create new SpiffeID", "SpiffeID.Name", key.Name)
+			r.recorder.Event(workload, corev1.EventTypeWarning, "SpiffeIdFailed", fmt.Sprintf("Failed to create SpiffeId %s: %v", key.Name, err))
+			return reconcile.Result{}, err
+		}
+		r.recorder.Event(workload, corev1.EventTypeNormal, "SpiffeIdCreated", fmt.Sprintf("Created SpiffeId %s for %s", key.Name, desired.SpiffeId))
+		return reconcile.Result{}, nil
+	} else if err != nil {
+		reqLogger.Error(err, "Failed to get SpiffeID", "name", key.Name)
+		return reconcile.Result{}, err
+	}
+
+	if !metav1.IsControlledBy(existing, workload) {
+		if desired != nil {
+			reqLogger.Info("SpiffeID already exists for something else, not changing it", "SpiffeID.Name", key.Name)
+			r.recorder.Event(workload, corev1.EventTypeWarning, "SpiffeIdConflict", fmt.Sprintf("SpiffeId %s already belongs to something else", key.Name))
+		}
+		return reconcile.Result{}, nil
+	}
+	if !existing.GetDeletionTimestamp().IsZero() {
+		return reconcile.Result{}, nil
+	}
+
+	if desired == nil {
+		reqLogger.Info("Workload no longer has a spiffe ID, deleting SpiffeID", "SpiffeID.Name", key.Name)
+		if err := r.client.Delete(context.TODO(), existing); err != nil && !k8errors.IsNotFound(err) {
+			reqLogger.Error(err, "Failed to delete SpiffeID", "SpiffeID.Name", key.Name)
+			return reconcile.Result{}, err
+		}
+		r.recorder.Event(workload, corev1.EventTypeNormal, "SpiffeIdDeleted", fmt.Sprintf("Deleted SpiffeId %s", key.Name))
+		return reconcile.Result{}, nil
+	}
+
+	if reflect.DeepEqual(existing.Spec, *desired) {
+		return reconcile.Result{}, nil
+	}
+	oldSpiffeId := existing.Spec.SpiffeId
+	reqLogger.Info("Updating SpiffeID", "SpiffeID.Name", key.Name, "from", oldSpiffeId, "to", desired.SpiffeId)
+	existing.Spec = *desired
+	if err := r.client.Update(context.TODO(), existing); err != nil {
+		reqLogger.Error(err, "Failed to update SpiffeID", "SpiffeID.Name", key.Name)
+		r.recorder.Event(workload, corev1.EventTypeWarning, "SpiffeIdFailed", fmt.Sprintf("Failed to update SpiffeId %s: %v", key.Name, err))
+		return reconcile.Result{}, err
+	}
+	if oldSpiffeId != desired.SpiffeId {
+		r.recorder.Event(workload, corev1.EventTypeNormal, "SpiffeIdUpdated", fmt.Sprintf("Updated SpiffeId %s from %s to %s", key.Name, oldSpiffeId, desired.SpiffeId))
+	}
+
+	return reconcile.Result{}, nil
+}
+
+// workloadSpec returns the SpiffeId spec for the workload, or nil if it shouldn't have one
+func (r *ReconcileWorkload) workloadSpec(workload Object) (*spiffeidv1alpha1.SpiffeIdSpec, error) {
+	// Jobs created by a CronJob are covered by the CronJob's SpiffeId
+	if owner := metav1.GetControllerOf(workload); owner != nil && r.kindEnabled(owner.Kind) {
+		return nil, nil
+	}
+
+	template, selector := r.kind.PodTemplate(workload)
+	pod := templatePod(workload, r.kind.Name, template)
+	spiffeId, err := r.config.Template.Execute(pod)
+	if err != nil || len(spiffeId) == 0 {
+		return nil, err
+	}
+
+	return &spiffeidv1alpha1.SpiffeIdSpec{
+		SpiffeId: spiffeId,
+		Selector: spiffeidv1alpha1.Selector{
+			PodLabel:       podLabels(template, selector),
+			ServiceAccount: pod.Spec.ServiceAccountName,
+		},
+	}, nil
+}
+
+func (r *ReconcileWorkload) kindEnabled(name string) bool {
+	for _, kind := range r.config.Kinds {
+		if kind == name {
+			return true
+		}
+	}
+	return false
+}
+
+// templatePod builds a pod from the workload's pod template, as seen by ID templates
+func templatePod(workload Object, kind string, template *corev1.PodTemplateSpec) *corev1.Pod {
+	isController := true
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   workload.GetNamespace(),
+			Name:        workload.GetName(),
+			Labels:      template.Labels,
+			Annotations: template.Annotations,
+			OwnerReferences: []metav1.OwnerReference{{
+				Kind:       kind,
+				Name:       workload.GetName(),
+				UID:        workload.GetUID(),
+				Controller: &isController,
+			}},
+		},
+		Spec: template.Spec,
+	}
+	if len(pod.Spec.ServiceAccountName) == 0 {
+		pod.Spec.ServiceAccountName = "default"
+	}
+	return pod
+}
+
+// podLabels returns the labels to select the workload's pods with. The selector's labels are stable across rollouts,
+// but when it also has expressions, which spire selectors can't express, the pod template's labels are used instead.
+func podLabels(template *corev1.PodTemplateSpec, selector *metav1.LabelSelector) map[string]string {
+	if selector != nil && len(selector.MatchLabels) > 0 && len(selector.MatchExpressions) == 0 {
+		return selector.MatchLabels
+	}
+	return template.Labels
+}
@@ -0,0 +1,329 @@
+package workload
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/transferwise/spire-k8s-operator/pkg/apis"
+	spiffeidv1alpha1 "github.com/transferwise/spire-k8s-operator/pkg/apis/spiffeid/v1alpha1"
+	"github.com/transferwise/spire-k8s-operator/pkg/spiremgr"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// podTemplate returns a pod template with the labels and service account
+func podTemplate(labels map[string]string, serviceAccount string) corev1.PodTemplateSpec {
+	return corev1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{Labels: labels},
+		Spec: corev1.PodSpec{
+			ServiceAccountName: serviceAccount,
+			Containers:         []corev1.Container{{Name: "web", Image: "web:1"}},
+		},
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	isController := true
+	webLabels := map[string]string{"app": "web", "version": "1"}
+
+	tests := []struct {
+		name     string
+		kinds    []string
+		template string
+		workload Object
+		// spec of the workload's SpiffeId before the reconcile, if it has one
+		existing *spiffeidv1alpha1.SpiffeIdSpec
+		// whether the existing SpiffeId belongs to something other than the workload
+		foreign bool
+		want    *spiffeidv1alpha1.SpiffeIdSpec
+	}{
+		{
+			name:  "deployment selected by its selector's labels",
+			kinds: []string{"Deployment"},
+			workload: &appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+				Spec: appsv1.DeploymentSpec{
+					Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+					Template: podTemplate(webLabels, "web"),
+				},
+			},
+			want: &spiffeidv1alpha1.SpiffeIdSpec{
+				SpiffeId: "spiffe://example.org/ns/default/deployment/web",
+				Selector: spiffeidv1alpha1.Selector{PodLabel: map[string]string{"app": "web"}, ServiceAccount: "web"},
+			},
+		},
+		{
+			name:  "selector expressions use the template labels",
+			kinds: []string{"StatefulSet"},
+			workload: &appsv1.StatefulSet{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+				Spec: appsv1.StatefulSetSpec{
+					Selector: &metav1.LabelSelector{
+						MatchLabels: map[string]string{"app": "web"},
+						MatchExpressions: []metav1.LabelSelectorRequirement{
+							{Key: "version", Operator: metav1.LabelSelectorOpExists},
+						},
+					},
+					Template: podTemplate(webLabels, "web"),
+				},
+			},
+			want: &spiffeidv1alpha1.SpiffeIdSpec{
+				SpiffeId: "spiffe://example.org/ns/default/statefulset/web",
+				Selector: spiffeidv1alpha1.Selector{PodLabel: webLabels, ServiceAccount: "web"},
+			},
+		},
+		{
+			name:  "no selector uses the template labels and default service account",
+			kinds: []string{"DaemonSet"},
+			workload: &appsv1.DaemonSet{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "agent"},
+				Spec:       appsv1.DaemonSetSpec{Template: podTemplate(map[string]string{"app": "agent"}, "")},
+			},
+			want: &spiffeidv1alpha1.SpiffeIdSpec{
+				SpiffeId: "spiffe://example.org/ns/default/daemonset/agent",
+				Selector: spiffeidv1alpha1.Selector{PodLabel: map[string]string{"app": "agent"}, ServiceAccount: "default"},
+			},
+		},
+		{
+			name:  "cron job from its job template",
+			kinds: []string{"Job", "CronJob"},
+			workload: &batchv1beta1.CronJob{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "backup"},
+				Spec: batchv1beta1.CronJobSpec{
+					JobTemplate: batchv1beta1.JobTemplateSpec{
+						Spec: batchv1.JobSpec{Template: podTemplate(map[string]string{"app": "backup"}, "backup")},
+					},
+				},
+			},
+			want: &spiffeidv1alpha1.SpiffeIdSpec{
+				SpiffeId: "spiffe://example.org/ns/default/cronjob/backup",
+				Selector: spiffeidv1alpha1.Selector{PodLabel: map[string]string{"app": "backup"}, ServiceAccount: "backup"},
+			},
+		},
+		{
+			name:  "job of an enabled cron job",
+			kinds: []string{"Job", "CronJob"},
+			workload: &batchv1.Job{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:       "default",
+					Name:            "backup-1",
+					OwnerReferences: []metav1.OwnerReference{{Kind: "CronJob", Name: "backup", Controller: &isController}},
+				},
+				Spec: batchv1.JobSpec{Template: podTemplate(map[string]string{"app": "backup"}, "backup")},
+			},
+		},
+		{
+			name:  "job of a cron job which isn't enabled",
+			kinds: []string{"Job"},
+			workload: &batchv1.Job{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:       "default",
+					Name:            "backup-1",
+					OwnerReferences: []metav1.OwnerReference{{Kind: "CronJob", Name: "backup", Controller: &isController}},
+				},
+				Spec: batchv1.JobSpec{Template: podTemplate(map[string]string{"app": "backup"}, "backup")},
+			},
+			want: &spiffeidv1alpha1.SpiffeIdSpec{
+				SpiffeId: "spiffe://example.org/ns/default/job/backup-1",
+				Selector: spiffeidv1alpha1.Selector{PodLabel: map[string]string{"app": "backup"}, ServiceAccount: "backup"},
+			},
+		},
+		{
+			name:     "no ID generated deletes",
+			kinds:    []string{"Deployment"},
+			template: `{{with .Labels.spiffe}}ns/{{$.Namespace}}/{{.}}{{end}}`,
+			workload: &appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+				Spec:       appsv1.DeploymentSpec{Template: podTemplate(webLabels, "web")},
+			},
+			existing: &spiffeidv1alpha1.SpiffeIdSpec{SpiffeId: "spiffe://example.org/ns/default/deployment/web"},
+		},
+		{
+			name:  "changed",
+			kinds: []string{"Deployment"},
+			workload: &appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+				Spec:       appsv1.DeploymentSpec{Template: podTemplate(map[string]string{"app": "web"}, "web")},
+			},
+			existing: &spiffeidv1alpha1.SpiffeIdSpec{SpiffeId: "spiffe://example.org/ns/default/deployment/old"},
+			want: &spiffeidv1alpha1.SpiffeIdSpec{
+				SpiffeId: "spiffe://example.org/ns/default/deployment/web",
+				Selector: spiffeidv1alpha1.Selector{PodLabel: map[string]string{"app": "web"}, ServiceAccount: "web"},
+			},
+		},
+		{
+			name:  "foreign",
+			kinds: []string{"Deployment"},
+			workload: &appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+				Spec:       appsv1.DeploymentSpec{Template: podTemplate(map[string]string{"app": "web"}, "web")},
+			},
+			existing: &spiffeidv1alpha1.SpiffeIdSpec{SpiffeId: "spiffe://example.org/ns/default/deployment/old"},
+			foreign:  true,
+			want:     &spiffeidv1alpha1.SpiffeIdSpec{SpiffeId: "spiffe://example.org/ns/default/deployment/old"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scheme := newScheme(t)
+			kindName := reflect.TypeOf(tt.workload).Elem().Name()
+			objs := []runtime.Object{tt.workload}
+			name := spiremgr.GeneratedName(strings.ToLower(kindName) + "-" + tt.workload.GetName())
+			if tt.existing != nil {
+				existing := &spiffeidv1alpha1.SpiffeId{
+					ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+					Spec:       *tt.existing,
+				}
+				if !tt.foreign {
+					if err := controllerutil.SetControllerReference(tt.workload, existing, scheme); err != nil {
+						t.Fatal(err)
+					}
+				}
+				objs = append(objs, existing)
+			}
+
+			c := fake.NewFakeClientWithScheme(scheme, objs...)
+			r := newTestReconciler(t, c, scheme, kindName, tt.kinds, tt.template)
+			reconcileWorkload(t, r, tt.workload.GetName())
+
+			spiffeIds := listSpiffeIds(t, c)
+			if tt.want == nil {
+				if len(spiffeIds) > 0 {
+					t.Errorf("SpiffeIds = %v, want none", spiffeIds)
+				}
+				return
+			}
+			if len(spiffeIds) != 1 || spiffeIds[0].Name != name {
+				t.Fatalf("SpiffeIds = %v, want just %s", spiffeIds, name)
+			}
+			if !reflect.DeepEqual(spiffeIds[0].Spec, *tt.want) {
+				t.Errorf("SpiffeId spec = %v, want %v", spiffeIds[0].Spec, *tt.want)
+			}
+		})
+	}
+}
+
+// A rollout changes the pod template and gives the pods a new pod-template-hash, which mustn't change the SpiffeId
+func TestReconcileRollout(t *testing.T) {
+	scheme := newScheme(t)
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+			Template: podTemplate(map[string]string{"app": "web"}, "web"),
+		},
+	}
+	c := fake.NewFakeClientWithScheme(scheme, deployment)
+	r := newTestReconciler(t, c, scheme, "Deployment", []string{"Deployment"}, "")
+	reconcileWorkload(t, r, "web")
+	before := listSpiffeIds(t, c)
+	if len(before) != 1 {
+		t.Fatalf("SpiffeIds = %v, want one", before)
+	}
+
+	if err := c.Get(context.TODO(), types.NamespacedName{Namespace: "default", Name: "web"}, deployment); err != nil {
+		t.Fatal(err)
+	}
+	deployment.Spec.Template.Spec.Containers[0].Image = "web:2"
+	deployment.Spec.Template.Annotations = map[string]string{"kubectl.kubernetes.io/restartedAt": "2020-01-01T00:00:00Z"}
+	if err := c.Update(context.TODO(), deployment); err != nil {
+		t.Fatal(err)
+	}
+	reconcileWorkload(t, r, "web")
+
+	after := listSpiffeIds(t, c)
+	if len(after) != 1 || after[0].Name != before[0].Name || after[0].ResourceVersion != before[0].ResourceVersion {
+		t.Errorf("SpiffeIds after rollout = %v, want %v unchanged", after, before)
+	}
+}
+
+func TestPodLabels(t *testing.T) {
+	template := podTemplate(map[string]string{"app": "web", "pod-template-hash": "7d4b9c8f6"}, "web")
+	tests := []struct {
+		name     string
+		selector *metav1.LabelSelector
+		want     map[string]string
+	}{
+		{name: "no selector", want: template.Labels},
+		{
+			name:     "match labels",
+			selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+			want:     map[string]string{"app": "web"},
+		},
+		{
+			name: "match expressions",
+			selector: &metav1.LabelSelector{
+				MatchLabels:      map[string]string{"app": "web"},
+				MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "tier", Operator: metav1.LabelSelectorOpDoesNotExist}},
+			},
+			want: template.Labels,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := podLabels(&template, tt.selector); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("podLabels() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func newScheme(t *testing.T) *runtime.Scheme {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := apis.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	return scheme
+}
+
+// newTestReconciler returns a ReconcileWorkload like newReconciler's, without needing a manager. An empty template
+// uses DefaultIdTemplate.
+func newTestReconciler(t *testing.T, c client.Client, scheme *runtime.Scheme, kind string, kinds []string, text string) *ReconcileWorkload {
+	if len(text) == 0 {
+		text = DefaultIdTemplate
+	}
+	idTemplate, err := spiremgr.ParseIdTemplate(text, "example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &ReconcileWorkload{
+		client:   c,
+		scheme:   scheme,
+		kind:     Kinds[kind],
+		config:   ReconcileWorkloadConfig{TrustDomain: "example.org", Kinds: kinds, Template: idTemplate},
+		recorder: record.NewFakeRecorder(100),
+	}
+}
+
+func reconcileWorkload(t *testing.T, r *ReconcileWorkload, name string) {
+	request := reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: name}}
+	if _, err := r.Reconcile(request); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+}
+
+func listSpiffeIds(t *testing.T, c client.Client) []spiffeidv1alpha1.SpiffeId {
+	spiffeIds := &spiffeidv1alpha1.SpiffeIdList{}
+	if err := c.List(context.TODO(), spiffeIds); err != nil {
+		t.Fatal(err)
+	}
+	return spiffeIds.Items
+}
@@ -0,0 +1,116 @@
+// Package health serves the operator's /healthz and /readyz endpoints for Kubernetes liveness and readiness
+// probes.
+package health
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+const (
+	LivenessPath  = "/healthz"
+	ReadinessPath = "/readyz"
+)
+
+// Check returns an error describing why the operator is unhealthy, or nil if it's healthy
+type Check func() error
+
+// Server serves the liveness and readiness checks over HTTP. Each endpoint returns 200 when all of its checks
+// pass, and 503 listing the failed checks otherwise. Add ?verbose to list every check.
+type Server struct {
+	Addr string
+	Log  logr.Logger
+
+	mu        sync.Mutex
+	liveness  map[string]Check
+	readiness map[string]Check
+}
+
+// NewServer creates a server listening on addr, e.g. :8081
+func NewServer(addr string, log logr.Logger) *Server {
+	return &Server{
+		Addr:      addr,
+		Log:       log,
+		liveness:  map[string]Check{},
+		readiness: map[string]Check{},
+	}
+}
+
+// AddLivenessCheck adds a check which makes /healthz fail, so that Kubernetes restarts the operator.
+func (s *Server) AddLivenessCheck(name string, check Check) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.liveness[name] = check
+}
+
+// AddReadinessCheck adds a check which makes /readyz fail.
+func (s *Server) AddReadinessCheck(name string, check Check) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readiness[name] = check
+}
+
+// Start serves the endpoints until stop is closed.
+func (s *Server) Start(stop <-chan struct{}) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc(LivenessPath, s.handler(func() map[string]Check { return s.liveness }))
+	mux.HandleFunc(ReadinessPath, s.handler(func() map[string]Check { return s.readiness }))
+	server := &http.Server{Addr: s.Addr, Handler: mux}
+
+	errs := make(chan error, 1)
+	go func() {
+		s.Log.Info("Serving health endpoints", "addr", s.Addr)
+		errs <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-stop:
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return server.Shutdown(ctx)
+	}
+}
+
+func (s *Server) handler(checks func() map[string]Check) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		s.mu.Lock()
+		names := make([]string, 0, len(checks()))
+		toRun := make(map[string]Check, len(checks()))
+		for name, check := range checks() {
+			names = append(names, name)
+			toRun[name] = check
+		}
+		s.mu.Unlock()
+		sort.Strings(names)
+
+		_, verbose := req.URL.Query()["verbose"]
+		failed := false
+		body := ""
+		for _, name := range names {
+			if err := toRun[name](); err != nil {
+				failed = true
+				body += fmt.Sprintf("[-]%s failed: %v\n", name, err)
+			} else if verbose {
+				body += fmt.Sprintf("[+]%s ok\n", name)
+			}
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if failed {
+			s.Log.Info("Health check failed", "path", req.URL.Path, "checks", body)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, body)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, body+"ok\n")
+	}
+}
@@ -0,0 +1,66 @@
+package health
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+func TestHandler(t *testing.T) {
+	pass := func() error { return nil }
+	fail := func() error { return errors.New("spire unreachable") }
+
+	tests := []struct {
+		name     string
+		checks   map[string]Check
+		query    string
+		wantCode int
+		wantBody string
+	}{
+		{name: "no checks", wantCode: http.StatusOK, wantBody: "ok\n"},
+		{name: "passing", checks: map[string]Check{"spire": pass, "svid": pass}, wantCode: http.StatusOK, wantBody: "ok\n"},
+		{
+			name:     "passing verbose",
+			checks:   map[string]Check{"svid": pass, "spire": pass},
+			query:    "?verbose",
+			wantCode: http.StatusOK,
+			wantBody: "[+]spire ok\n[+]svid ok\nok\n",
+		},
+		{
+			name:     "failing",
+			checks:   map[string]Check{"spire": fail, "svid": pass},
+			wantCode: http.StatusServiceUnavailable,
+			wantBody: "[-]spire failed: spire unreachable\n",
+		},
+		{
+			name:     "failing verbose",
+			checks:   map[string]Check{"spire": fail, "svid": pass},
+			query:    "?verbose",
+			wantCode: http.StatusServiceUnavailable,
+			wantBody: "[-]spire failed: spire unreachable\n[+]svid ok\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer(":0", logf.Log)
+			for name, check := range tt.checks {
+				s.AddReadinessCheck(name, check)
+			}
+			// Liveness checks don't affect readiness
+			s.AddLivenessCheck("deadlock", fail)
+
+			w := httptest.NewRecorder()
+			s.handler(func() map[string]Check { return s.readiness })(w, httptest.NewRequest("GET", ReadinessPath+tt.query, nil))
+			if w.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantCode)
+			}
+			if body := w.Body.String(); body != tt.wantBody {
+				t.Errorf("body = %q, want %q", body, tt.wantBody)
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+// Package metrics defines the operator's Prometheus metrics, which are served alongside the controller-runtime
+// metrics on the manager's metrics endpoint.
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+const namespace = "spire_k8s_operator"
+
+// Reconcile results
+const (
+	ResultSuccess = "success"
+	ResultRequeue = "requeue"
+	ResultError   = "error"
+)
+
+var (
+	// SpireRequests counts spire server RPCs by controller, RPC and gRPC status code
+	SpireRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "spire",
+		Name:      "requests_total",
+		Help:      "Number of spire server RPCs by controller, RPC and gRPC status code",
+	}, []string{"controller", "rpc", "code"})
+
+	// SpireRequestDuration measures spire server RPC latency by controller, RPC and gRPC status code
+	SpireRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "spire",
+		Name:      "request_duration_seconds",
+		Help:      "Latency of spire server RPCs by controller, RPC and gRPC status code",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"controller", "rpc", "code"})
+
+	// EntryOperations counts spire entries created, updated, recreated and deleted by each controller
+	EntryOperations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "entry_operations_total",
+		Help:      "Number of spire entries created, updated, recreated or deleted by controller and operation",
+	}, []string{"controller", "operation"})
+
+	// FinalizerFailures counts failures to add or run finalizers
+	FinalizerFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "finalizer_failures_total",
+		Help:      "Number of failures to add or run SpiffeId finalizers by controller",
+	}, []string{"controller"})
+
+	// Reconciles counts reconciles by controller and result
+	Reconciles = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "reconcile_total",
+		Help:      "Number of reconciles by controller and result",
+	}, []string{"controller", "result"})
+
+	// ReconcileDuration measures how long reconciles take by controller and result
+	ReconcileDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "reconcile_duration_seconds",
+		Help:      "Duration of reconciles by controller and result",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"controller", "result"})
+
+	// OutOfSync is the number of SpiffeIds whose last reconcile failed
+	OutOfSync = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "out_of_sync",
+		Help:      "Number of SpiffeIds whose spire entry failed to sync on the last reconcile, by controller",
+	}, []string{"controller"})
+
+	outOfSync = &syncTracker{outOfSync: map[string]map[types.NamespacedName]bool{}}
+)
+
+func init() {
+	metrics.Registry.MustRegister(
+		SpireRequests,
+		SpireRequestDuration,
+		EntryOperations,
+		FinalizerFailures,
+		Reconciles,
+		ReconcileDuration,
+		OutOfSync,
+	)
+}
+
+// ObserveSpireRequest records a spire server RPC which started at start and returned err.
+func ObserveSpireRequest(controller string, rpc string, start time.Time, err error) {
+	code := status.Code(err).String()
+	SpireRequests.WithLabelValues(controller, rpc, code).Inc()
+	SpireRequestDuration.WithLabelValues(controller, rpc, code).Observe(time.Since(start).Seconds())
+}
+
+// InstrumentReconciler wraps a reconciler, recording the result and duration of every reconcile.
+func InstrumentReconciler(controller string, r reconcile.Reconciler) reconcile.Reconciler {
+	return &instrumentedReconciler{controller: controller, delegate: r}
+}
+
+type instrumentedReconciler struct {
+	controller string
+	delegate   reconcile.Reconciler
+}
+
+func (r *instrumentedReconciler) Reconcile(request reconcile.Request) (reconcile.Result, error) {
+	start := time.Now()
+	result, err := r.delegate.Reconcile(request)
+
+	label := resultLabel(result, err)
+	Reconciles.WithLabelValues(r.controller, label).Inc()
+	ReconcileDuration.WithLabelValues(r.controller, label).Observe(time.Since(start).Seconds())
+	return result, err
+}
+
+// resultLabel classifies a reconcile. Errors are retried with backoff and count as errors. Only an explicit
+// Requeue counts as a requeue, as a RequeueAfter is the periodic resync scheduled after a successful reconcile.
+func resultLabel(result reconcile.Result, err error) string {
+	if err != nil {
+		return ResultError
+	}
+	if result.Requeue {
+		return ResultRequeue
+	}
+	return ResultSuccess
+}
+
+// SetOutOfSync records whether the last reconcile of a SpiffeId failed to sync its spire entry.
+func SetOutOfSync(controller string, key types.NamespacedName, failed bool) {
+	outOfSync.set(controller, key, failed)
+}
+
+// ForgetOutOfSync stops tracking a deleted SpiffeId.
+func ForgetOutOfSync(controller string, key types.NamespacedName) {
+	outOfSync.set(controller, key, false)
+}
+
+// syncTracker keeps the set of out of sync SpiffeIds per controller, so that OutOfSync doesn't double count
+// SpiffeIds which fail repeatedly.
+type syncTracker struct {
+	mu        sync.Mutex
+	outOfSync map[string]map[types.NamespacedName]bool
+}
+
+func (t *syncTracker) set(controller string, key types.NamespacedName, failed bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	keys, ok := t.outOfSync[controller]
+	if !ok {
+		keys = map[types.NamespacedName]bool{}
+		t.outOfSync[controller] = keys
+	}
+	if failed {
+		keys[key] = true
+	} else {
+		delete(keys, key)
+	}
+	OutOfSync.WithLabelValues(controller).Set(float64(len(keys)))
+}
@@ -0,0 +1,32 @@
+package metrics
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func TestResultLabel(t *testing.T) {
+	tests := []struct {
+		name   string
+		result reconcile.Result
+		err    error
+		want   string
+	}{
+		{name: "done", want: ResultSuccess},
+		{name: "periodic resync", result: reconcile.Result{RequeueAfter: 10 * time.Minute}, want: ResultSuccess},
+		{name: "requeue", result: reconcile.Result{Requeue: true}, want: ResultRequeue},
+		{name: "error", err: errors.New("spire unavailable"), want: ResultError},
+		{name: "error with resync", result: reconcile.Result{RequeueAfter: time.Minute}, err: errors.New("spire unavailable"), want: ResultError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := resultLabel(tt.result, tt.err); got != tt.want {
+				t.Errorf("resultLabel() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package spireconn
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// dialFiles authenticates with a certificate and key read from files, and verifies the server against the CA
+// bundle file and ServerID. The files are read again on every handshake, so rotated Secrets are picked up.
+func dialFiles(ctx context.Context, conf Config) (*grpc.ClientConn, error) {
+	if len(conf.CertFile) == 0 || len(conf.KeyFile) == 0 || len(conf.BundleFile) == 0 {
+		return nil, errors.New("certificate, key and bundle files must all be given")
+	}
+	if len(conf.ServerID) == 0 {
+		return nil, errors.New("the expected spire server ID must be given")
+	}
+	// Fail early on unreadable files rather than on every handshake
+	if _, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile); err != nil {
+		return nil, err
+	}
+	if _, err := loadBundle(conf.BundleFile); err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+			if err != nil {
+				return nil, err
+			}
+			return &cert, nil
+		},
+		// SVIDs identify the server by spiffe ID rather than host name, so the chain and ID are checked in
+		// VerifyPeerCertificate instead
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			bundle, err := loadBundle(conf.BundleFile)
+			if err != nil {
+				return err
+			}
+			if err := verifyPeer(rawCerts, bundle, conf.ServerID); err != nil {
+				return &peerRejectedError{err: err}
+			}
+			return nil
+		},
+	}
+
+	opts := append(blockingDialOptions(conf), grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	conn, err := grpc.DialContext(ctx, conf.ServerAddress, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if conf.Health != nil {
+		conf.Health.setSVID(func() (*x509.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+			if err != nil {
+				return nil, err
+			}
+			return leafCertificate(&cert)
+		})
+	}
+	return conn, nil
+}
+
+// dialAdminSocket connects to the spire server's local registration socket, which needs no authentication as
+// access is controlled by the socket's file permissions.
+func dialAdminSocket(ctx context.Context, conf Config) (*grpc.ClientConn, error) {
+	socketPath := strings.TrimPrefix(conf.AdminSocket, "unix://")
+	if len(socketPath) == 0 {
+		return nil, errors.New("the spire server admin socket must be given")
+	}
+
+	opts := append(blockingDialOptions(conf),
+		grpc.WithInsecure(),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", addr)
+		}),
+	)
+	return grpc.DialContext(ctx, socketPath, opts...)
+}
+
+func loadBundle(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in bundle %s", path)
+	}
+	return pool, nil
+}
+
+// verifyPeer checks that the server's certificate chains to the bundle and carries the expected spiffe ID.
+func verifyPeer(rawCerts [][]byte, bundle *x509.CertPool, serverID string) error {
+	if len(rawCerts) == 0 {
+		return errors.New("spire server presented no certificate")
+	}
+	certs := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	if _, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         bundle,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}); err != nil {
+		return err
+	}
+
+	for _, uri := range certs[0].URIs {
+		if uri.String() == serverID {
+			return nil
+		}
+	}
+	return fmt.Errorf("unexpected peer ID, expected %s", serverID)
+}
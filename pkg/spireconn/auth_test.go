@@ -0,0 +1,155 @@
+package spireconn
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+func TestDialFilesAuthError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spireconn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, caKey := newCertificate(t, nil, nil, nil)
+	server, serverKey := newCertificate(t, ca, caKey, &url.URL{Scheme: "spiffe", Host: "example.org", Path: "/spire/server"})
+	client, clientKey := newCertificate(t, ca, caKey, &url.URL{Scheme: "spiffe", Host: "example.org", Path: "/operator"})
+	conf := Config{
+		Auth:       AuthFiles,
+		CertFile:   writePEM(t, filepath.Join(dir, "cert.pem"), "CERTIFICATE", client.Raw),
+		KeyFile:    writeKey(t, filepath.Join(dir, "key.pem"), clientKey),
+		BundleFile: writePEM(t, filepath.Join(dir, "bundle.pem"), "CERTIFICATE", ca.Raw),
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpcServer := grpc.NewServer(grpc.Creds(credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{server.Raw}, PrivateKey: serverKey}},
+	})))
+	go grpcServer.Serve(listener)
+	defer grpcServer.Stop()
+	conf.ServerAddress = listener.Addr().String()
+
+	tests := []struct {
+		name         string
+		serverID     string
+		wantAuthFail bool
+	}{
+		{name: "expected ID", serverID: "spiffe://example.org/spire/server"},
+		{name: "unexpected ID", serverID: "spiffe://example.org/other", wantAuthFail: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			conf := conf
+			conf.ServerID = tt.serverID
+			conn, err := dialFiles(ctx, conf)
+			if !tt.wantAuthFail {
+				if err != nil {
+					t.Fatalf("dialFiles() error = %v", err)
+				}
+				conn.Close()
+				return
+			}
+			if err == nil {
+				conn.Close()
+				t.Fatal("dialFiles() succeeded, want an auth error")
+			}
+			if !isAuthError(err) {
+				t.Errorf("isAuthError(%v) = false, want true", err)
+			}
+			if ctx.Err() != nil {
+				t.Errorf("dialFiles() retried until the deadline rather than failing straight away")
+			}
+		})
+	}
+}
+
+// newCertificate returns a certificate signed by parent, or a self signed CA if parent is nil
+func newCertificate(t *testing.T, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, id *url.URL) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{Organization: []string{"SPIFFE"}},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	} else {
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+		template.URIs = []*url.URL{id}
+	}
+
+	raw, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func writeKey(t *testing.T, path string, key *ecdsa.PrivateKey) string {
+	raw, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return writePEM(t, path, "PRIVATE KEY", raw)
+}
+
+func writePEM(t *testing.T, path string, blockType string, raw []byte) string {
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestDialRequiresServerID(t *testing.T) {
+	for _, auth := range []string{AuthWorkloadAPI, AuthFiles} {
+		t.Run(auth, func(t *testing.T) {
+			conf := Config{
+				Auth:          auth,
+				ServerAddress: "127.0.0.1:8081",
+				CertFile:      "cert.pem",
+				KeyFile:       "key.pem",
+				BundleFile:    "bundle.pem",
+			}
+			if _, err := dial(context.Background(), conf); err == nil || err.Error() != "the expected spire server ID must be given" {
+				t.Errorf("dial() error = %v, want the missing server ID reported", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package spireconn
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Health tracks whether the spire server has answered recently and whether the operator's SVID is still valid.
+// Pass it in Config.Health and every call made over the connection is recorded.
+type Health struct {
+	mu          sync.Mutex
+	lastSuccess time.Time
+	lastError   error
+	svid        func() (*x509.Certificate, error)
+}
+
+// LastSuccess returns when the spire server last answered a call, zero if it never has
+func (h *Health) LastSuccess() time.Time {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.lastSuccess
+}
+
+// CheckSpire fails when the spire server hasn't answered a call for longer than maxAge
+func (h *Health) CheckSpire(maxAge time.Duration) func() error {
+	return func() error {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if h.lastSuccess.IsZero() {
+			return errors.New("not connected to spire server yet")
+		}
+		if age := time.Since(h.lastSuccess); age > maxAge {
+			return fmt.Errorf("no successful spire server call for %s, last error: %v", age.Round(time.Second), h.lastError)
+		}
+		return nil
+	}
+}
+
+// CheckSVID fails when the SVID the operator authenticates with has expired or can't be read. It always passes
+// when authenticating without an SVID, i.e. over the admin socket.
+func (h *Health) CheckSVID() func() error {
+	return func() error {
+		h.mu.Lock()
+		svid := h.svid
+		h.mu.Unlock()
+		if svid == nil {
+			return nil
+		}
+		cert, err := svid()
+		if err != nil {
+			return fmt.Errorf("failed to read SVID: %v", err)
+		}
+		now := time.Now()
+		if now.After(cert.NotAfter) {
+			return fmt.Errorf("SVID expired at %s", cert.NotAfter.Format(time.RFC3339))
+		}
+		if now.Before(cert.NotBefore) {
+			return fmt.Errorf("SVID not valid until %s", cert.NotBefore.Format(time.RFC3339))
+		}
+		return nil
+	}
+}
+
+// Probe calls probe every interval while no other call has reached the spire server, so that LastSuccess stays
+// current when the operator is idle. Any answer from the server counts, including errors such as NotFound.
+func (h *Health) Probe(interval time.Duration, probe func(ctx context.Context) error, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if time.Since(h.LastSuccess()) < interval {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		_ = probe(ctx)
+		cancel()
+	}
+}
+
+func (h *Health) record(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if serverAnswered(err) {
+		h.lastSuccess = time.Now()
+	} else {
+		h.lastError = err
+	}
+}
+
+func (h *Health) setSVID(svid func() (*x509.Certificate, error)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.svid = svid
+}
+
+// serverAnswered returns false for errors meaning the call never got a response from an authenticated server.
+// Context errors which haven't been converted to a grpc status count as no answer too.
+func serverAnswered(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Canceled, codes.Unauthenticated:
+		return false
+	}
+	return true
+}
+
+// leafCertificate returns the parsed leaf of a TLS certificate chain
+func leafCertificate(cert *tls.Certificate) (*x509.Certificate, error) {
+	if cert.Leaf != nil {
+		return cert.Leaf, nil
+	}
+	if len(cert.Certificate) == 0 {
+		return nil, errors.New("empty certificate chain")
+	}
+	return x509.ParseCertificate(cert.Certificate[0])
+}
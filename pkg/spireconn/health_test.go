@@ -0,0 +1,101 @@
+package spireconn
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCheckSpire(t *testing.T) {
+	tests := []struct {
+		name string
+		// how long ago the server last answered, never if zero
+		lastSuccess time.Duration
+		wantErr     bool
+	}{
+		{name: "never answered", wantErr: true},
+		{name: "recent", lastSuccess: time.Second},
+		{name: "stale", lastSuccess: 2 * time.Minute, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Health{lastError: status.Error(codes.Unavailable, "connection refused")}
+			if tt.lastSuccess > 0 {
+				h.lastSuccess = time.Now().Add(-tt.lastSuccess)
+			}
+			if err := h.CheckSpire(time.Minute)(); (err != nil) != tt.wantErr {
+				t.Errorf("CheckSpire() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckSVID(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name      string
+		notBefore time.Time
+		notAfter  time.Time
+		readErr   error
+		// whether the operator authenticates without an SVID
+		noSVID  bool
+		wantErr bool
+	}{
+		{name: "no SVID", noSVID: true},
+		{name: "valid", notBefore: now.Add(-time.Hour), notAfter: now.Add(time.Hour)},
+		{name: "near expiry", notBefore: now.Add(-time.Hour), notAfter: now.Add(time.Second)},
+		{name: "expired", notBefore: now.Add(-time.Hour), notAfter: now.Add(-time.Second), wantErr: true},
+		{name: "not yet valid", notBefore: now.Add(time.Minute), notAfter: now.Add(time.Hour), wantErr: true},
+		{name: "unreadable", readErr: errors.New("no such file"), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Health{}
+			if !tt.noSVID {
+				h.setSVID(func() (*x509.Certificate, error) {
+					if tt.readErr != nil {
+						return nil, tt.readErr
+					}
+					return &x509.Certificate{NotBefore: tt.notBefore, NotAfter: tt.notAfter}, nil
+				})
+			}
+			if err := h.CheckSVID()(); (err != nil) != tt.wantErr {
+				t.Errorf("CheckSVID() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestServerAnswered(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{err: nil, want: true},
+		{err: status.Error(codes.NotFound, "no such entry"), want: true},
+		{err: status.Error(codes.AlreadyExists, "entry exists"), want: true},
+		{err: status.Error(codes.PermissionDenied, "not an admin"), want: true},
+		{err: status.Error(codes.Internal, "datastore error"), want: true},
+		{err: status.Error(codes.Unavailable, "connection refused")},
+		{err: status.Error(codes.DeadlineExceeded, "deadline exceeded")},
+		{err: status.Error(codes.Canceled, "canceled")},
+		{err: status.Error(codes.Unauthenticated, "bad SVID")},
+		{err: context.DeadlineExceeded},
+		{err: context.Canceled},
+	}
+
+	for _, tt := range tests {
+		t.Run(status.Code(tt.err).String(), func(t *testing.T) {
+			if got := serverAnswered(tt.err); got != tt.want {
+				t.Errorf("serverAnswered(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,249 @@
+// Package spireconn connects to the spire server's APIs, authenticating with the SVID from the workload API.
+package spireconn
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/spiffe/go-spiffe/spiffe"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	DefaultWorkloadAPISocket = "unix:///run/spire/sockets/agent.sock"
+	DefaultAdminSocket       = "unix:///tmp/spire-registration.sock"
+)
+
+// Ways of authenticating to the spire server
+const (
+	// AuthWorkloadAPI uses the SVID issued to the operator by the spire agent on its node
+	AuthWorkloadAPI = "workload-api"
+	// AuthFiles uses a certificate, key and trust bundle read from files, e.g. a mounted Secret
+	AuthFiles = "files"
+	// AuthAdminSocket uses the spire server's local unix socket, when the operator runs alongside the server
+	AuthAdminSocket = "admin-socket"
+)
+
+// Config controls how the spire server is dialled and how calls to it behave
+type Config struct {
+	// How to authenticate, one of AuthWorkloadAPI (the default), AuthFiles or AuthAdminSocket
+	Auth string
+	// Host and port of the spire server
+	ServerAddress string
+	// Address of the spire agent's workload API, used to fetch the operator's SVID
+	WorkloadAPISocket string
+	// PEM files holding the client certificate chain, its key and the CA bundle the server is verified against
+	CertFile   string
+	KeyFile    string
+	BundleFile string
+	// Address of the spire server's local registration socket
+	AdminSocket string
+	// Spiffe ID the spire server must present. Required unless authenticating over the admin socket.
+	ServerID string
+	// Deadline applied to each call which doesn't already have one. Zero leaves calls without a deadline.
+	CallTimeout time.Duration
+	// How often to ping an idle connection, and how long to wait for the ping before reconnecting
+	KeepaliveTime    time.Duration
+	KeepaliveTimeout time.Duration
+	// Longest wait between reconnection attempts
+	MaxBackoff time.Duration
+	// How long to keep retrying the initial connection before giving up
+	DialTimeout time.Duration
+	// Records the outcome of calls and the SVID in use, for the health endpoints. Optional.
+	Health *Health
+	Log    logr.Logger
+}
+
+// Connect dials the spire server, retrying with exponential backoff until DialTimeout passes. Once connected,
+// the connection reconnects by itself with backoff whenever the spire server goes away.
+func Connect(conf Config) (*grpc.ClientConn, error) {
+	ctx := context.Background()
+	if conf.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, conf.DialTimeout)
+		defer cancel()
+	}
+
+	delay := time.Second
+	for {
+		conn, err := dial(ctx, conf)
+		if err == nil {
+			// The handshake with the server has completed, which is as good as an answered call
+			if conf.Health != nil {
+				conf.Health.record(nil)
+			}
+			return conn, nil
+		}
+		// A server with the wrong identity won't fix itself, so don't keep retrying
+		if isAuthError(err) {
+			return nil, fmt.Errorf("spire server at %s failed authentication, check that it presents the spiffe ID %q: %v", conf.ServerAddress, conf.ServerID, err)
+		}
+		conf.Log.Info("Failed to connect to spire server, retrying", "address", conf.ServerAddress, "error", err.Error())
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("failed to connect to spire server at %s: %v", conf.ServerAddress, err)
+		case <-time.After(wait.Jitter(delay, 0.1)):
+		}
+		delay *= 2
+		if conf.MaxBackoff > 0 && delay > conf.MaxBackoff {
+			delay = conf.MaxBackoff
+		}
+	}
+}
+
+func dial(ctx context.Context, conf Config) (*grpc.ClientConn, error) {
+	switch conf.Auth {
+	case "", AuthWorkloadAPI:
+		return dialWorkloadAPI(ctx, conf)
+	case AuthFiles:
+		return dialFiles(ctx, conf)
+	case AuthAdminSocket:
+		return dialAdminSocket(ctx, conf)
+	}
+	return nil, fmt.Errorf("unknown spire auth mode %q", conf.Auth)
+}
+
+func dialWorkloadAPI(ctx context.Context, conf Config) (*grpc.ClientConn, error) {
+	if len(conf.ServerID) == 0 {
+		return nil, errors.New("the expected spire server ID must be given")
+	}
+	tlsPeer, err := spiffe.NewTLSPeer(spiffe.WithWorkloadAPIAddr(conf.WorkloadAPISocket), spiffe.WithLogger(logWrapper{conf.Log}))
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := tlsPeer.GetConfig(ctx, spiffe.ExpectPeer(conf.ServerID))
+	if err != nil {
+		tlsPeer.Close()
+		return nil, err
+	}
+	tlsConfig.VerifyPeerCertificate = rejectingPeer(tlsConfig.VerifyPeerCertificate)
+
+	opts := append(blockingDialOptions(conf), grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	conn, err := grpc.DialContext(ctx, conf.ServerAddress, opts...)
+	if err != nil {
+		tlsPeer.Close()
+		return nil, err
+	}
+	if conf.Health != nil {
+		conf.Health.setSVID(func() (*x509.Certificate, error) {
+			cert, err := tlsPeer.GetCertificate()
+			if err != nil {
+				return nil, err
+			}
+			return leafCertificate(cert)
+		})
+	}
+	return conn, nil
+}
+
+// peerRejectedError is returned from VerifyPeerCertificate when the spire server's certificate doesn't chain to the
+// bundle or carries an unexpected spiffe ID
+type peerRejectedError struct {
+	err error
+}
+
+func (e *peerRejectedError) Error() string {
+	return fmt.Sprintf("spire server rejected: %v", e.err)
+}
+
+func (e *peerRejectedError) Unwrap() error {
+	return e.err
+}
+
+// Temporary is false so that a blocking dial fails straight away rather than retrying the handshake
+func (e *peerRejectedError) Temporary() bool {
+	return false
+}
+
+// rejectingPeer wraps the errors of a VerifyPeerCertificate callback in peerRejectedError
+func rejectingPeer(verify func([][]byte, [][]*x509.Certificate) error) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if err := verify(rawCerts, verifiedChains); err != nil {
+			return &peerRejectedError{err: err}
+		}
+		return nil
+	}
+}
+
+// isAuthError returns true if the TLS handshake failed because the server's certificate was rejected, e.g. for
+// presenting an unexpected spiffe ID
+func isAuthError(err error) bool {
+	var rejected *peerRejectedError
+	if errors.As(err, &rejected) {
+		return true
+	}
+	// grpc's transport errors keep the handshake error as their Origin rather than wrapping it
+	if conn, ok := err.(interface{ Origin() error }); ok {
+		return errors.As(conn.Origin(), &rejected)
+	}
+	return false
+}
+
+// dialOptions returns the keepalive, backoff and deadline options shared by every way of connecting
+func dialOptions(conf Config) []grpc.DialOption {
+	var opts []grpc.DialOption
+	if conf.KeepaliveTime > 0 {
+		opts = append(opts, grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                conf.KeepaliveTime,
+			Timeout:             conf.KeepaliveTimeout,
+			PermitWithoutStream: true,
+		}))
+	}
+	if conf.MaxBackoff > 0 {
+		opts = append(opts, grpc.WithBackoffMaxDelay(conf.MaxBackoff))
+	}
+	if conf.CallTimeout > 0 || conf.Health != nil {
+		opts = append(opts, grpc.WithUnaryInterceptor(callInterceptor(conf.CallTimeout, conf.Health)))
+	}
+	return opts
+}
+
+// blockingDialOptions adds to dialOptions so that dialling blocks until the first handshake completes, and an
+// unreachable or misidentified server fails the dial rather than the first call
+func blockingDialOptions(conf Config) []grpc.DialOption {
+	return append(dialOptions(conf), grpc.WithBlock(), grpc.FailOnNonTempDialError(true))
+}
+
+// callInterceptor gives calls made without a deadline, such as those using context.TODO, the default one, and
+// records their outcome on health. Either may be left unset.
+func callInterceptor(timeout time.Duration, health *Health) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if _, ok := ctx.Deadline(); !ok && timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		if health != nil {
+			health.record(err)
+		}
+		return err
+	}
+}
+
+// logWrapper adapts a logr.Logger to the go-spiffe logger interface
+type logWrapper struct {
+	delegate logr.Logger
+}
+
+func (l logWrapper) Debugf(format string, args ...interface{}) {
+	l.delegate.V(1).Info(fmt.Sprintf(format, args...))
+}
+func (l logWrapper) Infof(format string, args ...interface{}) {
+	l.delegate.Info(fmt.Sprintf(format, args...))
+}
+func (l logWrapper) Warnf(format string, args ...interface{}) {
+	l.delegate.Info(fmt.Sprintf(format, args...))
+}
+func (l logWrapper) Errorf(format string, args ...interface{}) {
+	l.delegate.Info(fmt.Sprintf(format, args...))
+}
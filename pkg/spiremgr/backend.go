@@ -0,0 +1,94 @@
+package spiremgr
+
+import (
+	"context"
+
+	"github.com/spiffe/spire/proto/spire/api/registration"
+	"github.com/spiffe/spire/proto/spire/common"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Backend stores spire registration entries. Errors use grpc status codes the way the spire server does:
+// NotFound for missing entries and AlreadyExists for duplicate ones.
+type Backend interface {
+	// CreateEntry creates an entry and returns its ID. If an equivalent entry already exists an AlreadyExists
+	// error is returned, along with the ID of the existing entry when the backend knows it.
+	CreateEntry(ctx context.Context, entry *common.RegistrationEntry) (string, error)
+	// UpdateEntry replaces all the fields of the entry with the same entry ID.
+	UpdateEntry(ctx context.Context, entry *common.RegistrationEntry) (*common.RegistrationEntry, error)
+	// DeleteEntry deletes a single entry.
+	DeleteEntry(ctx context.Context, entryId string) error
+	// DeleteEntries deletes many entries, returning the errors for those which couldn't be deleted by entry ID.
+	DeleteEntries(ctx context.Context, entryIds []string) (map[string]error, error)
+	// GetEntry fetches a single entry.
+	GetEntry(ctx context.Context, entryId string) (*common.RegistrationEntry, error)
+	// ListEntries lists all the entries with the given parent ID.
+	ListEntries(ctx context.Context, parentId string) ([]*common.RegistrationEntry, error)
+	// EnsureParent creates the entry which the operator's entries are parented to, if it doesn't exist yet.
+	EnsureParent(ctx context.Context, parent *common.RegistrationEntry) error
+}
+
+// RegistrationBackend manages entries with the spire server's legacy registration API.
+type RegistrationBackend struct {
+	Client registration.RegistrationClient
+}
+
+// blank assignment to verify that RegistrationBackend implements Backend
+var _ Backend = &RegistrationBackend{}
+
+func (r *RegistrationBackend) CreateEntry(ctx context.Context, entry *common.RegistrationEntry) (string, error) {
+	regEntryId, err := r.Client.CreateEntry(ctx, entry)
+	if err != nil {
+		return "", err
+	}
+	return regEntryId.GetId(), nil
+}
+
+func (r *RegistrationBackend) UpdateEntry(ctx context.Context, entry *common.RegistrationEntry) (*common.RegistrationEntry, error) {
+	return r.Client.UpdateEntry(ctx, &registration.UpdateEntryRequest{
+		Entry: entry,
+	})
+}
+
+func (r *RegistrationBackend) DeleteEntry(ctx context.Context, entryId string) error {
+	_, err := r.Client.DeleteEntry(ctx, &registration.RegistrationEntryID{
+		Id: entryId,
+	})
+	return err
+}
+
+// DeleteEntries deletes the entries one at a time, as the registration API has no batch delete.
+func (r *RegistrationBackend) DeleteEntries(ctx context.Context, entryIds []string) (map[string]error, error) {
+	failed := map[string]error{}
+	for _, entryId := range entryIds {
+		if err := r.DeleteEntry(ctx, entryId); err != nil {
+			failed[entryId] = err
+		}
+	}
+	return failed, nil
+}
+
+func (r *RegistrationBackend) GetEntry(ctx context.Context, entryId string) (*common.RegistrationEntry, error) {
+	return r.Client.FetchEntry(ctx, &registration.RegistrationEntryID{
+		Id: entryId,
+	})
+}
+
+func (r *RegistrationBackend) ListEntries(ctx context.Context, parentId string) ([]*common.RegistrationEntry, error) {
+	entries, err := r.Client.ListByParentID(ctx, &registration.ParentID{
+		Id: parentId,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries.GetEntries(), nil
+}
+
+func (r *RegistrationBackend) EnsureParent(ctx context.Context, parent *common.RegistrationEntry) error {
+	_, err := r.CreateEntry(ctx, parent)
+	if status.Code(err) == codes.AlreadyExists {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,428 @@
+package spiremgr_test
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/spiffe/spire/proto/spire/common"
+	"github.com/transferwise/spire-k8s-operator/pkg/spiremgr"
+	"github.com/transferwise/spire-k8s-operator/pkg/spiremgr/fakespire"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// The operator's parent ID in the example.org trust domain for the cluster "test"
+const nodeId = "spiffe://example.org/spire-k8s-operator/test/node"
+
+// startSpire starts a fake spire server and returns SpireUtils using the backend connected to it, and a function
+// stopping the server
+func startSpire(t *testing.T, connect func(conn *grpc.ClientConn) spiremgr.Backend) (*fakespire.Server, *spiremgr.SpireUtils, func()) {
+	server := fakespire.New()
+	conn, err := server.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := func() {
+		conn.Close()
+		server.Stop()
+	}
+	return server, &spiremgr.SpireUtils{Backend: connect(conn), TrustDomain: "example.org", Cluster: "test"}, stop
+}
+
+func TestEnsureEntry(t *testing.T) {
+	template := &common.RegistrationEntry{
+		SpiffeId:      "spiffe://example.org/ns/default/sa/web",
+		Selectors:     []*common.Selector{{Value: "k8s:ns:default"}, {Value: "k8s:sa:web"}},
+		Ttl:           3600,
+		DnsNames:      []string{"web.default.svc"},
+		FederatesWith: []string{"spiffe://other.org"},
+	}
+	matching := &common.RegistrationEntry{
+		ParentId:      nodeId,
+		SpiffeId:      template.SpiffeId,
+		Selectors:     []*common.Selector{{Type: "k8s", Value: "ns:default"}, {Type: "k8s", Value: "sa:web"}},
+		Ttl:           3600,
+		DnsNames:      []string{"web.default.svc"},
+		FederatesWith: []string{"spiffe://other.org"},
+	}
+	drifted := &common.RegistrationEntry{
+		ParentId:  nodeId,
+		SpiffeId:  template.SpiffeId,
+		Selectors: matching.Selectors,
+		Ttl:       60,
+		Admin:     true,
+	}
+	renamed := &common.RegistrationEntry{
+		ParentId:  nodeId,
+		SpiffeId:  "spiffe://example.org/ns/default/sa/old",
+		Selectors: matching.Selectors,
+	}
+
+	tests := []struct {
+		name string
+		// entry in spire before the reconcile
+		existing *common.RegistrationEntry
+		// whether the SpiffeId already knows the existing entry's ID
+		knownId bool
+		// whether the existing entry is removed from spire behind the operator's back
+		removed     bool
+		wantOutcome spiremgr.EntryOutcome
+	}{
+		{name: "create", wantOutcome: spiremgr.EntryCreated},
+		{name: "unchanged", existing: matching, knownId: true, wantOutcome: spiremgr.EntryUnchanged},
+		{name: "drifted", existing: drifted, knownId: true, wantOutcome: spiremgr.EntryUpdated},
+		{name: "spiffe ID changed", existing: renamed, knownId: true, wantOutcome: spiremgr.EntryUpdated},
+		{name: "removed", existing: matching, knownId: true, removed: true, wantOutcome: spiremgr.EntryRecreated},
+		{name: "reuse match", existing: matching, wantOutcome: spiremgr.EntryReused},
+		{name: "reuse duplicate", existing: drifted, wantOutcome: spiremgr.EntryReused},
+	}
+
+	for _, backend := range fakespire.Backends {
+		for _, tt := range tests {
+			t.Run(backend.Name+"/"+tt.name, func(t *testing.T) {
+				server, utils, stop := startSpire(t, backend.Connect)
+				defer stop()
+				entryId := ""
+				if tt.existing != nil {
+					existingId := server.AddEntry(tt.existing)
+					if tt.knownId {
+						entryId = existingId
+					}
+					if tt.removed {
+						server.RemoveEntry(existingId)
+					}
+				}
+
+				gotId, outcome, err := utils.EnsureEntry(logf.Log, entryId, template)
+				if err != nil {
+					t.Fatalf("EnsureEntry() error = %v", err)
+				}
+				if outcome != tt.wantOutcome {
+					t.Errorf("EnsureEntry() outcome = %v, want %v", outcome, tt.wantOutcome)
+				}
+
+				entry := server.Entry(gotId)
+				if entry == nil {
+					t.Fatalf("entry %s doesn't exist", gotId)
+				}
+				if !spiremgr.EntryIsDuplicate(entry, matching) || entry.Ttl != matching.Ttl || entry.Admin ||
+					!reflect.DeepEqual(entry.DnsNames, matching.DnsNames) || !reflect.DeepEqual(entry.FederatesWith, matching.FederatesWith) {
+					t.Errorf("entry = %v, want %v", entry, matching)
+				}
+				// Just the operator's parent entry and the SpiffeId's
+				if entries := server.Entries(); len(entries) != 2 {
+					t.Errorf("spire has %d entries, want 2: %v", len(entries), entries)
+				}
+			})
+		}
+	}
+}
+
+func TestDeleteEntries(t *testing.T) {
+	for _, backend := range fakespire.Backends {
+		t.Run(backend.Name, func(t *testing.T) {
+			server, utils, stop := startSpire(t, backend.Connect)
+			defer stop()
+			server.StrictDelete = true
+			var entryIds []string
+			for i := 0; i < 25; i++ {
+				entryIds = append(entryIds, server.AddEntry(&common.RegistrationEntry{
+					ParentId:  nodeId,
+					SpiffeId:  fmt.Sprintf("spiffe://example.org/%d", i),
+					Selectors: []*common.Selector{{Type: "k8s", Value: "ns:default"}},
+				}))
+			}
+			kept := entryIds[0]
+
+			failed, err := utils.DeleteEntries(logf.Log, append(entryIds[1:], "missing"))
+			if err != nil {
+				t.Fatalf("DeleteEntries() error = %v", err)
+			}
+			if len(failed) > 0 {
+				t.Errorf("DeleteEntries() failed = %v, want none as missing entries count as deleted", failed)
+			}
+			if entries := server.Entries(); len(entries) != 1 || entries[0].EntryId != kept {
+				t.Errorf("spire has entries %v, want just %s", entries, kept)
+			}
+		})
+	}
+}
+
+func TestListEntries(t *testing.T) {
+	for _, backend := range fakespire.Backends {
+		t.Run(backend.Name, func(t *testing.T) {
+			server, utils, stop := startSpire(t, backend.Connect)
+			defer stop()
+			// More than a page of the operator's entries, and one which isn't the operator's
+			const count = 501
+			for i := 0; i < count; i++ {
+				server.AddEntry(&common.RegistrationEntry{
+					ParentId:  nodeId,
+					SpiffeId:  fmt.Sprintf("spiffe://example.org/%d", i),
+					Selectors: []*common.Selector{{Type: "k8s", Value: "ns:default"}},
+				})
+			}
+			server.AddEntry(&common.RegistrationEntry{
+				ParentId:  "spiffe://example.org/spire/agent/other",
+				SpiffeId:  "spiffe://example.org/other",
+				Selectors: []*common.Selector{{Type: "k8s", Value: "ns:default"}},
+			})
+
+			entries, err := utils.ListEntries(logf.Log)
+			if err != nil {
+				t.Fatalf("ListEntries() error = %v", err)
+			}
+			if len(entries) != count {
+				t.Errorf("ListEntries() returned %d entries, want %d", len(entries), count)
+			}
+			for _, entry := range entries {
+				if entry.ParentId != nodeId {
+					t.Errorf("ListEntries() returned %v, which isn't parented to the operator", entry)
+				}
+			}
+		})
+	}
+}
+
+// failNext makes the next calls to whichever of the registration or entry/v1 methods the backend uses fail
+func failNext(server *fakespire.Server, methods []string, errs ...error) {
+	for _, method := range methods {
+		server.FailNext(method, errs...)
+	}
+}
+
+// calls counts the calls to whichever of the registration or entry/v1 methods the backend uses
+func calls(server *fakespire.Server, methods []string) int {
+	total := 0
+	for _, method := range methods {
+		total += server.Calls(method)
+	}
+	return total
+}
+
+var (
+	createMethods = []string{fakespire.MethodCreateEntry, fakespire.MethodBatchCreateEntry}
+	updateMethods = []string{fakespire.MethodUpdateEntry, fakespire.MethodBatchUpdateEntry}
+	deleteMethods = []string{fakespire.MethodDeleteEntry, fakespire.MethodBatchDeleteEntry}
+)
+
+func TestGetOrCreateEntryErrors(t *testing.T) {
+	template := &common.RegistrationEntry{
+		SpiffeId:  "spiffe://example.org/ns/default/sa/web",
+		Selectors: []*common.Selector{{Type: "k8s", Value: "ns:default"}, {Type: "k8s", Value: "sa:web"}},
+		Ttl:       3600,
+	}
+	duplicate := &common.RegistrationEntry{
+		ParentId:  nodeId,
+		SpiffeId:  template.SpiffeId,
+		Selectors: template.Selectors,
+		Ttl:       60,
+	}
+	alreadyExists := status.Error(codes.AlreadyExists, "entry already exists")
+	internal := status.Error(codes.Internal, "datastore unavailable")
+
+	tests := []struct {
+		name string
+		// entry in spire before the create
+		existing *common.RegistrationEntry
+		// sets up the errors injected into the server
+		inject      func(server *fakespire.Server)
+		wantErr     error
+		wantReused  bool
+		wantCreates int
+		wantUpdates int
+		// TTL of the SpiffeId's entry in spire afterwards, 0 if there shouldn't be one
+		wantTtl int32
+	}{
+		{
+			name: "entry deleted after AlreadyExists",
+			inject: func(server *fakespire.Server) {
+				failNext(server, createMethods, alreadyExists)
+			},
+			wantCreates: 2,
+			wantTtl:     3600,
+		},
+		{
+			name: "entry never found after AlreadyExists",
+			inject: func(server *fakespire.Server) {
+				server.SetErrorHook(func(method string, req interface{}) error {
+					if method == fakespire.MethodCreateEntry || method == fakespire.MethodBatchCreateEntry {
+						return alreadyExists
+					}
+					return nil
+				})
+			},
+			wantErr:     spiremgr.ExistingEntryNotFoundError,
+			wantCreates: 2,
+		},
+		{
+			name:        "adopt duplicate",
+			existing:    duplicate,
+			wantReused:  true,
+			wantCreates: 1,
+			wantUpdates: 1,
+			wantTtl:     3600,
+		},
+		{
+			name:     "adopt duplicate update fails",
+			existing: duplicate,
+			inject: func(server *fakespire.Server) {
+				failNext(server, updateMethods, internal)
+			},
+			wantErr:     internal,
+			wantCreates: 1,
+			wantUpdates: 1,
+			wantTtl:     60,
+		},
+		{
+			name: "create fails",
+			inject: func(server *fakespire.Server) {
+				failNext(server, createMethods, internal)
+			},
+			wantErr:     internal,
+			wantCreates: 1,
+		},
+	}
+
+	for _, backend := range fakespire.Backends {
+		for _, tt := range tests {
+			t.Run(backend.Name+"/"+tt.name, func(t *testing.T) {
+				server, utils, stop := startSpire(t, backend.Connect)
+				defer stop()
+				if tt.existing != nil {
+					server.AddEntry(tt.existing)
+				}
+				// Create the operator's parent entry before any errors are injected
+				if _, err := utils.ListEntries(logf.Log); err != nil {
+					t.Fatal(err)
+				}
+				creates, updates := calls(server, createMethods), calls(server, updateMethods)
+				if tt.inject != nil {
+					tt.inject(server)
+				}
+
+				entryId, reused, err := utils.GetOrCreateEntry(logf.Log, template)
+				if tt.wantErr != nil {
+					// Errors from the server lose their identity crossing grpc, so compare their status
+					if err == nil || status.Convert(err).String() != status.Convert(tt.wantErr).String() {
+						t.Errorf("GetOrCreateEntry() error = %v, want %v", err, tt.wantErr)
+					}
+				} else if err != nil {
+					t.Fatalf("GetOrCreateEntry() error = %v", err)
+				}
+				if reused != tt.wantReused {
+					t.Errorf("GetOrCreateEntry() reused = %v, want %v", reused, tt.wantReused)
+				}
+				if got := calls(server, createMethods) - creates; got != tt.wantCreates {
+					t.Errorf("%d creates, want %d", got, tt.wantCreates)
+				}
+				if got := calls(server, updateMethods) - updates; got != tt.wantUpdates {
+					t.Errorf("%d updates, want %d", got, tt.wantUpdates)
+				}
+
+				var entries []*common.RegistrationEntry
+				for _, entry := range server.Entries() {
+					if entry.SpiffeId == template.SpiffeId {
+						entries = append(entries, entry)
+					}
+				}
+				if tt.wantTtl == 0 {
+					if len(entries) > 0 {
+						t.Errorf("spire has entries %v, want none", entries)
+					}
+					return
+				}
+				if len(entries) != 1 || entries[0].Ttl != tt.wantTtl {
+					t.Fatalf("spire has entries %v, want one with TTL %d", entries, tt.wantTtl)
+				}
+				if err == nil && entries[0].EntryId != entryId {
+					t.Errorf("GetOrCreateEntry() = %q, want %q", entryId, entries[0].EntryId)
+				}
+			})
+		}
+	}
+}
+
+func TestDeleteEntry(t *testing.T) {
+	tests := []struct {
+		name string
+		// whether the entry is removed from spire before it's deleted
+		removed bool
+		// error injected into the delete
+		inject error
+		// whether the entry should still be in spire
+		wantKept bool
+	}{
+		{name: "deleted"},
+		{name: "already gone", removed: true},
+		// The spire server returns Internal for missing entries, so Internal errors are assumed to mean the entry
+		// is gone
+		{name: "internal error", inject: status.Error(codes.Internal, "failed to delete entry"), wantKept: true},
+	}
+
+	for _, backend := range fakespire.Backends {
+		for _, tt := range tests {
+			t.Run(backend.Name+"/"+tt.name, func(t *testing.T) {
+				server, utils, stop := startSpire(t, backend.Connect)
+				defer stop()
+				entryId := server.AddEntry(&common.RegistrationEntry{
+					ParentId:  nodeId,
+					SpiffeId:  "spiffe://example.org/ns/default/sa/web",
+					Selectors: []*common.Selector{{Type: "k8s", Value: "ns:default"}},
+				})
+				if tt.removed {
+					server.RemoveEntry(entryId)
+				}
+				if tt.inject != nil {
+					failNext(server, deleteMethods, tt.inject)
+				}
+
+				if err := utils.DeleteEntry(logf.Log, entryId); err != nil {
+					t.Errorf("DeleteEntry() error = %v, want nil", err)
+				}
+				if calls(server, deleteMethods) != 1 {
+					t.Errorf("%d deletes, want 1", calls(server, deleteMethods))
+				}
+				if kept := server.Entry(entryId) != nil; kept != tt.wantKept {
+					t.Errorf("entry kept = %v, want %v", kept, tt.wantKept)
+				}
+			})
+		}
+	}
+}
+
+func TestCallTimeout(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+	for _, backend := range fakespire.Backends {
+		t.Run(backend.Name, func(t *testing.T) {
+			server, utils, stop := startSpire(t, backend.Connect)
+			defer stop()
+			utils.CallTimeout = timeout
+			// Create the operator's parent entry before the server slows down
+			if _, err := utils.ListEntries(logf.Log); err != nil {
+				t.Fatal(err)
+			}
+			server.SetErrorHook(func(method string, req interface{}) error {
+				time.Sleep(10 * timeout)
+				return nil
+			})
+
+			start := time.Now()
+			_, _, err := utils.EnsureEntry(logf.Log, "", &common.RegistrationEntry{
+				SpiffeId:  "spiffe://example.org/ns/default/sa/web",
+				Selectors: []*common.Selector{{Type: "k8s", Value: "ns:default"}},
+			})
+			if status.Code(err) != codes.DeadlineExceeded && err != context.DeadlineExceeded {
+				t.Errorf("EnsureEntry() error = %v, want the deadline to be exceeded", err)
+			}
+			if elapsed := time.Since(start); elapsed >= 10*timeout {
+				t.Errorf("EnsureEntry() took %s, want it to give up after %s", elapsed, timeout)
+			}
+		})
+	}
+}
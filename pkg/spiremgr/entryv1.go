@@ -0,0 +1,396 @@
+package spiremgr
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	entryv1 "github.com/spiffe/spire-api-sdk/proto/spire/api/server/entry/v1"
+	"github.com/spiffe/spire-api-sdk/proto/spire/api/types"
+	"github.com/spiffe/spire/proto/spire/common"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultBatchWindow  = 50 * time.Millisecond
+	defaultMaxBatchSize = 100
+	defaultListPageSize = 500
+	// Longest a batch RPC may take
+	defaultBatchTimeout = time.Minute
+)
+
+// EntryV1Client talks to the spire server's entry/v1 API. Creates, updates and deletes made concurrently by
+// different reconciles are coalesced into batch RPCs, and listing is filtered and paginated server side.
+type EntryV1Client struct {
+	client  entryv1.EntryClient
+	creates *batcher
+	updates *batcher
+	deletes *batcher
+}
+
+// NewEntryV1Client creates an entry/v1 client. Calls are held for up to batchWindow waiting for others to batch
+// with, and batches are sent early once they reach maxBatchSize. Zero values use the defaults.
+func NewEntryV1Client(conn *grpc.ClientConn, batchWindow time.Duration, maxBatchSize int) *EntryV1Client {
+	if batchWindow <= 0 {
+		batchWindow = defaultBatchWindow
+	}
+	if maxBatchSize <= 0 {
+		maxBatchSize = defaultMaxBatchSize
+	}
+	c := &EntryV1Client{client: entryv1.NewEntryClient(conn)}
+	c.creates = &batcher{window: batchWindow, maxSize: maxBatchSize, flush: c.flushCreates}
+	c.updates = &batcher{window: batchWindow, maxSize: maxBatchSize, flush: c.flushUpdates}
+	c.deletes = &batcher{window: batchWindow, maxSize: maxBatchSize, flush: c.flushDeletes}
+	return c
+}
+
+// blank assignment to verify that EntryV1Client implements Backend
+var _ Backend = &EntryV1Client{}
+
+// CreateEntry creates an entry. If an entry with the same parent, spiffe ID and selectors already exists, an
+// AlreadyExists error is returned along with the ID of the existing entry.
+func (c *EntryV1Client) CreateEntry(ctx context.Context, entry *common.RegistrationEntry) (string, error) {
+	v1Entry, err := entryToV1(entry)
+	if err != nil {
+		return "", status.Error(codes.InvalidArgument, err.Error())
+	}
+	result, err := c.creates.do(ctx, v1Entry)
+	if result == nil {
+		return "", err
+	}
+	return result.(*common.RegistrationEntry).GetEntryId(), err
+}
+
+// UpdateEntry replaces all the fields of the entry with the given entry ID.
+func (c *EntryV1Client) UpdateEntry(ctx context.Context, entry *common.RegistrationEntry) (*common.RegistrationEntry, error) {
+	v1Entry, err := entryToV1(entry)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	result, err := c.updates.do(ctx, v1Entry)
+	if result == nil {
+		return nil, err
+	}
+	return result.(*common.RegistrationEntry), err
+}
+
+// DeleteEntry deletes a single entry.
+func (c *EntryV1Client) DeleteEntry(ctx context.Context, entryId string) error {
+	_, err := c.deletes.do(ctx, entryId)
+	return err
+}
+
+// DeleteEntries deletes many entries with as few RPCs as the maximum batch size allows, returning the errors for
+// the entries which couldn't be deleted by entry ID.
+func (c *EntryV1Client) DeleteEntries(ctx context.Context, entryIds []string) (map[string]error, error) {
+	failed := map[string]error{}
+	for start := 0; start < len(entryIds); start += c.deletes.maxSize {
+		end := start + c.deletes.maxSize
+		if end > len(entryIds) {
+			end = len(entryIds)
+		}
+		ids := make([]interface{}, 0, end-start)
+		for _, id := range entryIds[start:end] {
+			ids = append(ids, id)
+		}
+		results, err := c.flushDeletes(ctx, ids)
+		if err != nil {
+			return nil, err
+		}
+		for i, result := range results {
+			if result.err != nil {
+				failed[entryIds[start+i]] = result.err
+			}
+		}
+	}
+	return failed, nil
+}
+
+// GetEntry fetches a single entry, returning a NotFound error if it doesn't exist.
+func (c *EntryV1Client) GetEntry(ctx context.Context, entryId string) (*common.RegistrationEntry, error) {
+	v1Entry, err := c.client.GetEntry(ctx, &entryv1.GetEntryRequest{Id: entryId})
+	if err != nil {
+		return nil, err
+	}
+	return entryFromV1(v1Entry), nil
+}
+
+// ListEntries lists all the entries with the given parent, a page at a time.
+func (c *EntryV1Client) ListEntries(ctx context.Context, parentId string) ([]*common.RegistrationEntry, error) {
+	v1ParentId, err := spiffeIdToV1(parentId)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	var entries []*common.RegistrationEntry
+	pageToken := ""
+	for {
+		resp, err := c.client.ListEntries(ctx, &entryv1.ListEntriesRequest{
+			Filter: &entryv1.ListEntriesRequest_Filter{
+				ByParentId: v1ParentId,
+			},
+			PageSize:  defaultListPageSize,
+			PageToken: pageToken,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, v1Entry := range resp.GetEntries() {
+			entries = append(entries, entryFromV1(v1Entry))
+		}
+		pageToken = resp.GetNextPageToken()
+		if len(pageToken) == 0 {
+			return entries, nil
+		}
+	}
+}
+
+// EnsureParent creates the parent entry, ignoring the error if it already exists.
+func (c *EntryV1Client) EnsureParent(ctx context.Context, parent *common.RegistrationEntry) error {
+	_, err := c.CreateEntry(ctx, parent)
+	if status.Code(err) == codes.AlreadyExists {
+		return nil
+	}
+	return err
+}
+
+func (c *EntryV1Client) flushCreates(ctx context.Context, items []interface{}) ([]batchResult, error) {
+	entries := make([]*types.Entry, 0, len(items))
+	for _, item := range items {
+		entries = append(entries, item.(*types.Entry))
+	}
+	resp, err := c.client.BatchCreateEntry(ctx, &entryv1.BatchCreateEntryRequest{Entries: entries})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.GetResults()) != len(items) {
+		return nil, status.Errorf(codes.Internal, "expected %d batch create results, got %d", len(items), len(resp.GetResults()))
+	}
+	results := make([]batchResult, 0, len(items))
+	for _, result := range resp.GetResults() {
+		var created *common.RegistrationEntry
+		if result.GetEntry() != nil {
+			created = entryFromV1(result.GetEntry())
+		}
+		results = append(results, batchResult{value: created, err: statusToError(result.GetStatus())})
+	}
+	return results, nil
+}
+
+func (c *EntryV1Client) flushUpdates(ctx context.Context, items []interface{}) ([]batchResult, error) {
+	entries := make([]*types.Entry, 0, len(items))
+	for _, item := range items {
+		entries = append(entries, item.(*types.Entry))
+	}
+	resp, err := c.client.BatchUpdateEntry(ctx, &entryv1.BatchUpdateEntryRequest{Entries: entries})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.GetResults()) != len(items) {
+		return nil, status.Errorf(codes.Internal, "expected %d batch update results, got %d", len(items), len(resp.GetResults()))
+	}
+	results := make([]batchResult, 0, len(items))
+	for _, result := range resp.GetResults() {
+		var updated *common.RegistrationEntry
+		if result.GetEntry() != nil {
+			updated = entryFromV1(result.GetEntry())
+		}
+		results = append(results, batchResult{value: updated, err: statusToError(result.GetStatus())})
+	}
+	return results, nil
+}
+
+func (c *EntryV1Client) flushDeletes(ctx context.Context, items []interface{}) ([]batchResult, error) {
+	ids := make([]string, 0, len(items))
+	for _, item := range items {
+		ids = append(ids, item.(string))
+	}
+	resp, err := c.client.BatchDeleteEntry(ctx, &entryv1.BatchDeleteEntryRequest{Ids: ids})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.GetResults()) != len(items) {
+		return nil, status.Errorf(codes.Internal, "expected %d batch delete results, got %d", len(items), len(resp.GetResults()))
+	}
+	results := make([]batchResult, 0, len(items))
+	for _, result := range resp.GetResults() {
+		results = append(results, batchResult{err: statusToError(result.GetStatus())})
+	}
+	return results, nil
+}
+
+func statusToError(s *types.Status) error {
+	if s == nil || codes.Code(s.GetCode()) == codes.OK {
+		return nil
+	}
+	return status.Error(codes.Code(s.GetCode()), s.GetMessage())
+}
+
+// entryToV1 converts an entry to the entry/v1 representation. Spiffe IDs are split into trust domain and path,
+// federated trust domains are given by name and selectors must have a type.
+func entryToV1(in *common.RegistrationEntry) (*types.Entry, error) {
+	spiffeId, err := spiffeIdToV1(in.GetSpiffeId())
+	if err != nil {
+		return nil, err
+	}
+	parentId, err := spiffeIdToV1(in.GetParentId())
+	if err != nil {
+		return nil, err
+	}
+	selectors := make([]*types.Selector, 0, len(in.GetSelectors()))
+	for _, sel := range in.GetSelectors() {
+		key := normalizeSelector(sel)
+		selectors = append(selectors, &types.Selector{Type: key.Type, Value: key.Value})
+	}
+	federatesWith := make([]string, 0, len(in.GetFederatesWith()))
+	for _, trustDomain := range in.GetFederatesWith() {
+		federatesWith = append(federatesWith, strings.TrimPrefix(trustDomain, "spiffe://"))
+	}
+	return &types.Entry{
+		Id:            in.GetEntryId(),
+		SpiffeId:      spiffeId,
+		ParentId:      parentId,
+		Selectors:     selectors,
+		Ttl:           in.GetTtl(),
+		FederatesWith: federatesWith,
+		Admin:         in.GetAdmin(),
+		Downstream:    in.GetDownstream(),
+		DnsNames:      in.GetDnsNames(),
+	}, nil
+}
+
+func entryFromV1(in *types.Entry) *common.RegistrationEntry {
+	selectors := make([]*common.Selector, 0, len(in.GetSelectors()))
+	for _, sel := range in.GetSelectors() {
+		selectors = append(selectors, &common.Selector{Type: sel.GetType(), Value: sel.GetValue()})
+	}
+	var federatesWith []string
+	for _, trustDomain := range in.GetFederatesWith() {
+		federatesWith = append(federatesWith, "spiffe://"+trustDomain)
+	}
+	return &common.RegistrationEntry{
+		EntryId:       in.GetId(),
+		SpiffeId:      spiffeIdFromV1(in.GetSpiffeId()),
+		ParentId:      spiffeIdFromV1(in.GetParentId()),
+		Selectors:     selectors,
+		Ttl:           in.GetTtl(),
+		FederatesWith: federatesWith,
+		Admin:         in.GetAdmin(),
+		Downstream:    in.GetDownstream(),
+		DnsNames:      in.GetDnsNames(),
+	}
+}
+
+func spiffeIdToV1(id string) (*types.SPIFFEID, error) {
+	u, err := ParseSpiffeId(id)
+	if err != nil {
+		return nil, fmt.Errorf("invalid spiffe ID %q: %v", id, err)
+	}
+	return &types.SPIFFEID{TrustDomain: u.Host, Path: u.Path}, nil
+}
+
+func spiffeIdFromV1(id *types.SPIFFEID) string {
+	if id == nil {
+		return ""
+	}
+	return "spiffe://" + id.GetTrustDomain() + id.GetPath()
+}
+
+type batchResult struct {
+	value interface{}
+	err   error
+}
+
+type batchRequest struct {
+	ctx    context.Context
+	item   interface{}
+	result chan batchResult
+}
+
+// batcher coalesces single calls made within a short window of each other into one batch RPC.
+type batcher struct {
+	window  time.Duration
+	maxSize int
+	// flush sends a batch, returning one result per item in the same order
+	flush func(ctx context.Context, items []interface{}) ([]batchResult, error)
+
+	mu      sync.Mutex
+	pending []*batchRequest
+	timer   *time.Timer
+}
+
+func (b *batcher) do(ctx context.Context, item interface{}) (interface{}, error) {
+	req := &batchRequest{ctx: ctx, item: item, result: make(chan batchResult, 1)}
+
+	b.mu.Lock()
+	b.pending = append(b.pending, req)
+	if len(b.pending) >= b.maxSize {
+		batch := b.take()
+		b.mu.Unlock()
+		go b.send(batch)
+	} else {
+		if b.timer == nil {
+			b.timer = time.AfterFunc(b.window, b.flushPending)
+		}
+		b.mu.Unlock()
+	}
+
+	select {
+	case result := <-req.result:
+		return result.value, result.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (b *batcher) flushPending() {
+	b.mu.Lock()
+	batch := b.take()
+	b.mu.Unlock()
+	b.send(batch)
+}
+
+// take removes the pending requests. b.mu must be held.
+func (b *batcher) take() []*batchRequest {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	batch := b.pending
+	b.pending = nil
+	return batch
+}
+
+// send flushes the batch, leaving out the calls which have already been cancelled. The RPC is only bounded by
+// defaultBatchTimeout, so a call with a short deadline can't fail the others in its batch; each caller stops
+// waiting when its own context is done.
+func (b *batcher) send(batch []*batchRequest) {
+	live := make([]*batchRequest, 0, len(batch))
+	items := make([]interface{}, 0, len(batch))
+	for _, req := range batch {
+		if err := req.ctx.Err(); err != nil {
+			req.result <- batchResult{err: err}
+			continue
+		}
+		live = append(live, req)
+		items = append(items, req.item)
+	}
+	if len(live) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultBatchTimeout)
+	defer cancel()
+	results, err := b.flush(ctx, items)
+	for i, req := range live {
+		if err != nil {
+			req.result <- batchResult{err: err}
+			continue
+		}
+		req.result <- results[i]
+	}
+}
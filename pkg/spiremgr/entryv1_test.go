@@ -0,0 +1,42 @@
+package spiremgr
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBatcherDeadlines(t *testing.T) {
+	b := &batcher{
+		window:  10 * time.Millisecond,
+		maxSize: 10,
+		flush: func(ctx context.Context, items []interface{}) ([]batchResult, error) {
+			select {
+			case <-time.After(100 * time.Millisecond):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			results := make([]batchResult, len(items))
+			for i, item := range items {
+				results[i] = batchResult{value: item}
+			}
+			return results, nil
+		},
+	}
+
+	short, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	shortErr := make(chan error, 1)
+	go func() {
+		_, err := b.do(short, "short")
+		shortErr <- err
+	}()
+
+	value, err := b.do(context.Background(), "long")
+	if err != nil || value != "long" {
+		t.Errorf("do() = %v, %v, want long", value, err)
+	}
+	if err := <-shortErr; err != context.DeadlineExceeded {
+		t.Errorf("do() with a short deadline error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
@@ -0,0 +1,76 @@
+package spiremgr
+
+import (
+	spiffeidv1alpha1 "github.com/transferwise/spire-k8s-operator/pkg/apis/spiffeid/v1alpha1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// Reasons of the events recorded for SpiffeIds
+const (
+	EventEntryCreated     = "EntryCreated"
+	EventEntryReused      = "EntryReused"
+	EventEntryDeleted     = "EntryDeleted"
+	EventSpireUnavailable = "SpireUnavailable"
+)
+
+// EventRecorder records SpiffeId lifecycle events on the SpiffeId, and also on the Pod that a ClusterSpiffeId
+// was generated for, so that app teams can see what happened without reading the operator logs.
+type EventRecorder struct {
+	Recorder record.EventRecorder
+}
+
+// Event records an event on the instance and its source Pod.
+func (r *EventRecorder) Event(instance spiffeidv1alpha1.CommonSpiffeId, eventType string, reason string, message string) {
+	r.Recorder.Event(instance, eventType, reason, message)
+	if pod := sourcePod(instance); pod != nil {
+		r.Recorder.Event(pod, eventType, reason, message)
+	}
+}
+
+// SpireError records a Warning event for a failed spire server call, distinguishing an unreachable spire server
+// from spire rejecting the request.
+func (r *EventRecorder) SpireError(instance spiffeidv1alpha1.CommonSpiffeId, err error) {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded:
+		r.Event(instance, corev1.EventTypeWarning, EventSpireUnavailable, "Spire server is unavailable: "+err.Error())
+	default:
+		r.Event(instance, corev1.EventTypeWarning, ReasonSpireError, "Spire server rejected the entry: "+err.Error())
+	}
+}
+
+// EntrySynced records a Normal event when an entry was created for the instance or an existing one was reused.
+func (r *EventRecorder) EntrySynced(instance spiffeidv1alpha1.CommonSpiffeId, entryId string, outcome EntryOutcome) {
+	switch outcome {
+	case EntryCreated:
+		r.Event(instance, corev1.EventTypeNormal, EventEntryCreated, "Created spire entry "+entryId)
+	case EntryReused:
+		r.Event(instance, corev1.EventTypeNormal, EventEntryReused, "Reusing existing spire entry "+entryId)
+	}
+}
+
+// sourcePod returns a reference to the Pod controlling the instance, if any. Pod controlled ClusterSpiffeIds
+// select the pod's namespace, which the owner reference doesn't record.
+func sourcePod(instance spiffeidv1alpha1.CommonSpiffeId) *corev1.ObjectReference {
+	owner := v1.GetControllerOf(instance)
+	if owner == nil || owner.Kind != "Pod" || owner.APIVersion != "v1" {
+		return nil
+	}
+	namespace := instance.GetNamespace()
+	if len(namespace) == 0 {
+		namespace = instance.GetSpec().Selector.Namespace
+	}
+	if len(namespace) == 0 {
+		return nil
+	}
+	return &corev1.ObjectReference{
+		APIVersion: owner.APIVersion,
+		Kind:       owner.Kind,
+		Namespace:  namespace,
+		Name:       owner.Name,
+		UID:        owner.UID,
+	}
+}
@@ -0,0 +1,216 @@
+package fakespire
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	entryv1 "github.com/spiffe/spire-api-sdk/proto/spire/api/server/entry/v1"
+	"github.com/spiffe/spire-api-sdk/proto/spire/api/types"
+	"github.com/spiffe/spire/proto/spire/common"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Entry/v1 API methods which errors can be injected into. Errors fail the whole batch.
+const (
+	MethodBatchCreateEntry = "BatchCreateEntry"
+	MethodBatchUpdateEntry = "BatchUpdateEntry"
+	MethodBatchDeleteEntry = "BatchDeleteEntry"
+	MethodGetEntry         = "GetEntry"
+	MethodListEntries      = "ListEntries"
+)
+
+// entryV1Server serves the entry/v1 API from the same entries as the registration API
+type entryV1Server struct {
+	entryv1.UnimplementedEntryServer
+
+	server *Server
+}
+
+func (e *entryV1Server) BatchCreateEntry(ctx context.Context, req *entryv1.BatchCreateEntryRequest) (*entryv1.BatchCreateEntryResponse, error) {
+	s := e.server
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.begin(MethodBatchCreateEntry, req); err != nil {
+		return nil, err
+	}
+
+	resp := &entryv1.BatchCreateEntryResponse{}
+	for _, v1Entry := range req.GetEntries() {
+		entry := entryFromV1(v1Entry)
+		result := &entryv1.BatchCreateEntryResponse_Result{}
+		switch existing := s.duplicateOf(entry, ""); {
+		case len(entry.GetSpiffeId()) == 0 || len(entry.GetParentId()) == 0 || len(entry.GetSelectors()) == 0:
+			result.Status = v1Status(codes.InvalidArgument, "entry must have a spiffe ID, parent ID and selectors")
+		case existing != nil:
+			// Like the real server, the existing entry is returned alongside AlreadyExists
+			result.Status = v1Status(codes.AlreadyExists, "similar entry already exists")
+			result.Entry = entryToV1(existing)
+		default:
+			entry.EntryId = ""
+			result.Status = v1Status(codes.OK, "")
+			result.Entry = entryToV1(s.entries[s.store(entry)])
+		}
+		resp.Results = append(resp.Results, result)
+	}
+	return resp, nil
+}
+
+func (e *entryV1Server) BatchUpdateEntry(ctx context.Context, req *entryv1.BatchUpdateEntryRequest) (*entryv1.BatchUpdateEntryResponse, error) {
+	s := e.server
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.begin(MethodBatchUpdateEntry, req); err != nil {
+		return nil, err
+	}
+
+	resp := &entryv1.BatchUpdateEntryResponse{}
+	for _, v1Entry := range req.GetEntries() {
+		entry := entryFromV1(v1Entry)
+		result := &entryv1.BatchUpdateEntryResponse_Result{}
+		if _, ok := s.entries[entry.GetEntryId()]; !ok {
+			result.Status = v1Status(codes.NotFound, "entry not found")
+		} else if s.duplicateOf(entry, entry.GetEntryId()) != nil {
+			result.Status = v1Status(codes.AlreadyExists, "similar entry already exists")
+		} else {
+			s.entries[entry.GetEntryId()] = clone(entry)
+			result.Status = v1Status(codes.OK, "")
+			result.Entry = entryToV1(entry)
+		}
+		resp.Results = append(resp.Results, result)
+	}
+	return resp, nil
+}
+
+// BatchDeleteEntry always returns NotFound for missing entries, which the entry/v1 API does unlike the
+// registration API.
+func (e *entryV1Server) BatchDeleteEntry(ctx context.Context, req *entryv1.BatchDeleteEntryRequest) (*entryv1.BatchDeleteEntryResponse, error) {
+	s := e.server
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.begin(MethodBatchDeleteEntry, req); err != nil {
+		return nil, err
+	}
+
+	resp := &entryv1.BatchDeleteEntryResponse{}
+	for _, id := range req.GetIds() {
+		result := &entryv1.BatchDeleteEntryResponse_Result{Id: id, Status: v1Status(codes.OK, "")}
+		if _, ok := s.entries[id]; !ok {
+			result.Status = v1Status(codes.NotFound, "entry not found")
+		}
+		delete(s.entries, id)
+		resp.Results = append(resp.Results, result)
+	}
+	return resp, nil
+}
+
+func (e *entryV1Server) GetEntry(ctx context.Context, req *entryv1.GetEntryRequest) (*types.Entry, error) {
+	s := e.server
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.begin(MethodGetEntry, req); err != nil {
+		return nil, err
+	}
+	entry, ok := s.entries[req.GetId()]
+	if !ok {
+		return nil, status.Error(codes.NotFound, "entry not found")
+	}
+	return entryToV1(entry), nil
+}
+
+// ListEntries only supports filtering by parent ID. Page tokens are offsets into the entries ordered by ID.
+func (e *entryV1Server) ListEntries(ctx context.Context, req *entryv1.ListEntriesRequest) (*entryv1.ListEntriesResponse, error) {
+	s := e.server
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.begin(MethodListEntries, req); err != nil {
+		return nil, err
+	}
+
+	parentId := req.GetFilter().GetByParentId()
+	entries := s.filter(func(entry *common.RegistrationEntry) bool {
+		return parentId == nil || entry.GetParentId() == spiffeIdFromV1(parentId)
+	})
+
+	start := 0
+	if len(req.GetPageToken()) > 0 {
+		var err error
+		if start, err = strconv.Atoi(req.GetPageToken()); err != nil || start < 0 || start > len(entries) {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid page token %q", req.GetPageToken())
+		}
+	}
+	end := len(entries)
+	if size := int(req.GetPageSize()); size > 0 && start+size < end {
+		end = start + size
+	}
+
+	resp := &entryv1.ListEntriesResponse{}
+	for _, entry := range entries[start:end] {
+		resp.Entries = append(resp.Entries, entryToV1(entry))
+	}
+	if end < len(entries) {
+		resp.NextPageToken = strconv.Itoa(end)
+	}
+	return resp, nil
+}
+
+func v1Status(code codes.Code, message string) *types.Status {
+	return &types.Status{Code: int32(code), Message: message}
+}
+
+// entryToV1 and entryFromV1 convert between the stored entries and the entry/v1 representation independently of
+// spiremgr's own conversion, so that tests against the fake catch mistakes in either.
+func entryToV1(in *common.RegistrationEntry) *types.Entry {
+	out := &types.Entry{
+		Id:         in.GetEntryId(),
+		SpiffeId:   spiffeIdToV1(in.GetSpiffeId()),
+		ParentId:   spiffeIdToV1(in.GetParentId()),
+		Ttl:        in.GetTtl(),
+		Admin:      in.GetAdmin(),
+		Downstream: in.GetDownstream(),
+		DnsNames:   in.GetDnsNames(),
+	}
+	for _, sel := range in.GetSelectors() {
+		out.Selectors = append(out.Selectors, &types.Selector{Type: sel.GetType(), Value: sel.GetValue()})
+	}
+	for _, trustDomain := range in.GetFederatesWith() {
+		out.FederatesWith = append(out.FederatesWith, strings.TrimPrefix(trustDomain, "spiffe://"))
+	}
+	return out
+}
+
+func entryFromV1(in *types.Entry) *common.RegistrationEntry {
+	out := &common.RegistrationEntry{
+		EntryId:    in.GetId(),
+		SpiffeId:   spiffeIdFromV1(in.GetSpiffeId()),
+		ParentId:   spiffeIdFromV1(in.GetParentId()),
+		Ttl:        in.GetTtl(),
+		Admin:      in.GetAdmin(),
+		Downstream: in.GetDownstream(),
+		DnsNames:   in.GetDnsNames(),
+	}
+	for _, sel := range in.GetSelectors() {
+		out.Selectors = append(out.Selectors, &common.Selector{Type: sel.GetType(), Value: sel.GetValue()})
+	}
+	for _, trustDomain := range in.GetFederatesWith() {
+		out.FederatesWith = append(out.FederatesWith, "spiffe://"+trustDomain)
+	}
+	return out
+}
+
+func spiffeIdToV1(id string) *types.SPIFFEID {
+	trustDomain := strings.TrimPrefix(id, "spiffe://")
+	path := ""
+	if i := strings.Index(trustDomain, "/"); i >= 0 {
+		trustDomain, path = trustDomain[:i], trustDomain[i:]
+	}
+	return &types.SPIFFEID{TrustDomain: trustDomain, Path: path}
+}
+
+func spiffeIdFromV1(id *types.SPIFFEID) string {
+	if id == nil || len(id.GetTrustDomain()) == 0 {
+		return ""
+	}
+	return "spiffe://" + id.GetTrustDomain() + id.GetPath()
+}
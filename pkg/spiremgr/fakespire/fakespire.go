@@ -0,0 +1,294 @@
+// Package fakespire provides an in-memory spire server implementing the registration and entry/v1 APIs, for
+// exercising the operator without a real spire deployment.
+package fakespire
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	entryv1 "github.com/spiffe/spire-api-sdk/proto/spire/api/server/entry/v1"
+	"github.com/spiffe/spire/proto/spire/api/registration"
+	"github.com/spiffe/spire/proto/spire/common"
+	"github.com/transferwise/spire-k8s-operator/pkg/spiremgr"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// Registration API methods which errors can be injected into
+const (
+	MethodCreateEntry    = "CreateEntry"
+	MethodDeleteEntry    = "DeleteEntry"
+	MethodFetchEntry     = "FetchEntry"
+	MethodUpdateEntry    = "UpdateEntry"
+	MethodListByParentID = "ListByParentID"
+)
+
+const bufSize = 1024 * 1024
+
+// ErrorHook is called before every request is handled. Returning an error fails the request with it.
+type ErrorHook func(method string, req interface{}) error
+
+// Server is an in-memory spire server. Only the entry methods used by the operator are implemented, and any other
+// method returns Unimplemented.
+type Server struct {
+	unimplementedRegistrationServer
+
+	// StrictDelete makes deleting a missing entry return NotFound. By default an Internal error is returned,
+	// as the real spire server does.
+	StrictDelete bool
+
+	mu       sync.Mutex
+	entries  map[string]*common.RegistrationEntry
+	nextId   int
+	failures map[string][]error
+	hook     ErrorHook
+	calls    map[string]int
+
+	listener   *bufconn.Listener
+	grpcServer *grpc.Server
+}
+
+// blank assignment to verify that Server implements registration.RegistrationServer
+var _ registration.RegistrationServer = &Server{}
+
+// New creates an empty server. It isn't listening until Start is called.
+func New() *Server {
+	return &Server{
+		entries:  map[string]*common.RegistrationEntry{},
+		failures: map[string][]error{},
+		calls:    map[string]int{},
+	}
+}
+
+// Start serves the registration and entry/v1 APIs on an in-process listener and returns a connection to it. The
+// server stops when Stop is called.
+func (s *Server) Start() (*grpc.ClientConn, error) {
+	s.listener = bufconn.Listen(bufSize)
+	s.grpcServer = grpc.NewServer()
+	registration.RegisterRegistrationServer(s.grpcServer, s)
+	entryv1.RegisterEntryServer(s.grpcServer, &entryV1Server{server: s})
+	go func() {
+		_ = s.grpcServer.Serve(s.listener)
+	}()
+
+	return grpc.DialContext(context.Background(), "bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return s.listener.Dial()
+		}),
+		grpc.WithInsecure(),
+	)
+}
+
+// Stop stops serving, closing all connections.
+func (s *Server) Stop() {
+	if s.grpcServer != nil {
+		s.grpcServer.Stop()
+	}
+}
+
+// FailNext makes the next calls to method fail with the given errors, one error per call.
+func (s *Server) FailNext(method string, errs ...error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[method] = append(s.failures[method], errs...)
+}
+
+// SetErrorHook sets a hook which is called before every request, replacing any existing hook.
+func (s *Server) SetErrorHook(hook ErrorHook) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hook = hook
+}
+
+// Calls returns how many times method has been called, including calls which failed.
+func (s *Server) Calls(method string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[method]
+}
+
+// AddEntry stores an entry directly, bypassing error injection and duplicate checks, and returns its ID.
+func (s *Server) AddEntry(entry *common.RegistrationEntry) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.store(entry)
+}
+
+// RemoveEntry deletes an entry directly, as if it had been removed out-of-band.
+func (s *Server) RemoveEntry(entryId string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, entryId)
+}
+
+// Entries returns copies of all the stored entries, ordered by entry ID.
+func (s *Server) Entries() []*common.RegistrationEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.filter(func(*common.RegistrationEntry) bool { return true })
+}
+
+// Entry returns a copy of the entry with the given ID, or nil if there isn't one.
+func (s *Server) Entry(entryId string) *common.RegistrationEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[entryId]
+	if !ok {
+		return nil
+	}
+	return clone(entry)
+}
+
+func (s *Server) CreateEntry(ctx context.Context, req *common.RegistrationEntry) (*registration.RegistrationEntryID, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.begin(MethodCreateEntry, req); err != nil {
+		return nil, err
+	}
+	if len(req.GetSpiffeId()) == 0 || len(req.GetParentId()) == 0 || len(req.GetSelectors()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "entry must have a spiffe ID, parent ID and selectors")
+	}
+	if existing := s.duplicateOf(req, ""); existing != nil {
+		return nil, status.Error(codes.AlreadyExists, "entry already exists")
+	}
+	return &registration.RegistrationEntryID{Id: s.store(req)}, nil
+}
+
+func (s *Server) DeleteEntry(ctx context.Context, req *registration.RegistrationEntryID) (*common.RegistrationEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.begin(MethodDeleteEntry, req); err != nil {
+		return nil, err
+	}
+	entry, ok := s.entries[req.GetId()]
+	if !ok {
+		if s.StrictDelete {
+			return nil, status.Errorf(codes.NotFound, "no such registration entry %q", req.GetId())
+		}
+		return nil, status.Errorf(codes.Internal, "failed to delete registration entry %q", req.GetId())
+	}
+	delete(s.entries, req.GetId())
+	return clone(entry), nil
+}
+
+func (s *Server) FetchEntry(ctx context.Context, req *registration.RegistrationEntryID) (*common.RegistrationEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.begin(MethodFetchEntry, req); err != nil {
+		return nil, err
+	}
+	entry, ok := s.entries[req.GetId()]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "no such registration entry %q", req.GetId())
+	}
+	return clone(entry), nil
+}
+
+func (s *Server) UpdateEntry(ctx context.Context, req *registration.UpdateEntryRequest) (*common.RegistrationEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.begin(MethodUpdateEntry, req); err != nil {
+		return nil, err
+	}
+	entryId := req.GetEntry().GetEntryId()
+	if _, ok := s.entries[entryId]; !ok {
+		return nil, status.Errorf(codes.NotFound, "no such registration entry %q", entryId)
+	}
+	if existing := s.duplicateOf(req.GetEntry(), entryId); existing != nil {
+		return nil, status.Error(codes.AlreadyExists, "entry already exists")
+	}
+	s.entries[entryId] = clone(req.GetEntry())
+	return clone(req.GetEntry()), nil
+}
+
+func (s *Server) ListByParentID(ctx context.Context, req *registration.ParentID) (*common.RegistrationEntries, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.begin(MethodListByParentID, req); err != nil {
+		return nil, err
+	}
+	return &common.RegistrationEntries{
+		Entries: s.filter(func(entry *common.RegistrationEntry) bool {
+			return entry.GetParentId() == req.GetId()
+		}),
+	}, nil
+}
+
+// begin records a call and returns the error injected for it, if any. s.mu must be held.
+func (s *Server) begin(method string, req interface{}) error {
+	s.calls[method]++
+	if failures := s.failures[method]; len(failures) > 0 {
+		s.failures[method] = failures[1:]
+		return failures[0]
+	}
+	if s.hook != nil {
+		return s.hook(method, req)
+	}
+	return nil
+}
+
+// store saves a copy of the entry, assigning it an ID if it doesn't have one. s.mu must be held.
+func (s *Server) store(entry *common.RegistrationEntry) string {
+	stored := clone(entry)
+	if len(stored.EntryId) == 0 {
+		s.nextId++
+		stored.EntryId = fmt.Sprintf("entry-%d", s.nextId)
+	}
+	s.entries[stored.EntryId] = stored
+	return stored.EntryId
+}
+
+// duplicateOf returns the entry, other than the one being updated, with the same spiffe ID, parent ID and
+// selectors. s.mu must be held.
+func (s *Server) duplicateOf(entry *common.RegistrationEntry, ignoreId string) *common.RegistrationEntry {
+	for id, existing := range s.entries {
+		if id == ignoreId {
+			continue
+		}
+		if spiremgr.EntryIsDuplicate(existing, entry) {
+			return existing
+		}
+	}
+	return nil
+}
+
+// filter returns copies of the entries matching the predicate, ordered by entry ID. s.mu must be held.
+func (s *Server) filter(predicate func(*common.RegistrationEntry) bool) []*common.RegistrationEntry {
+	var entries []*common.RegistrationEntry
+	for _, entry := range s.entries {
+		if predicate(entry) {
+			entries = append(entries, clone(entry))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].GetEntryId() < entries[j].GetEntryId()
+	})
+	return entries
+}
+
+func clone(entry *common.RegistrationEntry) *common.RegistrationEntry {
+	return proto.Clone(entry).(*common.RegistrationEntry)
+}
+
+// Backend connects one of the operator's spire backends to the server, so tests can run against each of them.
+type Backend struct {
+	Name    string
+	Connect func(conn *grpc.ClientConn) spiremgr.Backend
+}
+
+// Backends are the operator's spire backends. The entry/v1 backend batches with a short window to keep tests fast.
+var Backends = []Backend{
+	{Name: "registration", Connect: func(conn *grpc.ClientConn) spiremgr.Backend {
+		return &spiremgr.RegistrationBackend{Client: registration.NewRegistrationClient(conn)}
+	}},
+	{Name: "entry-v1", Connect: func(conn *grpc.ClientConn) spiremgr.Backend {
+		return spiremgr.NewEntryV1Client(conn, time.Millisecond, 10)
+	}},
+}
@@ -0,0 +1,105 @@
+package fakespire
+
+import (
+	"context"
+
+	"github.com/spiffe/spire/proto/spire/api/registration"
+	"github.com/spiffe/spire/proto/spire/common"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// unimplementedRegistrationServer returns Unimplemented for the registration methods the operator doesn't use. This
+// version of the registration API doesn't generate one.
+type unimplementedRegistrationServer struct{}
+
+func unimplemented(method string) error {
+	return status.Errorf(codes.Unimplemented, "method %s not implemented", method)
+}
+
+func (unimplementedRegistrationServer) CreateEntry(context.Context, *common.RegistrationEntry) (*registration.RegistrationEntryID, error) {
+	return nil, unimplemented("CreateEntry")
+}
+
+func (unimplementedRegistrationServer) DeleteEntry(context.Context, *registration.RegistrationEntryID) (*common.RegistrationEntry, error) {
+	return nil, unimplemented("DeleteEntry")
+}
+
+func (unimplementedRegistrationServer) FetchEntry(context.Context, *registration.RegistrationEntryID) (*common.RegistrationEntry, error) {
+	return nil, unimplemented("FetchEntry")
+}
+
+func (unimplementedRegistrationServer) FetchEntries(context.Context, *common.Empty) (*common.RegistrationEntries, error) {
+	return nil, unimplemented("FetchEntries")
+}
+
+func (unimplementedRegistrationServer) UpdateEntry(context.Context, *registration.UpdateEntryRequest) (*common.RegistrationEntry, error) {
+	return nil, unimplemented("UpdateEntry")
+}
+
+func (unimplementedRegistrationServer) ListByParentID(context.Context, *registration.ParentID) (*common.RegistrationEntries, error) {
+	return nil, unimplemented("ListByParentID")
+}
+
+func (unimplementedRegistrationServer) ListBySelector(context.Context, *common.Selector) (*common.RegistrationEntries, error) {
+	return nil, unimplemented("ListBySelector")
+}
+
+func (unimplementedRegistrationServer) ListBySelectors(context.Context, *common.Selectors) (*common.RegistrationEntries, error) {
+	return nil, unimplemented("ListBySelectors")
+}
+
+func (unimplementedRegistrationServer) ListBySpiffeID(context.Context, *registration.SpiffeID) (*common.RegistrationEntries, error) {
+	return nil, unimplemented("ListBySpiffeID")
+}
+
+func (unimplementedRegistrationServer) CreateFederatedBundle(context.Context, *registration.FederatedBundle) (*common.Empty, error) {
+	return nil, unimplemented("CreateFederatedBundle")
+}
+
+func (unimplementedRegistrationServer) FetchFederatedBundle(context.Context, *registration.FederatedBundleID) (*registration.FederatedBundle, error) {
+	return nil, unimplemented("FetchFederatedBundle")
+}
+
+func (unimplementedRegistrationServer) ListFederatedBundles(*common.Empty, registration.Registration_ListFederatedBundlesServer) error {
+	return unimplemented("ListFederatedBundles")
+}
+
+func (unimplementedRegistrationServer) UpdateFederatedBundle(context.Context, *registration.FederatedBundle) (*common.Empty, error) {
+	return nil, unimplemented("UpdateFederatedBundle")
+}
+
+func (unimplementedRegistrationServer) DeleteFederatedBundle(context.Context, *registration.DeleteFederatedBundleRequest) (*common.Empty, error) {
+	return nil, unimplemented("DeleteFederatedBundle")
+}
+
+func (unimplementedRegistrationServer) CreateJoinToken(context.Context, *registration.JoinToken) (*registration.JoinToken, error) {
+	return nil, unimplemented("CreateJoinToken")
+}
+
+func (unimplementedRegistrationServer) FetchBundle(context.Context, *common.Empty) (*registration.Bundle, error) {
+	return nil, unimplemented("FetchBundle")
+}
+
+func (unimplementedRegistrationServer) EvictAgent(context.Context, *registration.EvictAgentRequest) (*registration.EvictAgentResponse, error) {
+	return nil, unimplemented("EvictAgent")
+}
+
+func (unimplementedRegistrationServer) ListAgents(context.Context, *registration.ListAgentsRequest) (*registration.ListAgentsResponse, error) {
+	return nil, unimplemented("ListAgents")
+}
+
+func (unimplementedRegistrationServer) MintX509SVID(context.Context, *registration.MintX509SVIDRequest) (*registration.MintX509SVIDResponse, error) {
+	return nil, unimplemented("MintX509SVID")
+}
+
+func (unimplementedRegistrationServer) MintJWTSVID(context.Context, *registration.MintJWTSVIDRequest) (*registration.MintJWTSVIDResponse, error) {
+	return nil, unimplemented("MintJWTSVID")
+}
+
+func (unimplementedRegistrationServer) GetNodeSelectors(context.Context, *registration.GetNodeSelectorsRequest) (*registration.GetNodeSelectorsResponse, error) {
+	return nil, unimplemented("GetNodeSelectors")
+}
+
+// blank assignment to verify that unimplementedRegistrationServer implements registration.RegistrationServer
+var _ registration.RegistrationServer = unimplementedRegistrationServer{}
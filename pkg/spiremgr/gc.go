@@ -0,0 +1,133 @@
+package spiremgr
+
+import (
+	"context"
+	"github.com/go-logr/logr"
+	"github.com/spiffe/spire/proto/spire/common"
+	spiffeidv1alpha1 "github.com/transferwise/spire-k8s-operator/pkg/apis/spiffeid/v1alpha1"
+	"github.com/transferwise/spire-k8s-operator/pkg/metrics"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"time"
+)
+
+// GarbageCollectorName labels the garbage collector's metrics
+const GarbageCollectorName = "garbage-collector"
+
+// GarbageCollector periodically removes spire entries parented to the operator which aren't referenced by any
+// SpiffeId or ClusterSpiffeId, such as entries leaked by failed finalizers or swallowed delete errors.
+type GarbageCollector struct {
+	// Reader used to list SpiffeIds. This should read from the API server rather than the cache, so that a
+	// stale cache never causes live entries to be deleted.
+	Reader   client.Reader
+	Utils    SpireUtils
+	Log      logr.Logger
+	Interval time.Duration
+	// Only report what would be deleted, without deleting anything.
+	DryRun bool
+
+	// Entries found orphaned on the previous pass. Entries are only deleted once they've been orphaned on two
+	// consecutive passes, so entries created moments before their SpiffeId status was written are left alone.
+	candidates map[string]bool
+}
+
+// GCReport describes the outcome of a single garbage collection pass
+type GCReport struct {
+	// Number of entries parented to the operator
+	Scanned int
+	// Entries not referenced by any SpiffeId
+	Orphaned []*common.RegistrationEntry
+	// IDs of orphaned entries which were deleted (or would have been, in dry-run mode)
+	Deleted []string
+	DryRun  bool
+}
+
+// Start runs the garbage collector until stop is closed. It implements manager.Runnable.
+func (r *GarbageCollector) Start(stop <-chan struct{}) error {
+	r.Log.Info("Starting spire entry garbage collector", "interval", r.Interval, "dryRun", r.DryRun)
+	wait.Until(func() {
+		if _, err := r.Collect(); err != nil {
+			r.Log.Error(err, "Spire entry garbage collection failed")
+		}
+	}, r.Interval, stop)
+	return nil
+}
+
+// Collect runs a single garbage collection pass.
+func (r *GarbageCollector) Collect() (*GCReport, error) {
+	referenced, err := r.referencedEntries()
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := r.Utils.ListEntries(r.Log)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &GCReport{Scanned: len(entries), DryRun: r.DryRun}
+	candidates := map[string]bool{}
+	var toDelete []string
+	for _, entry := range entries {
+		if referenced[entry.GetEntryId()] {
+			continue
+		}
+		report.Orphaned = append(report.Orphaned, entry)
+		candidates[entry.GetEntryId()] = true
+		if !r.candidates[entry.GetEntryId()] {
+			r.Log.Info("Found orphaned spire entry, will delete on next pass if still orphaned", "entryID", entry.GetEntryId(), "spiffeID", entry.GetSpiffeId())
+			continue
+		}
+		if r.DryRun {
+			r.Log.Info("Would delete orphaned spire entry", "entryID", entry.GetEntryId(), "spiffeID", entry.GetSpiffeId())
+			report.Deleted = append(report.Deleted, entry.GetEntryId())
+			continue
+		}
+		r.Log.Info("Deleting orphaned spire entry", "entryID", entry.GetEntryId(), "spiffeID", entry.GetSpiffeId())
+		toDelete = append(toDelete, entry.GetEntryId())
+	}
+	r.candidates = candidates
+
+	// Deletes are sent together so the entry/v1 API can remove them in a single batch
+	failed, err := r.Utils.DeleteEntries(r.Log, toDelete)
+	if err != nil {
+		return nil, err
+	}
+	for _, entryId := range toDelete {
+		if err, ok := failed[entryId]; ok {
+			r.Log.Error(err, "Failed to delete orphaned spire entry", "entryID", entryId)
+			continue
+		}
+		report.Deleted = append(report.Deleted, entryId)
+		metrics.EntryOperations.WithLabelValues(GarbageCollectorName, "deleted").Inc()
+	}
+
+	r.Log.Info("Spire entry garbage collection finished", "scanned", report.Scanned, "orphaned", len(report.Orphaned), "deleted", len(report.Deleted), "dryRun", report.DryRun)
+	return report, nil
+}
+
+func (r *GarbageCollector) referencedEntries() (map[string]bool, error) {
+	referenced := map[string]bool{}
+
+	spiffeIds := &spiffeidv1alpha1.SpiffeIdList{}
+	if err := r.Reader.List(context.TODO(), spiffeIds); err != nil {
+		return nil, err
+	}
+	for _, spiffeId := range spiffeIds.Items {
+		if len(spiffeId.Status.EntryId) > 0 {
+			referenced[spiffeId.Status.EntryId] = true
+		}
+	}
+
+	clusterSpiffeIds := &spiffeidv1alpha1.ClusterSpiffeIdList{}
+	if err := r.Reader.List(context.TODO(), clusterSpiffeIds); err != nil {
+		return nil, err
+	}
+	for _, clusterSpiffeId := range clusterSpiffeIds.Items {
+		if len(clusterSpiffeId.Status.EntryId) > 0 {
+			referenced[clusterSpiffeId.Status.EntryId] = true
+		}
+	}
+
+	return referenced, nil
+}
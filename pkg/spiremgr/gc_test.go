@@ -0,0 +1,192 @@
+package spiremgr_test
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/spiffe/spire/proto/spire/api/registration"
+	"github.com/spiffe/spire/proto/spire/common"
+	"github.com/transferwise/spire-k8s-operator/pkg/apis"
+	spiffeidv1alpha1 "github.com/transferwise/spire-k8s-operator/pkg/apis/spiffeid/v1alpha1"
+	"github.com/transferwise/spire-k8s-operator/pkg/spiremgr"
+	"github.com/transferwise/spire-k8s-operator/pkg/spiremgr/fakespire"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+func TestGarbageCollector(t *testing.T) {
+	tests := []struct {
+		name string
+		// entries in spire before the first pass
+		entries []string
+		// entries referenced by a SpiffeId or ClusterSpiffeId
+		spiffeIdRefs        []string
+		clusterSpiffeIdRefs []string
+		dryRun              bool
+		// changes made between the two passes
+		between func(t *testing.T, server *fakespire.Server, c client.Client)
+		// entries whose deletes fail
+		failDeletes []string
+		// entries reported deleted by each pass
+		wantFirst  []string
+		wantSecond []string
+		// entries left in spire after the second pass
+		wantKept []string
+	}{
+		{
+			name:                "orphan deleted on the second pass",
+			entries:             []string{"referenced", "cluster-referenced", "orphan"},
+			spiffeIdRefs:        []string{"referenced"},
+			clusterSpiffeIdRefs: []string{"cluster-referenced"},
+			wantSecond:          []string{"orphan"},
+			wantKept:            []string{"cluster-referenced", "referenced"},
+		},
+		{
+			name:         "dry run deletes nothing",
+			entries:      []string{"referenced", "orphan"},
+			spiffeIdRefs: []string{"referenced"},
+			dryRun:       true,
+			wantSecond:   []string{"orphan"},
+			wantKept:     []string{"orphan", "referenced"},
+		},
+		{
+			name:    "referenced between passes",
+			entries: []string{"orphan", "adopted"},
+			between: func(t *testing.T, server *fakespire.Server, c client.Client) {
+				createSpiffeId(t, c, "adopted")
+			},
+			wantSecond: []string{"orphan"},
+			wantKept:   []string{"adopted"},
+		},
+		{
+			name:    "orphaned since the first pass only",
+			entries: []string{"orphan"},
+			between: func(t *testing.T, server *fakespire.Server, c client.Client) {
+				addEntry(server, "new")
+			},
+			wantSecond: []string{"orphan"},
+			wantKept:   []string{"new"},
+		},
+		{
+			name:        "failed deletes not reported",
+			entries:     []string{"orphan", "undeletable"},
+			failDeletes: []string{"undeletable"},
+			wantSecond:  []string{"orphan"},
+			wantKept:    []string{"undeletable"},
+		},
+	}
+
+	// The registration backend deletes entries one at a time, so single deletes can be failed
+	backend := fakespire.Backends[0]
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, utils, stop := startSpire(t, backend.Connect)
+			defer stop()
+			for _, entryId := range tt.entries {
+				addEntry(server, entryId)
+			}
+			failDeletes := map[string]bool{}
+			for _, entryId := range tt.failDeletes {
+				failDeletes[entryId] = true
+			}
+			server.SetErrorHook(func(method string, req interface{}) error {
+				if method == fakespire.MethodDeleteEntry && failDeletes[req.(*registration.RegistrationEntryID).GetId()] {
+					return status.Error(codes.Internal, "failed to delete entry")
+				}
+				return nil
+			})
+
+			scheme := runtime.NewScheme()
+			if err := apis.AddToScheme(scheme); err != nil {
+				t.Fatal(err)
+			}
+			c := fake.NewFakeClientWithScheme(scheme)
+			for _, entryId := range tt.spiffeIdRefs {
+				createSpiffeId(t, c, entryId)
+			}
+			for _, entryId := range tt.clusterSpiffeIdRefs {
+				clusterSpiffeId := &spiffeidv1alpha1.ClusterSpiffeId{ObjectMeta: metav1.ObjectMeta{Name: entryId}}
+				clusterSpiffeId.Status.EntryId = entryId
+				if err := c.Create(context.TODO(), clusterSpiffeId); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			gc := &spiremgr.GarbageCollector{
+				Reader: c,
+				Utils:  spiremgr.SpireUtils{Backend: utils.Backend, TrustDomain: utils.TrustDomain, Cluster: utils.Cluster},
+				Log:    logf.Log,
+				DryRun: tt.dryRun,
+			}
+			report, err := gc.Collect()
+			if err != nil {
+				t.Fatalf("first Collect() error = %v", err)
+			}
+			if !sameIds(report.Deleted, tt.wantFirst) {
+				t.Errorf("first Collect() deleted %v, want %v", report.Deleted, tt.wantFirst)
+			}
+			if report.DryRun != tt.dryRun {
+				t.Errorf("first Collect() dry run = %v, want %v", report.DryRun, tt.dryRun)
+			}
+			if tt.between != nil {
+				tt.between(t, server, c)
+			}
+
+			report, err = gc.Collect()
+			if err != nil {
+				t.Fatalf("second Collect() error = %v", err)
+			}
+			if !sameIds(report.Deleted, tt.wantSecond) {
+				t.Errorf("second Collect() deleted %v, want %v", report.Deleted, tt.wantSecond)
+			}
+			if tt.dryRun && server.Calls(fakespire.MethodDeleteEntry) > 0 {
+				t.Errorf("%d deletes in dry-run mode, want none", server.Calls(fakespire.MethodDeleteEntry))
+			}
+
+			var kept []string
+			for _, entry := range server.Entries() {
+				if entry.ParentId == nodeId {
+					kept = append(kept, entry.EntryId)
+				}
+			}
+			if !sameIds(kept, tt.wantKept) {
+				t.Errorf("spire has entries %v, want %v", kept, tt.wantKept)
+			}
+		})
+	}
+}
+
+// addEntry adds an entry parented to the operator with the given ID
+func addEntry(server *fakespire.Server, entryId string) {
+	server.AddEntry(&common.RegistrationEntry{
+		EntryId:   entryId,
+		ParentId:  nodeId,
+		SpiffeId:  "spiffe://example.org/" + entryId,
+		Selectors: []*common.Selector{{Type: "k8s", Value: "ns:default"}},
+	})
+}
+
+// createSpiffeId creates a SpiffeId referencing the entry
+func createSpiffeId(t *testing.T, c client.Client, entryId string) {
+	spiffeId := &spiffeidv1alpha1.SpiffeId{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: entryId}}
+	spiffeId.Status.EntryId = entryId
+	if err := c.Create(context.TODO(), spiffeId); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// sameIds compares lists of entry IDs, ignoring ordering
+func sameIds(a []string, b []string) bool {
+	a = append([]string{}, a...)
+	b = append([]string{}, b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	return len(a) == len(b) && (len(a) == 0 || reflect.DeepEqual(a, b))
+}
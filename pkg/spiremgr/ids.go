@@ -0,0 +1,54 @@
+package spiremgr
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// GeneratedPrefix starts the names of the SpiffeIds and ClusterSpiffeIds the operator generates
+const GeneratedPrefix = "spire-operator-"
+
+func (r *SpireUtils) makeID(pathFmt string, pathArgs ...interface{}) string {
+	id := url.URL{
+		Scheme: "spiffe",
+		Host:   r.TrustDomain,
+		Path:   path.Clean(fmt.Sprintf(pathFmt, pathArgs...)),
+	}
+	return id.String()
+}
+
+// ServerID creates a server SPIFFE ID string given a trustDomain.
+func ServerID(trustDomain string) string {
+	return ServerURI(trustDomain).String()
+}
+
+// ServerURI creates a server SPIFFE URI given a trustDomain.
+func ServerURI(trustDomain string) *url.URL {
+	return &url.URL{
+		Scheme: "spiffe",
+		Host:   trustDomain,
+		Path:   path.Join("spire", "server"),
+	}
+}
+
+func (r *SpireUtils) nodeID() string {
+	return r.makeID("spire-k8s-operator/%s/node", r.Cluster)
+}
+
+// GeneratedName returns the name of a SpiffeId or ClusterSpiffeId generated for the named object. Names which would
+// be too long are truncated and made unique again with a hash of the object name.
+func GeneratedName(name string) string {
+	generated := GeneratedPrefix + name
+	if len(generated) <= validation.DNS1123SubdomainMaxLength {
+		return generated
+	}
+	sum := sha256.Sum256([]byte(name))
+	suffix := "-" + hex.EncodeToString(sum[:])[:10]
+	return strings.TrimRight(generated[:validation.DNS1123SubdomainMaxLength-len(suffix)], "-.") + suffix
+}
@@ -0,0 +1,192 @@
+package spiremgr
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// PodTemplateData is the pod metadata spiffe ID templates are executed against, e.g.
+// ns/{{.Namespace}}/{{.OwnerKind | lower}}/{{.OwnerName}}
+type PodTemplateData struct {
+	TrustDomain    string
+	Namespace      string
+	Name           string
+	ServiceAccount string
+	NodeName       string
+	Labels         map[string]string
+	Annotations    map[string]string
+	// Kind and name of the pod's controller. Pods of a Deployment report the Deployment rather than its ReplicaSet.
+	OwnerKind string
+	OwnerName string
+}
+
+// NewPodTemplateData collects the template data for a pod
+func NewPodTemplateData(pod *corev1.Pod, trustDomain string) *PodTemplateData {
+	data := &PodTemplateData{
+		TrustDomain:    trustDomain,
+		Namespace:      pod.Namespace,
+		Name:           pod.Name,
+		ServiceAccount: pod.Spec.ServiceAccountName,
+		NodeName:       pod.Spec.NodeName,
+		Labels:         pod.Labels,
+		Annotations:    pod.Annotations,
+	}
+	if owner := metav1.GetControllerOf(pod); owner != nil {
+		data.OwnerKind = owner.Kind
+		data.OwnerName = owner.Name
+		// ReplicaSets created by a Deployment are named after it, followed by the pod template hash
+		if hash, ok := pod.Labels["pod-template-hash"]; ok && owner.Kind == "ReplicaSet" && strings.HasSuffix(owner.Name, "-"+hash) {
+			data.OwnerKind = "Deployment"
+			data.OwnerName = strings.TrimSuffix(owner.Name, "-"+hash)
+		}
+	}
+	return data
+}
+
+var sampleController = true
+
+// SamplePod is used to check templates execute when they're loaded and to preview the IDs they generate. It has few
+// labels and annotations, so the IDs generated for it aren't validated.
+var SamplePod = &corev1.Pod{
+	ObjectMeta: metav1.ObjectMeta{
+		Namespace: "default",
+		Name:      "example-7d4b9c8f6-x2x4q",
+		Labels: map[string]string{
+			"app":               "example",
+			"pod-template-hash": "7d4b9c8f6",
+		},
+		OwnerReferences: []metav1.OwnerReference{{
+			APIVersion: "apps/v1",
+			Kind:       "ReplicaSet",
+			Name:       "example-7d4b9c8f6",
+			Controller: &sampleController,
+		}},
+	},
+	Spec: corev1.PodSpec{
+		ServiceAccountName: "example",
+		NodeName:           "node-1",
+	},
+}
+
+// Functions available to templates besides the text/template builtins
+var templateFuncs = template.FuncMap{
+	"lower":      strings.ToLower,
+	"upper":      strings.ToUpper,
+	"replace":    func(old, new, s string) string { return strings.Replace(s, old, new, -1) },
+	"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+	"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+	"default": func(def string, s string) string {
+		if len(s) == 0 {
+			return def
+		}
+		return s
+	},
+}
+
+// IdTemplate generates spiffe IDs for pods from a text/template. The template may produce a full spiffe ID in the
+// trust domain or just its path, and producing nothing means the pod shouldn't get an ID.
+type IdTemplate struct {
+	Text        string
+	trustDomain string
+	template    *template.Template
+}
+
+// ParseIdTemplate parses a spiffe ID template and checks it executes against SamplePod. The IDs it generates are
+// validated per pod by Execute.
+func ParseIdTemplate(text string, trustDomain string) (*IdTemplate, error) {
+	tmpl, err := parseTemplate("id", text)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := executeTemplate(tmpl, NewPodTemplateData(SamplePod, trustDomain)); err != nil {
+		return nil, err
+	}
+	return &IdTemplate{Text: text, trustDomain: trustDomain, template: tmpl}, nil
+}
+
+// Execute returns the spiffe ID for the pod, or "" if the template produced nothing for it
+func (t *IdTemplate) Execute(pod *corev1.Pod) (string, error) {
+	out, err := executeTemplate(t.template, NewPodTemplateData(pod, t.trustDomain))
+	if err != nil {
+		return "", err
+	}
+	if len(out) == 0 {
+		return "", nil
+	}
+	// The path is used as produced, so that .. segments from pod metadata are rejected rather than cleaned away
+	if !strings.HasPrefix(out, "spiffe://") {
+		out = fmt.Sprintf("spiffe://%s/%s", t.trustDomain, strings.TrimPrefix(out, "/"))
+	}
+	if err := t.validate(out); err != nil {
+		return "", fmt.Errorf("template produced invalid spiffe ID %q: %v", out, err)
+	}
+	return out, nil
+}
+
+func (t *IdTemplate) validate(id string) error {
+	u, err := ParseSpiffeId(id)
+	if err != nil {
+		return err
+	}
+	if u.Host != t.trustDomain {
+		return fmt.Errorf("must be in trust domain %s", t.trustDomain)
+	}
+	if len(u.Path) <= 1 {
+		return fmt.Errorf("must have a path")
+	}
+	return nil
+}
+
+// DnsNameTemplate generates a DNS name for pods from a text/template. Producing nothing means no DNS name. DNS
+// names aren't tied to the trust domain, so .TrustDomain is empty.
+type DnsNameTemplate struct {
+	Text     string
+	template *template.Template
+}
+
+// ParseDnsNameTemplate parses a DNS name template and checks it executes against SamplePod. The DNS names it
+// generates are validated per pod by Execute.
+func ParseDnsNameTemplate(text string) (*DnsNameTemplate, error) {
+	tmpl, err := parseTemplate("dnsName", text)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := executeTemplate(tmpl, NewPodTemplateData(SamplePod, "")); err != nil {
+		return nil, err
+	}
+	return &DnsNameTemplate{Text: text, template: tmpl}, nil
+}
+
+// Execute returns the DNS name for the pod, or "" if the template produced nothing for it
+func (t *DnsNameTemplate) Execute(pod *corev1.Pod) (string, error) {
+	out, err := executeTemplate(t.template, NewPodTemplateData(pod, ""))
+	if err != nil || len(out) == 0 {
+		return "", err
+	}
+	if errs := validateDnsName(out); len(errs) > 0 {
+		return "", fmt.Errorf("template produced invalid DNS name %q: %s", out, strings.Join(errs, ", "))
+	}
+	return out, nil
+}
+
+// parseTemplate parses a template for pod metadata. Missing labels and annotations produce an empty string.
+func parseTemplate(name string, text string) (*template.Template, error) {
+	tmpl, err := template.New(name).Option("missingkey=zero").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template: %v", err)
+	}
+	return tmpl, nil
+}
+
+func executeTemplate(tmpl *template.Template, data *PodTemplateData) (string, error) {
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, data); err != nil {
+		return "", fmt.Errorf("failed to execute template: %v", err)
+	}
+	return strings.TrimSpace(out.String()), nil
+}
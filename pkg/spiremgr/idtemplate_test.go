@@ -0,0 +1,116 @@
+package spiremgr
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestIdTemplateExecute(t *testing.T) {
+	tests := []struct {
+		name       string
+		template   string
+		annotation string
+		want       string
+		wantErr    bool
+	}{
+		{
+			name:     "path",
+			template: "ns/{{.Namespace}}/sa/{{.ServiceAccount}}",
+			want:     "spiffe://example.org/ns/default/sa/web",
+		},
+		{
+			name:     "leading slash",
+			template: "/ns/{{.Namespace}}",
+			want:     "spiffe://example.org/ns/default",
+		},
+		{
+			name:     "full ID",
+			template: "spiffe://{{.TrustDomain}}/ns/{{.Namespace}}",
+			want:     "spiffe://example.org/ns/default",
+		},
+		{
+			name:       "nothing",
+			template:   `{{index .Annotations "x"}}`,
+			annotation: "",
+			want:       "",
+		},
+		{
+			name:       "dot dot from metadata",
+			template:   `ns/{{.Namespace}}/{{index .Annotations "x"}}`,
+			annotation: "../../payments/api",
+			wantErr:    true,
+		},
+		{
+			name:       "dot from metadata",
+			template:   `ns/{{.Namespace}}/{{index .Annotations "x"}}/api`,
+			annotation: ".",
+			wantErr:    true,
+		},
+		{
+			name:       "empty segment",
+			template:   `ns/{{.Namespace}}/{{index .Annotations "x"}}/api`,
+			annotation: "",
+			wantErr:    true,
+		},
+		{
+			name:     "label missing from pod",
+			template: "ns/{{.Namespace}}/team/{{.Labels.team}}",
+			wantErr:  true,
+		},
+		{
+			name:     "other trust domain",
+			template: "spiffe://other.org/ns/{{.Namespace}}",
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := parseTemplate("id", tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+			idTemplate := &IdTemplate{Text: tt.template, trustDomain: "example.org", template: tmpl}
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   "default",
+					Name:        "web-0",
+					Annotations: map[string]string{"x": tt.annotation},
+				},
+				Spec: corev1.PodSpec{ServiceAccountName: "web"},
+			}
+
+			got, err := idTemplate.Execute(pod)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Execute() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Execute() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseIdTemplate(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		wantErr  bool
+	}{
+		{name: "sample pod labels", template: "ns/{{.Namespace}}/app/{{.Labels.app}}"},
+		// The sample pod has no team label, so its ID has an empty segment, but real pods may have it
+		{name: "label missing from sample pod", template: "ns/{{.Namespace}}/team/{{.Labels.team}}"},
+		{name: "parse error", template: "ns/{{.Namespace", wantErr: true},
+		{name: "execute error", template: "ns/{{.Missing}}", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseIdTemplate(tt.template, "example.org"); (err != nil) != tt.wantErr {
+				t.Errorf("ParseIdTemplate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
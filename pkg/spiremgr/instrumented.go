@@ -0,0 +1,69 @@
+package spiremgr
+
+import (
+	"context"
+	"time"
+
+	"github.com/spiffe/spire/proto/spire/common"
+	"github.com/transferwise/spire-k8s-operator/pkg/metrics"
+)
+
+// InstrumentBackend wraps a backend, recording the latency and status code of every call in the spire request
+// metrics, labelled with the given controller name.
+func InstrumentBackend(backend Backend, controller string) Backend {
+	return &instrumentedBackend{backend: backend, controller: controller}
+}
+
+type instrumentedBackend struct {
+	backend    Backend
+	controller string
+}
+
+func (r *instrumentedBackend) CreateEntry(ctx context.Context, entry *common.RegistrationEntry) (string, error) {
+	start := time.Now()
+	entryId, err := r.backend.CreateEntry(ctx, entry)
+	metrics.ObserveSpireRequest(r.controller, "CreateEntry", start, err)
+	return entryId, err
+}
+
+func (r *instrumentedBackend) UpdateEntry(ctx context.Context, entry *common.RegistrationEntry) (*common.RegistrationEntry, error) {
+	start := time.Now()
+	updated, err := r.backend.UpdateEntry(ctx, entry)
+	metrics.ObserveSpireRequest(r.controller, "UpdateEntry", start, err)
+	return updated, err
+}
+
+func (r *instrumentedBackend) DeleteEntry(ctx context.Context, entryId string) error {
+	start := time.Now()
+	err := r.backend.DeleteEntry(ctx, entryId)
+	metrics.ObserveSpireRequest(r.controller, "DeleteEntry", start, err)
+	return err
+}
+
+func (r *instrumentedBackend) DeleteEntries(ctx context.Context, entryIds []string) (map[string]error, error) {
+	start := time.Now()
+	failed, err := r.backend.DeleteEntries(ctx, entryIds)
+	metrics.ObserveSpireRequest(r.controller, "DeleteEntries", start, err)
+	return failed, err
+}
+
+func (r *instrumentedBackend) GetEntry(ctx context.Context, entryId string) (*common.RegistrationEntry, error) {
+	start := time.Now()
+	entry, err := r.backend.GetEntry(ctx, entryId)
+	metrics.ObserveSpireRequest(r.controller, "GetEntry", start, err)
+	return entry, err
+}
+
+func (r *instrumentedBackend) ListEntries(ctx context.Context, parentId string) ([]*common.RegistrationEntry, error) {
+	start := time.Now()
+	entries, err := r.backend.ListEntries(ctx, parentId)
+	metrics.ObserveSpireRequest(r.controller, "ListEntries", start, err)
+	return entries, err
+}
+
+func (r *instrumentedBackend) EnsureParent(ctx context.Context, parent *common.RegistrationEntry) error {
+	start := time.Now()
+	err := r.backend.EnsureParent(ctx, parent)
+	metrics.ObserveSpireRequest(r.controller, "EnsureParent", start, err)
+	return err
+}
@@ -0,0 +1,71 @@
+package spiremgr
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// ExpandPattern fills in the {trustDomain} and {namespace} placeholders of an allowable spiffe ID pattern,
+// e.g. spiffe://{trustDomain}/ns/{namespace}/*
+func ExpandPattern(pattern string, trustDomain string, namespace string) string {
+	return strings.NewReplacer("{trustDomain}", trustDomain, "{namespace}", namespace).Replace(pattern)
+}
+
+// MatchPattern reports whether a spiffe ID matches an expanded pattern. Each path segment of the pattern is
+// matched using path.Match, and a trailing /* matches one or more remaining segments. IDs which aren't valid,
+// such as those with .. segments, never match.
+func MatchPattern(pattern string, id string) bool {
+	if _, err := ParseSpiffeId(id); err != nil {
+		return false
+	}
+	patternParts := strings.Split(pattern, "/")
+	idParts := strings.Split(id, "/")
+
+	if patternParts[len(patternParts)-1] == "*" {
+		if len(idParts) < len(patternParts) {
+			return false
+		}
+		rest := strings.Join(idParts[len(patternParts)-1:], "/")
+		if len(rest) == 0 {
+			return false
+		}
+		patternParts = patternParts[:len(patternParts)-1]
+		idParts = idParts[:len(patternParts)]
+	} else if len(idParts) != len(patternParts) {
+		return false
+	}
+
+	for i := range patternParts {
+		if ok, err := path.Match(patternParts[i], idParts[i]); err != nil || !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidatePattern checks that a pattern is a spiffe ID pattern which path.Match can use.
+func ValidatePattern(pattern string) error {
+	if !strings.HasPrefix(pattern, "spiffe://") {
+		return fmt.Errorf("pattern %q must start with spiffe://", pattern)
+	}
+	for _, part := range strings.Split(ExpandPattern(pattern, "", ""), "/") {
+		if _, err := path.Match(part, ""); err != nil {
+			return fmt.Errorf("pattern %q is invalid: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// ParsePatterns splits a newline separated list of patterns, ignoring blank lines and # comments.
+func ParsePatterns(data string) []string {
+	var patterns []string
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	return patterns
+}
@@ -0,0 +1,61 @@
+package spiremgr
+
+import "testing"
+
+func TestMatchPattern(t *testing.T) {
+	const pattern = "spiffe://{trustDomain}/ns/{namespace}/*"
+
+	tests := []struct {
+		name      string
+		namespace string
+		id        string
+		want      bool
+	}{
+		{name: "in namespace", namespace: "foo", id: "spiffe://td/ns/foo/web", want: true},
+		{name: "nested", namespace: "foo", id: "spiffe://td/ns/foo/sa/web", want: true},
+		{name: "other namespace", namespace: "foo", id: "spiffe://td/ns/payments/web"},
+		{name: "no remaining segment", namespace: "foo", id: "spiffe://td/ns/foo"},
+		{name: "trailing slash", namespace: "foo", id: "spiffe://td/ns/foo/"},
+		{name: "other trust domain", namespace: "foo", id: "spiffe://other/ns/foo/web"},
+		{name: "dot dot escape", namespace: "foo", id: "spiffe://td/ns/foo/../../ns/payments/x"},
+		{name: "encoded dot dot escape", namespace: "foo", id: "spiffe://td/ns/foo/%2e%2e/%2e%2e/ns/payments/x"},
+		{name: "dot segment", namespace: "foo", id: "spiffe://td/ns/foo/./web"},
+		{name: "empty segment", namespace: "foo", id: "spiffe://td/ns/foo//web"},
+		{name: "not a spiffe ID", namespace: "foo", id: "https://td/ns/foo/web"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expanded := ExpandPattern(pattern, "td", tt.namespace)
+			if got := MatchPattern(expanded, tt.id); got != tt.want {
+				t.Errorf("MatchPattern(%q, %q) = %v, want %v", expanded, tt.id, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSpiffeId(t *testing.T) {
+	tests := []struct {
+		id      string
+		wantErr bool
+	}{
+		{id: "spiffe://td"},
+		{id: "spiffe://td/ns/foo/sa/web"},
+		{id: "spiffe://td/", wantErr: true},
+		{id: "spiffe://td/ns//web", wantErr: true},
+		{id: "spiffe://td/ns/./web", wantErr: true},
+		{id: "spiffe://td/ns/../web", wantErr: true},
+		{id: "spiffe://td/ns/%2E%2E/web", wantErr: true},
+		{id: "spiffe://td/ns/foo/..", wantErr: true},
+		{id: "spiffe:///ns/foo", wantErr: true},
+		{id: "spiffe://td/ns/foo?x=y", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			if _, err := ParseSpiffeId(tt.id); (err != nil) != tt.wantErr {
+				t.Errorf("ParseSpiffeId(%q) error = %v, wantErr %v", tt.id, err, tt.wantErr)
+			}
+		})
+	}
+}
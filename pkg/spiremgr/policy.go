@@ -0,0 +1,168 @@
+package spiremgr
+
+import (
+	"context"
+	"fmt"
+	spiffeidv1alpha1 "github.com/transferwise/spire-k8s-operator/pkg/apis/spiffeid/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	k8errors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// PolicyEvaluator checks SpiffeIds and ClusterSpiffeIds against the SpiffeIdPolicies which apply to them.
+type PolicyEvaluator struct {
+	Client client.Client
+}
+
+// Evaluate returns the reasons the instance is denied by the SpiffeIdPolicies covering its namespace. Every
+// applicable policy must allow the instance, and instances which no policy applies to are always allowed.
+func (r *PolicyEvaluator) Evaluate(instance spiffeidv1alpha1.CommonSpiffeId) (field.ErrorList, error) {
+	allErrs := field.ErrorList{}
+
+	policies := &spiffeidv1alpha1.SpiffeIdPolicyList{}
+	if err := r.Client.List(context.TODO(), policies); err != nil {
+		return nil, err
+	}
+	if len(policies.Items) == 0 {
+		return allErrs, nil
+	}
+
+	namespace := instanceNamespace(instance)
+	namespaceLabels, err := r.namespaceLabels(namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range policies.Items {
+		policy := &policies.Items[i]
+		applies, err := policyApplies(policy, namespace, namespaceLabels)
+		if err != nil {
+			return nil, fmt.Errorf("invalid namespaceSelector in SpiffeIdPolicy %s: %v", policy.Name, err)
+		}
+		if applies {
+			allErrs = append(allErrs, checkPolicy(policy, instance)...)
+		}
+	}
+	return allErrs, nil
+}
+
+// Affected returns the keys of the instances the policy applies to, so that they can be checked again when the
+// policy changes.
+func (r *PolicyEvaluator) Affected(policy *spiffeidv1alpha1.SpiffeIdPolicy, instances []spiffeidv1alpha1.CommonSpiffeId) ([]types.NamespacedName, error) {
+	var keys []types.NamespacedName
+	for _, instance := range instances {
+		namespace := instanceNamespace(instance)
+		namespaceLabels, err := r.namespaceLabels(namespace)
+		if err != nil {
+			return nil, err
+		}
+		applies, err := policyApplies(policy, namespace, namespaceLabels)
+		if err != nil {
+			return nil, err
+		}
+		if applies {
+			keys = append(keys, keyOf(instance))
+		}
+	}
+	return keys, nil
+}
+
+// instanceNamespace returns the namespace of a SpiffeId, or of the pods a ClusterSpiffeId selects
+func instanceNamespace(instance spiffeidv1alpha1.CommonSpiffeId) string {
+	if namespace := instance.GetNamespace(); len(namespace) > 0 {
+		return namespace
+	}
+	return instance.GetSpec().Selector.Namespace
+}
+
+func (r *PolicyEvaluator) namespaceLabels(namespace string) (labels.Set, error) {
+	if len(namespace) == 0 {
+		return nil, nil
+	}
+	ns := &corev1.Namespace{}
+	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: namespace}, ns)
+	if err != nil {
+		if k8errors.IsNotFound(err) {
+			return labels.Set{}, nil
+		}
+		return nil, err
+	}
+	return labels.Set(ns.GetLabels()), nil
+}
+
+// policyApplies returns true if the policy selects the namespace. IDs without a namespace are only covered by
+// policies which apply to all namespaces.
+func policyApplies(policy *spiffeidv1alpha1.SpiffeIdPolicy, namespace string, namespaceLabels labels.Set) (bool, error) {
+	selector := policy.Spec.NamespaceSelector
+	if selector == nil || (len(selector.MatchLabels) == 0 && len(selector.MatchExpressions) == 0) {
+		return true, nil
+	}
+	if len(namespace) == 0 {
+		return false, nil
+	}
+	s, err := v1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		return false, err
+	}
+	return s.Matches(namespaceLabels), nil
+}
+
+// checkPolicy returns the ways the instance breaks the policy. Empty policy fields don't restrict anything.
+func checkPolicy(policy *spiffeidv1alpha1.SpiffeIdPolicy, instance spiffeidv1alpha1.CommonSpiffeId) field.ErrorList {
+	allErrs := field.ErrorList{}
+	spec := instance.GetSpec()
+	selectorPath := field.NewPath("spec", "selector")
+	isCluster := len(instance.GetNamespace()) == 0
+
+	usedTypes := map[string]bool{
+		spiffeidv1alpha1.SelectorTypePodLabel:       len(spec.Selector.PodLabel) > 0,
+		spiffeidv1alpha1.SelectorTypePodName:        len(spec.Selector.PodName) > 0,
+		spiffeidv1alpha1.SelectorTypeServiceAccount: len(spec.Selector.ServiceAccount) > 0,
+		// Namespaced IDs always get an implicit namespace selector, so only count it when set explicitly
+		spiffeidv1alpha1.SelectorTypeNamespace: isCluster && len(spec.Selector.Namespace) > 0,
+	}
+	if len(policy.Spec.AllowedSelectorTypes) > 0 {
+		allowed := map[string]bool{}
+		for _, t := range policy.Spec.AllowedSelectorTypes {
+			allowed[t] = true
+		}
+		for _, t := range []string{
+			spiffeidv1alpha1.SelectorTypePodLabel,
+			spiffeidv1alpha1.SelectorTypePodName,
+			spiffeidv1alpha1.SelectorTypeNamespace,
+			spiffeidv1alpha1.SelectorTypeServiceAccount,
+		} {
+			if usedTypes[t] && !allowed[t] {
+				allErrs = append(allErrs, field.Forbidden(selectorPath.Child(t), fmt.Sprintf("denied by SpiffeIdPolicy %s: %s selectors are not allowed", policy.Name, t)))
+			}
+		}
+	}
+
+	// Only ClusterSpiffeIds turn arbitrary selectors into spire selectors
+	if isCluster && len(spec.Selector.Arbitrary) > 0 && !policy.Spec.AllowArbitrarySelectors {
+		allErrs = append(allErrs, field.Forbidden(selectorPath.Child("arbitrary"), fmt.Sprintf("denied by SpiffeIdPolicy %s: arbitrary selectors are not allowed", policy.Name)))
+	}
+
+	if policy.Spec.MaxTtl > 0 && spec.Ttl > policy.Spec.MaxTtl {
+		allErrs = append(allErrs, field.Forbidden(field.NewPath("spec", "ttl"), fmt.Sprintf("denied by SpiffeIdPolicy %s: ttl must not be more than %d", policy.Name, policy.Spec.MaxTtl)))
+	}
+
+	if len(policy.Spec.AllowedFederatedDomains) == 0 {
+		return allErrs
+	}
+	allowedDomains := map[string]bool{}
+	for _, trustDomain := range policy.Spec.AllowedFederatedDomains {
+		allowedDomains[trustDomain] = true
+	}
+	for i, trustDomain := range spec.FederatesWith {
+		if !allowedDomains[trustDomain] {
+			allErrs = append(allErrs, field.Forbidden(field.NewPath("spec", "federatesWith").Index(i), fmt.Sprintf("denied by SpiffeIdPolicy %s: federation with %s is not allowed", policy.Name, trustDomain)))
+		}
+	}
+
+	return allErrs
+}
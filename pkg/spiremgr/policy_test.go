@@ -0,0 +1,175 @@
+package spiremgr
+
+import (
+	"testing"
+
+	spiffeidv1alpha1 "github.com/transferwise/spire-k8s-operator/pkg/apis/spiffeid/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+func TestPolicyApplies(t *testing.T) {
+	tests := []struct {
+		name            string
+		selector        *metav1.LabelSelector
+		namespace       string
+		namespaceLabels labels.Set
+		want            bool
+		wantErr         bool
+	}{
+		{name: "no selector", namespace: "default", want: true},
+		{name: "empty selector", selector: &metav1.LabelSelector{}, want: true},
+		{
+			name:            "matching namespace",
+			selector:        &metav1.LabelSelector{MatchLabels: map[string]string{"team": "payments"}},
+			namespace:       "payments",
+			namespaceLabels: labels.Set{"team": "payments"},
+			want:            true,
+		},
+		{
+			name:            "other namespace",
+			selector:        &metav1.LabelSelector{MatchLabels: map[string]string{"team": "payments"}},
+			namespace:       "default",
+			namespaceLabels: labels.Set{},
+		},
+		{
+			name:     "no namespace",
+			selector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "payments"}},
+		},
+		{
+			name: "invalid selector",
+			selector: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{
+				{Key: "team", Operator: "Near"},
+			}},
+			namespace: "default",
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := &spiffeidv1alpha1.SpiffeIdPolicy{
+				Spec: spiffeidv1alpha1.SpiffeIdPolicySpec{NamespaceSelector: tt.selector},
+			}
+			got, err := policyApplies(policy, tt.namespace, tt.namespaceLabels)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("policyApplies() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("policyApplies() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  spiffeidv1alpha1.SpiffeIdPolicySpec
+		cluster bool
+		spec    spiffeidv1alpha1.SpiffeIdSpec
+		// fields which should be reported as forbidden
+		want []string
+	}{
+		{
+			name:   "empty policy",
+			policy: spiffeidv1alpha1.SpiffeIdPolicySpec{},
+			spec: spiffeidv1alpha1.SpiffeIdSpec{
+				Selector:      spiffeidv1alpha1.Selector{PodName: "web-0", Arbitrary: []string{"unix:uid:0"}},
+				Ttl:           86400,
+				FederatesWith: []string{"spiffe://other.org"},
+			},
+			cluster: true,
+			want:    []string{"spec.selector.arbitrary"},
+		},
+		{
+			name:   "allowed selector type",
+			policy: spiffeidv1alpha1.SpiffeIdPolicySpec{AllowedSelectorTypes: []string{spiffeidv1alpha1.SelectorTypeServiceAccount}},
+			spec:   spiffeidv1alpha1.SpiffeIdSpec{Selector: spiffeidv1alpha1.Selector{ServiceAccount: "web"}},
+		},
+		{
+			name:   "denied selector type",
+			policy: spiffeidv1alpha1.SpiffeIdPolicySpec{AllowedSelectorTypes: []string{spiffeidv1alpha1.SelectorTypeServiceAccount}},
+			spec:   spiffeidv1alpha1.SpiffeIdSpec{Selector: spiffeidv1alpha1.Selector{PodName: "web-0", ServiceAccount: "web"}},
+			want:   []string{"spec.selector." + spiffeidv1alpha1.SelectorTypePodName},
+		},
+		{
+			name:   "namespace of namespaced ID",
+			policy: spiffeidv1alpha1.SpiffeIdPolicySpec{AllowedSelectorTypes: []string{spiffeidv1alpha1.SelectorTypeServiceAccount}},
+			spec:   spiffeidv1alpha1.SpiffeIdSpec{Selector: spiffeidv1alpha1.Selector{Namespace: "default", ServiceAccount: "web"}},
+		},
+		{
+			name:    "namespace of cluster ID",
+			policy:  spiffeidv1alpha1.SpiffeIdPolicySpec{AllowedSelectorTypes: []string{spiffeidv1alpha1.SelectorTypeServiceAccount}},
+			cluster: true,
+			spec:    spiffeidv1alpha1.SpiffeIdSpec{Selector: spiffeidv1alpha1.Selector{Namespace: "default", ServiceAccount: "web"}},
+			want:    []string{"spec.selector." + spiffeidv1alpha1.SelectorTypeNamespace},
+		},
+		{
+			name: "arbitrary of namespaced ID",
+			spec: spiffeidv1alpha1.SpiffeIdSpec{Selector: spiffeidv1alpha1.Selector{Arbitrary: []string{"unix:uid:0"}}},
+		},
+		{
+			name:    "arbitrary of cluster ID",
+			cluster: true,
+			spec:    spiffeidv1alpha1.SpiffeIdSpec{Selector: spiffeidv1alpha1.Selector{Arbitrary: []string{"unix:uid:0"}}},
+			want:    []string{"spec.selector.arbitrary"},
+		},
+		{
+			name:    "arbitrary allowed",
+			policy:  spiffeidv1alpha1.SpiffeIdPolicySpec{AllowArbitrarySelectors: true},
+			cluster: true,
+			spec:    spiffeidv1alpha1.SpiffeIdSpec{Selector: spiffeidv1alpha1.Selector{Arbitrary: []string{"unix:uid:0"}}},
+		},
+		{
+			name:   "ttl within max",
+			policy: spiffeidv1alpha1.SpiffeIdPolicySpec{MaxTtl: 3600},
+			spec:   spiffeidv1alpha1.SpiffeIdSpec{Ttl: 3600},
+		},
+		{
+			name:   "ttl over max",
+			policy: spiffeidv1alpha1.SpiffeIdPolicySpec{MaxTtl: 3600},
+			spec:   spiffeidv1alpha1.SpiffeIdSpec{Ttl: 3601},
+			want:   []string{"spec.ttl"},
+		},
+		{
+			name:   "allowed federated domain",
+			policy: spiffeidv1alpha1.SpiffeIdPolicySpec{AllowedFederatedDomains: []string{"spiffe://other.org"}},
+			spec:   spiffeidv1alpha1.SpiffeIdSpec{FederatesWith: []string{"spiffe://other.org"}},
+		},
+		{
+			name:   "denied federated domain",
+			policy: spiffeidv1alpha1.SpiffeIdPolicySpec{AllowedFederatedDomains: []string{"spiffe://other.org"}},
+			spec:   spiffeidv1alpha1.SpiffeIdSpec{FederatesWith: []string{"spiffe://other.org", "spiffe://evil.org"}},
+			want:   []string{"spec.federatesWith[1]"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := &spiffeidv1alpha1.SpiffeIdPolicy{
+				ObjectMeta: metav1.ObjectMeta{Name: "policy"},
+				Spec:       tt.policy,
+			}
+			var instance spiffeidv1alpha1.CommonSpiffeId
+			if tt.cluster {
+				instance = &spiffeidv1alpha1.ClusterSpiffeId{ObjectMeta: metav1.ObjectMeta{Name: "web"}, Spec: tt.spec}
+			} else {
+				instance = &spiffeidv1alpha1.SpiffeId{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"}, Spec: tt.spec}
+			}
+
+			var got []string
+			for _, err := range checkPolicy(policy, instance) {
+				got = append(got, err.Field)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("checkPolicy() forbids %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("checkPolicy() forbids %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
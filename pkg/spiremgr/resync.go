@@ -0,0 +1,60 @@
+package spiremgr
+
+import (
+	"fmt"
+	spiffeidv1alpha1 "github.com/transferwise/spire-k8s-operator/pkg/apis/spiffeid/v1alpha1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"time"
+)
+
+// EntryOutcome describes what EnsureEntry had to do to bring a spire entry in line with its SpiffeId
+type EntryOutcome int
+
+const (
+	EntryUnchanged EntryOutcome = iota
+	EntryCreated
+	EntryUpdated
+	EntryRecreated
+	EntryReused
+)
+
+func (o EntryOutcome) String() string {
+	switch o {
+	case EntryUnchanged:
+		return "unchanged"
+	case EntryCreated:
+		return "created"
+	case EntryUpdated:
+		return "updated"
+	case EntryRecreated:
+		return "recreated"
+	case EntryReused:
+		return "reused"
+	}
+	return fmt.Sprintf("EntryOutcome(%d)", int(o))
+}
+
+// Resyncer periodically re-checks each SpiffeId's entry against the spire server, so that entries deleted or
+// modified out-of-band (or lost when the spire datastore is restored from a backup) are detected and repaired.
+type Resyncer struct {
+	// How often to check entries. Zero disables periodic checks.
+	Interval time.Duration
+}
+
+// Result returns the reconcile result which schedules the next drift check for an object.
+func (r *Resyncer) Result() reconcile.Result {
+	if r.Interval <= 0 {
+		return reconcile.Result{}
+	}
+	// Spread the checks out so that all objects don't hit the spire server at once.
+	return reconcile.Result{RequeueAfter: wait.Jitter(r.Interval, 0.1)}
+}
+
+// IsRepair returns true if the entry had to be changed even though the SpiffeId spec was already synced,
+// meaning the spire server drifted rather than the spec being edited.
+func (r *Resyncer) IsRepair(instance spiffeidv1alpha1.CommonSpiffeId, outcome EntryOutcome) bool {
+	status := instance.GetStatus()
+	return outcome != EntryUnchanged && len(status.EntryId) > 0 && status.ObservedGeneration == instance.GetGeneration() &&
+		status.IsConditionTrue(spiffeidv1alpha1.SpiffeIdSynced)
+}
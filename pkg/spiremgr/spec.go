@@ -0,0 +1,20 @@
+package spiremgr
+
+import (
+	"github.com/spiffe/spire/proto/spire/common"
+	spiffeidv1alpha1 "github.com/transferwise/spire-k8s-operator/pkg/apis/spiffeid/v1alpha1"
+)
+
+// EntryFromSpec builds the template for the spire entry described by a SpiffeIdSpec and its selectors.
+// The parent ID is filled in by SpireUtils.
+func EntryFromSpec(spec *spiffeidv1alpha1.SpiffeIdSpec, selectors []*common.Selector) *common.RegistrationEntry {
+	return &common.RegistrationEntry{
+		SpiffeId:      spec.SpiffeId,
+		Selectors:     selectors,
+		Ttl:           spec.Ttl,
+		DnsNames:      spec.DnsNames,
+		Admin:         spec.Admin,
+		Downstream:    spec.Downstream,
+		FederatesWith: spec.FederatesWith,
+	}
+}
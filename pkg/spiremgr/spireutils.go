@@ -5,53 +5,45 @@ import (
 	"errors"
 	"fmt"
 	"github.com/go-logr/logr"
-	"github.com/spiffe/spire/proto/spire/api/registration"
 	"github.com/spiffe/spire/proto/spire/common"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
-	"net/url"
-	"path"
+	"strings"
+	"sync"
+	"time"
 )
 
-type SpireUtils struct {
-	SpireClient registration.RegistrationClient
-	TrustDomain	string
-	Cluster	    string
-	myId        *string
-}
+// DefaultCallTimeout is the deadline for each call to the spire server when SpireUtils isn't given one
+const DefaultCallTimeout = 30 * time.Second
 
+// SpireUtils manages the spire entries parented to the operator, using whichever Backend it's given.
+type SpireUtils struct {
+	Backend     Backend
+	TrustDomain string
+	Cluster     string
+	// Deadline for each call to the spire server. Zero uses DefaultCallTimeout.
+	CallTimeout time.Duration
 
-func (r *SpireUtils) makeID(pathFmt string, pathArgs ...interface{}) string {
-	id := url.URL{
-		Scheme: "spiffe",
-		Host:   r.TrustDomain,
-		Path:   path.Clean(fmt.Sprintf(pathFmt, pathArgs...)),
-	}
-	return id.String()
-}
-
-// ServerID creates a server SPIFFE ID string given a trustDomain.
-func ServerID(trustDomain string) string {
-	return ServerURI(trustDomain).String()
+	// myIdLock serializes concurrent reconciles creating the operator's parent entry
+	myIdLock sync.Mutex
+	myId     *string
 }
 
-// ServerURI creates a server SPIFFE URI given a trustDomain.
-func ServerURI(trustDomain string) *url.URL {
-	return &url.URL{
-		Scheme: "spiffe",
-		Host:   trustDomain,
-		Path:   path.Join("spire", "server"),
+// callContext returns the context for a single call to the backend, which must be cancelled once it's done
+func (r *SpireUtils) callContext() (context.Context, context.CancelFunc) {
+	timeout := r.CallTimeout
+	if timeout <= 0 {
+		timeout = DefaultCallTimeout
 	}
-}
-
-func (r *SpireUtils) nodeID() string {
-	return r.makeID("spire-k8s-operator/%s/node", r.Cluster)
+	return context.WithTimeout(context.Background(), timeout)
 }
 
 func (r *SpireUtils) makeMyId(reqLogger logr.Logger) (string, error) {
 	myId := r.nodeID()
 	reqLogger.Info("Initializing operator parent ID.")
-	_, err := r.SpireClient.CreateEntry(context.TODO(), &common.RegistrationEntry{
+	ctx, cancel := r.callContext()
+	defer cancel()
+	err := r.Backend.EnsureParent(ctx, &common.RegistrationEntry{
 		Selectors: []*common.Selector{
 			{Type: "k8s_psat", Value: fmt.Sprintf("cluster:%s", r.Cluster)},
 		},
@@ -59,16 +51,16 @@ func (r *SpireUtils) makeMyId(reqLogger logr.Logger) (string, error) {
 		SpiffeId: myId,
 	})
 	if err != nil {
-		if status.Code(err) != codes.AlreadyExists {
-			reqLogger.Info("Failed to create operator parent ID", "spiffeID", myId)
-			return "", err
-		}
+		reqLogger.Info("Failed to create operator parent ID", "spiffeID", myId)
+		return "", err
 	}
 	reqLogger.Info("Initialized operator parent ID", "spiffeID", myId)
 	return myId, nil
 }
 
 func (r *SpireUtils) getMyId(reqLogger logr.Logger) (string, error) {
+	r.myIdLock.Lock()
+	defer r.myIdLock.Unlock()
 	if r.myId == nil {
 		myId, err := r.makeMyId(reqLogger)
 		if err != nil {
@@ -80,16 +72,15 @@ func (r *SpireUtils) getMyId(reqLogger logr.Logger) (string, error) {
 }
 
 func (r *SpireUtils) DeleteEntry(reqLogger logr.Logger, entryId string) error {
-	regEntryId := &registration.RegistrationEntryID{
-		Id: entryId,
-	}
-	_, err := r.SpireClient.DeleteEntry(context.TODO(), regEntryId)
+	ctx, cancel := r.callContext()
+	defer cancel()
+	err := r.Backend.DeleteEntry(ctx, entryId)
 	if err != nil {
 		if status.Code(err) == codes.NotFound {
 			return nil
 		}
 		// Spire server returns internal server error rather than NotFound when the entry doesn't exist.
-		//reqLogger.Error(err, "Failed to delete registration entry", "entryID", regEntryId.Id)
+		//reqLogger.Error(err, "Failed to delete registration entry", "entryID", entryId)
 		//return err
 		reqLogger.Error(err, "Got error deleting spire entry, but assuming it's OK")
 		return nil
@@ -98,75 +89,301 @@ func (r *SpireUtils) DeleteEntry(reqLogger logr.Logger, entryId string) error {
 	return nil
 }
 
+// DeleteEntries deletes many entries at once, returning the errors for the entries which couldn't be deleted
+// by entry ID. Entries which no longer exist are treated as deleted.
+func (r *SpireUtils) DeleteEntries(reqLogger logr.Logger, entryIds []string) (map[string]error, error) {
+	failed := map[string]error{}
+	if len(entryIds) == 0 {
+		return failed, nil
+	}
+	ctx, cancel := r.callContext()
+	defer cancel()
+	results, err := r.Backend.DeleteEntries(ctx, entryIds)
+	if err != nil {
+		reqLogger.Error(err, "Failed to delete spire entries")
+		return nil, err
+	}
+	for entryId, err := range results {
+		if status.Code(err) != codes.NotFound {
+			failed[entryId] = err
+		}
+	}
+	return failed, nil
+}
+
 var ExistingEntryNotFoundError = errors.New("No existing matching entry found")
 
-func (r *SpireUtils) getExistingEntry(reqLogger logr.Logger, id string, selectors []*common.Selector) (string, error) {
+// ListEntries returns all the spire entries parented to the operator.
+func (r *SpireUtils) ListEntries(reqLogger logr.Logger) ([]*common.RegistrationEntry, error) {
 	myId, err := r.getMyId(reqLogger)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	entries, err := r.SpireClient.ListByParentID(context.TODO(), &registration.ParentID{
-		Id: myId,
-	})
+	ctx, cancel := r.callContext()
+	defer cancel()
+	return r.Backend.ListEntries(ctx, myId)
+}
+
+// getExistingEntry finds the entry parented to the operator which matches the desired entry exactly. If there
+// isn't one, the entry which the spire server considers a duplicate (same spiffe ID, parent and selectors) is
+// returned instead, and may differ from the desired entry in its other fields.
+func (r *SpireUtils) getExistingEntry(reqLogger logr.Logger, desired *common.RegistrationEntry) (*common.RegistrationEntry, error) {
+	entries, err := r.ListEntries(reqLogger)
 	if err != nil {
 		reqLogger.Error(err, "Failed to retrieve existing spire entry")
-		return "", err
+		return nil, err
 	}
 
-	selectorMap := map[string]map[string]bool{}
-	for _, sel := range selectors {
-		if _, ok := selectorMap[sel.Type]; !ok {
-			selectorMap[sel.Type] = make(map[string]bool)
+	var duplicate *common.RegistrationEntry
+	for _, entry := range entries {
+		if entryMatches(entry, desired) {
+			return entry, nil
 		}
-		selectorMap[sel.Type][sel.Value] = true
-	}
-	for _, entry := range entries.Entries {
-		if entry.GetSpiffeId() == id {
-			if len(entry.GetSelectors()) != len(selectors) {
-				continue
-			}
-			for _, sel := range entry.GetSelectors() {
-				if _, ok := selectorMap[sel.Type]; !ok {
-					continue
-				}
-				if _, ok := selectorMap[sel.Type][sel.Value]; !ok {
-					continue
-				}
-			}
-			return entry.GetEntryId(), nil
+		if duplicate == nil && EntryIsDuplicate(entry, desired) {
+			duplicate = entry
 		}
 	}
-	return "", ExistingEntryNotFoundError
+	if duplicate != nil {
+		return duplicate, nil
+	}
+	return nil, ExistingEntryNotFoundError
 }
 
-func (r *SpireUtils) GetOrCreateEntry(reqLogger logr.Logger, spiffeId string, selectors []*common.Selector) (string, error) {
+// findExistingEntry returns the entry which stopped the desired entry being created, fetching it by ID if the
+// backend said which one it was.
+func (r *SpireUtils) findExistingEntry(reqLogger logr.Logger, entryId string, desired *common.RegistrationEntry) (*common.RegistrationEntry, error) {
+	if len(entryId) == 0 {
+		return r.getExistingEntry(reqLogger, desired)
+	}
+	entry, err := r.getEntry(entryId)
+	if status.Code(err) == codes.NotFound {
+		return nil, ExistingEntryNotFoundError
+	}
+	return entry, err
+}
 
+// adoptEntry reuses an existing entry for the desired one. A duplicate entry with a different TTL, DNS names or
+// other options is updated to match, rather than binding the SpiffeId to an entry that doesn't follow its spec.
+func (r *SpireUtils) adoptEntry(reqLogger logr.Logger, existing *common.RegistrationEntry, desired *common.RegistrationEntry) (string, error) {
+	entryId := existing.GetEntryId()
+	if entryMatches(existing, desired) {
+		return entryId, nil
+	}
+	reqLogger.Info("Updating existing entry to match", "entryID", entryId, "spiffeID", desired.GetSpiffeId())
+	updated, err := r.updateEntry(withParent(desired, desired.GetParentId(), entryId))
+	if err != nil {
+		reqLogger.Error(err, "Failed to update existing spire entry", "entryID", entryId)
+		return "", err
+	}
+	return updated.GetEntryId(), nil
+}
+
+// GetOrCreateEntry creates a spire entry parented to the operator from the given template, reusing an
+// existing entry with the same spiffe ID and selectors if there is one. Returns whether an existing entry was
+// reused.
+func (r *SpireUtils) GetOrCreateEntry(reqLogger logr.Logger, template *common.RegistrationEntry) (string, bool, error) {
+	spiffeId := template.GetSpiffeId()
 	reqLogger.Info("Creating entry", "spiffeID", spiffeId)
 
 	myId, err := r.getMyId(reqLogger)
 	if err != nil {
-		return "", err
+		return "", false, err
 	}
 
-	regEntryId, err := r.SpireClient.CreateEntry(context.TODO(), &common.RegistrationEntry{
-		Selectors: selectors,
-		ParentId:  myId,
-		SpiffeId:  spiffeId,
-	})
+	desired := withParent(template, myId, "")
+
+	// If the matching entry is deleted between CreateEntry failing and us finding the existing entry, retry the
+	// create once rather than failing the reconcile.
+	for attempt := 0; ; attempt++ {
+		entryId, err := r.createEntry(desired)
+		if err == nil {
+			reqLogger.Info("Created entry", "entryID", entryId, "spiffeID", spiffeId)
+			return entryId, false, nil
+		}
+		if status.Code(err) != codes.AlreadyExists {
+			reqLogger.Error(err, "Failed to create spire entry")
+			return "", false, err
+		}
+
+		existing, err := r.findExistingEntry(reqLogger, entryId, desired)
+		if err == ExistingEntryNotFoundError && attempt == 0 {
+			reqLogger.Info("Existing entry disappeared, retrying create", "spiffeID", spiffeId)
+			continue
+		}
+		if err != nil {
+			reqLogger.Error(err, "Failed to reuse existing spire entry")
+			return "", false, err
+		}
+		reqLogger.Info("Found existing entry", "entryID", existing.GetEntryId(), "spiffeID", spiffeId)
+		entryId, err = r.adoptEntry(reqLogger, existing, desired)
+		if err != nil {
+			return "", false, err
+		}
+		return entryId, true, nil
+	}
+}
+
+// EnsureEntry makes sure the spire entry owned by a SpiffeId matches the given template. Entries which have
+// drifted from the spec are updated in place, and if the entry is gone (or no entry ID is known yet) a new
+// one is created. Returns the ID of the entry that now represents the SpiffeId, along with what had to be
+// done to it.
+func (r *SpireUtils) EnsureEntry(reqLogger logr.Logger, entryId string, template *common.RegistrationEntry) (string, EntryOutcome, error) {
+	spiffeId := template.GetSpiffeId()
+	if len(entryId) == 0 {
+		newEntryId, reused, err := r.GetOrCreateEntry(reqLogger, template)
+		if reused {
+			return newEntryId, EntryReused, err
+		}
+		return newEntryId, EntryCreated, err
+	}
+
+	myId, err := r.getMyId(reqLogger)
+	if err != nil {
+		return "", EntryUnchanged, err
+	}
+
+	entry, err := r.getEntry(entryId)
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			reqLogger.Info("Spire entry no longer exists, recreating", "entryID", entryId, "spiffeID", spiffeId)
+			newEntryId, _, err := r.GetOrCreateEntry(reqLogger, template)
+			return newEntryId, EntryRecreated, err
+		}
+		reqLogger.Error(err, "Failed to fetch spire entry", "entryID", entryId)
+		return "", EntryUnchanged, err
+	}
+
+	desired := withParent(template, myId, entryId)
+	if entryMatches(entry, desired) {
+		return entryId, EntryUnchanged, nil
+	}
+
+	reqLogger.Info("Updating entry", "entryID", entryId, "oldSpiffeID", entry.GetSpiffeId(), "spiffeID", spiffeId)
+	updated, err := r.updateEntry(desired)
 	if err != nil {
-		if status.Code(err) == codes.AlreadyExists {
-			entryId, err := r.getExistingEntry(reqLogger, spiffeId, selectors)
-			if err != nil {
-				reqLogger.Error(err, "Failed to reuse existing spire entry")
-				return "", err
+		if status.Code(err) != codes.AlreadyExists {
+			reqLogger.Error(err, "Failed to update spire entry", "entryID", entryId)
+			return "", EntryUnchanged, err
+		}
+		// Another entry already matches the new spec, so switch over to it and clean up the old one.
+		newEntryId, _, err := r.GetOrCreateEntry(reqLogger, template)
+		if err != nil {
+			return "", EntryUnchanged, err
+		}
+		if newEntryId != entryId {
+			if err := r.DeleteEntry(reqLogger, entryId); err != nil {
+				return "", EntryUnchanged, err
 			}
-			reqLogger.Info("Found existing entry", "entryID", entryId, "spiffeID", spiffeId)
-			return entryId, err
 		}
-		reqLogger.Error(err, "Failed to create spire entry")
-		return "", err
+		return newEntryId, EntryRecreated, nil
 	}
-	reqLogger.Info("Created entry", "entryID", regEntryId.Id, "spiffeID", spiffeId)
+	reqLogger.Info("Updated entry", "entryID", updated.GetEntryId(), "spiffeID", spiffeId)
+
+	return updated.GetEntryId(), EntryUpdated, nil
+}
+
+func (r *SpireUtils) createEntry(entry *common.RegistrationEntry) (string, error) {
+	ctx, cancel := r.callContext()
+	defer cancel()
+	return r.Backend.CreateEntry(ctx, entry)
+}
+
+func (r *SpireUtils) getEntry(entryId string) (*common.RegistrationEntry, error) {
+	ctx, cancel := r.callContext()
+	defer cancel()
+	return r.Backend.GetEntry(ctx, entryId)
+}
 
-	return regEntryId.Id, nil
-}
\ No newline at end of file
+func (r *SpireUtils) updateEntry(entry *common.RegistrationEntry) (*common.RegistrationEntry, error) {
+	ctx, cancel := r.callContext()
+	defer cancel()
+	return r.Backend.UpdateEntry(ctx, entry)
+}
+
+// withParent returns a copy of the template entry with the parent and entry IDs filled in.
+func withParent(template *common.RegistrationEntry, parentId string, entryId string) *common.RegistrationEntry {
+	return &common.RegistrationEntry{
+		EntryId:       entryId,
+		ParentId:      parentId,
+		SpiffeId:      template.GetSpiffeId(),
+		Selectors:     template.GetSelectors(),
+		Ttl:           template.GetTtl(),
+		DnsNames:      template.GetDnsNames(),
+		Admin:         template.GetAdmin(),
+		Downstream:    template.GetDownstream(),
+		FederatesWith: template.GetFederatesWith(),
+	}
+}
+
+// entryMatches returns true if the entry has the same identity, parent, selectors and options as the desired
+// entry. Selectors, DNS names and federated trust domains are compared as sets, ignoring their ordering.
+func entryMatches(entry *common.RegistrationEntry, desired *common.RegistrationEntry) bool {
+	return entry.GetSpiffeId() == desired.GetSpiffeId() &&
+		entry.GetParentId() == desired.GetParentId() &&
+		entry.GetTtl() == desired.GetTtl() &&
+		entry.GetAdmin() == desired.GetAdmin() &&
+		entry.GetDownstream() == desired.GetDownstream() &&
+		SelectorsMatch(entry.GetSelectors(), desired.GetSelectors()) &&
+		stringSetsMatch(entry.GetDnsNames(), desired.GetDnsNames()) &&
+		stringSetsMatch(entry.GetFederatesWith(), desired.GetFederatesWith())
+}
+
+// EntryIsDuplicate returns true if the spire server would refuse to create the desired entry because of the
+// existing one, i.e. they have the same spiffe ID, parent and selectors.
+func EntryIsDuplicate(entry *common.RegistrationEntry, desired *common.RegistrationEntry) bool {
+	return entry.GetSpiffeId() == desired.GetSpiffeId() &&
+		entry.GetParentId() == desired.GetParentId() &&
+		SelectorsMatch(entry.GetSelectors(), desired.GetSelectors())
+}
+
+type selectorKey struct {
+	Type  string
+	Value string
+}
+
+// normalizeSelector splits selectors given as a single "type:value" string into their type and value, so
+// they compare equal to the same selector returned by the spire server.
+func normalizeSelector(sel *common.Selector) selectorKey {
+	if len(sel.GetType()) == 0 {
+		if parts := strings.SplitN(sel.GetValue(), ":", 2); len(parts) == 2 {
+			return selectorKey{parts[0], parts[1]}
+		}
+	}
+	return selectorKey{sel.GetType(), sel.GetValue()}
+}
+
+// SelectorsMatch compares two sets of selectors, ignoring ordering. Selectors given as a single "type:value"
+// string match the same selector split into its type and value.
+func SelectorsMatch(a []*common.Selector, b []*common.Selector) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	selectorSet := make(map[selectorKey]int, len(a))
+	for _, sel := range a {
+		selectorSet[normalizeSelector(sel)]++
+	}
+	for _, sel := range b {
+		key := normalizeSelector(sel)
+		if selectorSet[key] == 0 {
+			return false
+		}
+		selectorSet[key]--
+	}
+	return true
+}
+
+// stringSetsMatch compares two lists of strings as sets, ignoring ordering and duplicates.
+func stringSetsMatch(a []string, b []string) bool {
+	setA := make(map[string]bool, len(a))
+	for _, v := range a {
+		setA[v] = true
+	}
+	setB := make(map[string]bool, len(b))
+	for _, v := range b {
+		if !setA[v] {
+			return false
+		}
+		setB[v] = true
+	}
+	return len(setA) == len(setB)
+}
@@ -0,0 +1,333 @@
+package spiremgr
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/spiffe/spire/proto/spire/common"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const testParentId = "spiffe://example.org/spire-k8s-operator/test/node"
+
+func TestEntryMatches(t *testing.T) {
+	desired := &common.RegistrationEntry{
+		SpiffeId:      "spiffe://example.org/web",
+		ParentId:      testParentId,
+		Selectors:     []*common.Selector{{Type: "k8s", Value: "ns:default"}, {Type: "k8s", Value: "sa:web"}},
+		Ttl:           3600,
+		DnsNames:      []string{"web", "web.default.svc"},
+		FederatesWith: []string{"spiffe://other.org"},
+	}
+
+	tests := []struct {
+		name   string
+		modify func(*common.RegistrationEntry)
+		want   bool
+	}{
+		{name: "identical", modify: func(*common.RegistrationEntry) {}, want: true},
+		{name: "entry ID ignored", modify: func(e *common.RegistrationEntry) { e.EntryId = "other" }, want: true},
+		{name: "selectors reordered", modify: func(e *common.RegistrationEntry) {
+			e.Selectors = []*common.Selector{e.Selectors[1], e.Selectors[0]}
+		}, want: true},
+		{name: "DNS names reordered", modify: func(e *common.RegistrationEntry) { e.DnsNames = []string{"web.default.svc", "web"} }, want: true},
+		{name: "spiffe ID", modify: func(e *common.RegistrationEntry) { e.SpiffeId = "spiffe://example.org/api" }},
+		{name: "parent", modify: func(e *common.RegistrationEntry) { e.ParentId = "spiffe://example.org/other" }},
+		{name: "TTL", modify: func(e *common.RegistrationEntry) { e.Ttl = 60 }},
+		{name: "admin", modify: func(e *common.RegistrationEntry) { e.Admin = true }},
+		{name: "downstream", modify: func(e *common.RegistrationEntry) { e.Downstream = true }},
+		{name: "DNS names", modify: func(e *common.RegistrationEntry) { e.DnsNames = []string{"web"} }},
+		{name: "federates with", modify: func(e *common.RegistrationEntry) { e.FederatesWith = nil }},
+		{name: "selectors", modify: func(e *common.RegistrationEntry) { e.Selectors = e.Selectors[:1] }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry := copyEntry(desired)
+			tt.modify(entry)
+			if got := entryMatches(entry, desired); got != tt.want {
+				t.Errorf("entryMatches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectorsMatch(t *testing.T) {
+	tests := []struct {
+		name string
+		a    []*common.Selector
+		b    []*common.Selector
+		want bool
+	}{
+		{name: "both empty", want: true},
+		{
+			name: "same",
+			a:    []*common.Selector{{Type: "k8s", Value: "ns:default"}},
+			b:    []*common.Selector{{Type: "k8s", Value: "ns:default"}},
+			want: true,
+		},
+		{
+			name: "reordered",
+			a:    []*common.Selector{{Type: "k8s", Value: "ns:default"}, {Type: "k8s", Value: "sa:web"}},
+			b:    []*common.Selector{{Type: "k8s", Value: "sa:web"}, {Type: "k8s", Value: "ns:default"}},
+			want: true,
+		},
+		{
+			name: "type in value",
+			a:    []*common.Selector{{Value: "k8s:ns:default"}},
+			b:    []*common.Selector{{Type: "k8s", Value: "ns:default"}},
+			want: true,
+		},
+		{
+			name: "different value",
+			a:    []*common.Selector{{Type: "k8s", Value: "ns:default"}},
+			b:    []*common.Selector{{Type: "k8s", Value: "ns:other"}},
+		},
+		{
+			name: "different type",
+			a:    []*common.Selector{{Type: "k8s", Value: "ns:default"}},
+			b:    []*common.Selector{{Type: "unix", Value: "ns:default"}},
+		},
+		{
+			name: "subset",
+			a:    []*common.Selector{{Type: "k8s", Value: "ns:default"}},
+			b:    []*common.Selector{{Type: "k8s", Value: "ns:default"}, {Type: "k8s", Value: "sa:web"}},
+		},
+		{
+			name: "repeated",
+			a:    []*common.Selector{{Type: "k8s", Value: "ns:default"}, {Type: "k8s", Value: "ns:default"}},
+			b:    []*common.Selector{{Type: "k8s", Value: "ns:default"}, {Type: "k8s", Value: "sa:web"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SelectorsMatch(tt.a, tt.b); got != tt.want {
+				t.Errorf("SelectorsMatch() = %v, want %v", got, tt.want)
+			}
+			if got := SelectorsMatch(tt.b, tt.a); got != tt.want {
+				t.Errorf("SelectorsMatch() reversed = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetExistingEntry(t *testing.T) {
+	desired := &common.RegistrationEntry{
+		SpiffeId:  "spiffe://example.org/web",
+		ParentId:  testParentId,
+		Selectors: []*common.Selector{{Type: "k8s", Value: "ns:default"}},
+		Ttl:       3600,
+	}
+	duplicate := copyEntry(desired)
+	duplicate.Ttl = 60
+	other := copyEntry(desired)
+	other.SpiffeId = "spiffe://example.org/api"
+
+	tests := []struct {
+		name    string
+		entries []*common.RegistrationEntry
+		wantId  string
+		wantErr error
+	}{
+		{name: "none", wantErr: ExistingEntryNotFoundError},
+		{name: "unrelated", entries: []*common.RegistrationEntry{other}, wantErr: ExistingEntryNotFoundError},
+		{name: "match", entries: []*common.RegistrationEntry{other, desired}, wantId: "entry-2"},
+		{name: "duplicate", entries: []*common.RegistrationEntry{duplicate}, wantId: "entry-1"},
+		{name: "match preferred to duplicate", entries: []*common.RegistrationEntry{duplicate, desired}, wantId: "entry-2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestUtils(newTestBackend(tt.entries...))
+
+			entry, err := r.getExistingEntry(logf.Log, desired)
+			if err != tt.wantErr {
+				t.Fatalf("getExistingEntry() error = %v, want %v", err, tt.wantErr)
+			}
+			if entry.GetEntryId() != tt.wantId {
+				t.Errorf("getExistingEntry() = %q, want %q", entry.GetEntryId(), tt.wantId)
+			}
+		})
+	}
+}
+
+func TestGetOrCreateEntry(t *testing.T) {
+	template := &common.RegistrationEntry{
+		SpiffeId:  "spiffe://example.org/web",
+		Selectors: []*common.Selector{{Type: "k8s", Value: "ns:default"}},
+		Ttl:       3600,
+		DnsNames:  []string{"web"},
+	}
+	desired := withParent(template, testParentId, "")
+	duplicate := copyEntry(desired)
+	duplicate.Ttl = 60
+	duplicate.DnsNames = nil
+	duplicate.Admin = true
+
+	tests := []struct {
+		name string
+		// entries which exist before the create
+		entries []*common.RegistrationEntry
+		// whether the backend returns the existing entry's ID along with AlreadyExists
+		reportsExisting bool
+		// deletes the existing entry once the create has failed
+		deleteExisting bool
+		wantId         string
+		wantReused     bool
+		wantUpdates    int
+	}{
+		{name: "create", wantId: "entry-2"},
+		{name: "adopt match", entries: []*common.RegistrationEntry{desired}, wantId: "entry-2", wantReused: true},
+		{name: "adopt match by ID", entries: []*common.RegistrationEntry{desired}, reportsExisting: true, wantId: "entry-2", wantReused: true},
+		{name: "adopt and update duplicate", entries: []*common.RegistrationEntry{duplicate}, wantId: "entry-2", wantReused: true, wantUpdates: 1},
+		{name: "adopt and update duplicate by ID", entries: []*common.RegistrationEntry{duplicate}, reportsExisting: true, wantId: "entry-2", wantReused: true, wantUpdates: 1},
+		{name: "existing entry disappears", entries: []*common.RegistrationEntry{desired}, deleteExisting: true, wantId: "entry-3"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The operator's parent entry is entry-1
+			backend := newTestBackend(&common.RegistrationEntry{SpiffeId: testParentId})
+			backend.reportsExisting = tt.reportsExisting
+			r := newTestUtils(backend)
+			for _, entry := range tt.entries {
+				backend.add(entry)
+			}
+			if tt.deleteExisting {
+				backend.afterAlreadyExists = func() { delete(backend.entries, "entry-2") }
+			}
+
+			entryId, reused, err := r.GetOrCreateEntry(logf.Log, template)
+			if err != nil {
+				t.Fatalf("GetOrCreateEntry() error = %v", err)
+			}
+			if entryId != tt.wantId || reused != tt.wantReused {
+				t.Errorf("GetOrCreateEntry() = %q, %v, want %q, %v", entryId, reused, tt.wantId, tt.wantReused)
+			}
+			if backend.updates != tt.wantUpdates {
+				t.Errorf("GetOrCreateEntry() made %d updates, want %d", backend.updates, tt.wantUpdates)
+			}
+			if entry := backend.entries[entryId]; !entryMatches(entry, desired) {
+				t.Errorf("entry %s = %v, want it to match %v", entryId, entry, desired)
+			}
+		})
+	}
+}
+
+// newTestUtils returns SpireUtils whose parent entry is testParentId
+func newTestUtils(backend Backend) *SpireUtils {
+	myId := testParentId
+	return &SpireUtils{Backend: backend, TrustDomain: "example.org", Cluster: "test", myId: &myId}
+}
+
+// testBackend is an in-memory Backend which refuses duplicate entries like the spire server
+type testBackend struct {
+	entries map[string]*common.RegistrationEntry
+	nextId  int
+	// return the ID of the existing entry along with AlreadyExists, like the entry/v1 API
+	reportsExisting bool
+	// called when a create fails with AlreadyExists
+	afterAlreadyExists func()
+	updates            int
+}
+
+var _ Backend = &testBackend{}
+
+func newTestBackend(entries ...*common.RegistrationEntry) *testBackend {
+	backend := &testBackend{entries: map[string]*common.RegistrationEntry{}}
+	for _, entry := range entries {
+		backend.add(entry)
+	}
+	return backend
+}
+
+func (b *testBackend) add(entry *common.RegistrationEntry) string {
+	b.nextId++
+	entry = copyEntry(entry)
+	entry.EntryId = fmt.Sprintf("entry-%d", b.nextId)
+	b.entries[entry.EntryId] = entry
+	return entry.EntryId
+}
+
+func (b *testBackend) CreateEntry(_ context.Context, entry *common.RegistrationEntry) (string, error) {
+	for _, existing := range b.entries {
+		if EntryIsDuplicate(existing, entry) {
+			existingId := ""
+			if b.reportsExisting {
+				existingId = existing.EntryId
+			}
+			if b.afterAlreadyExists != nil {
+				b.afterAlreadyExists()
+				b.afterAlreadyExists = nil
+			}
+			return existingId, status.Error(codes.AlreadyExists, "entry already exists")
+		}
+	}
+	return b.add(entry), nil
+}
+
+func (b *testBackend) UpdateEntry(_ context.Context, entry *common.RegistrationEntry) (*common.RegistrationEntry, error) {
+	if _, ok := b.entries[entry.EntryId]; !ok {
+		return nil, status.Error(codes.NotFound, "no such entry")
+	}
+	b.updates++
+	b.entries[entry.EntryId] = copyEntry(entry)
+	return copyEntry(entry), nil
+}
+
+func (b *testBackend) DeleteEntry(_ context.Context, entryId string) error {
+	if _, ok := b.entries[entryId]; !ok {
+		return status.Error(codes.NotFound, "no such entry")
+	}
+	delete(b.entries, entryId)
+	return nil
+}
+
+func (b *testBackend) DeleteEntries(ctx context.Context, entryIds []string) (map[string]error, error) {
+	failed := map[string]error{}
+	for _, entryId := range entryIds {
+		if err := b.DeleteEntry(ctx, entryId); err != nil {
+			failed[entryId] = err
+		}
+	}
+	return failed, nil
+}
+
+func (b *testBackend) GetEntry(_ context.Context, entryId string) (*common.RegistrationEntry, error) {
+	entry, ok := b.entries[entryId]
+	if !ok {
+		return nil, status.Error(codes.NotFound, "no such entry")
+	}
+	return copyEntry(entry), nil
+}
+
+func (b *testBackend) ListEntries(_ context.Context, parentId string) ([]*common.RegistrationEntry, error) {
+	var entries []*common.RegistrationEntry
+	// In ID order, so tests can rely on which of several entries is found first
+	for i := 1; i <= b.nextId; i++ {
+		if entry, ok := b.entries[fmt.Sprintf("entry-%d", i)]; ok && entry.ParentId == parentId {
+			entries = append(entries, copyEntry(entry))
+		}
+	}
+	return entries, nil
+}
+
+func (b *testBackend) EnsureParent(ctx context.Context, parent *common.RegistrationEntry) error {
+	_, err := b.CreateEntry(ctx, parent)
+	if status.Code(err) == codes.AlreadyExists {
+		return nil
+	}
+	return err
+}
+
+func copyEntry(entry *common.RegistrationEntry) *common.RegistrationEntry {
+	copied := withParent(entry, entry.GetParentId(), entry.GetEntryId())
+	copied.Selectors = append([]*common.Selector(nil), entry.GetSelectors()...)
+	copied.DnsNames = append([]string(nil), entry.GetDnsNames()...)
+	copied.FederatesWith = append([]string(nil), entry.GetFederatesWith()...)
+	return copied
+}
@@ -0,0 +1,127 @@
+package spiremgr
+
+import (
+	"context"
+	"github.com/go-logr/logr"
+	spiffeidv1alpha1 "github.com/transferwise/spire-k8s-operator/pkg/apis/spiffeid/v1alpha1"
+	"github.com/transferwise/spire-k8s-operator/pkg/metrics"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"time"
+)
+
+// Reasons reported on SpiffeId conditions
+const (
+	ReasonEntrySynced     = "EntrySynced"
+	ReasonEntryRepaired   = "EntryRepaired"
+	ReasonSpireError      = "SpireError"
+	ReasonFinalizerFailed = "FinalizerFailed"
+	ReasonInvalidSpec     = "InvalidSpec"
+	ReasonPolicyViolation = "PolicyViolation"
+	ReasonPolicyDenied    = "PolicyDenied"
+)
+
+type StatusUpdater struct {
+	Client client.Client
+	// Controller name used to label the out of sync metric
+	Controller string
+	// How old LastSyncTime may get before it is refreshed. Zero only writes the status when it changes.
+	RefreshInterval time.Duration
+}
+
+// SetSynced records a successful sync of the spire entry. The status is only written when something
+// other than the sync time changes (or the sync time is older than RefreshInterval), so that status
+// updates don't trigger reconcile loops.
+func (r *StatusUpdater) SetSynced(reqLogger logr.Logger, instance spiffeidv1alpha1.CommonSpiffeId, entryId string, reason string, message string) error {
+	metrics.SetOutOfSync(r.Controller, keyOf(instance), false)
+
+	status := instance.GetStatus()
+	changed := status.EntryId != entryId || status.ObservedGeneration != instance.GetGeneration() || status.LastSyncTime == nil
+	if r.RefreshInterval > 0 && status.LastSyncTime != nil && time.Since(status.LastSyncTime.Time) >= r.RefreshInterval {
+		changed = true
+	}
+
+	// The entry now matches the spec, so it is federated with exactly the trust domains in the spec
+	federatesWith := instance.GetSpec().FederatesWith
+	if len(status.FederatesWith) != len(federatesWith) || !stringSetsMatch(status.FederatesWith, federatesWith) {
+		changed = true
+	}
+
+	status.EntryId = entryId
+	status.FederatesWith = append([]string(nil), federatesWith...)
+	status.ObservedGeneration = instance.GetGeneration()
+	if status.SetCondition(spiffeidv1alpha1.SpiffeIdReady, corev1.ConditionTrue, ReasonEntrySynced, "Spire entry matches the spec") {
+		changed = true
+	}
+	if status.SetCondition(spiffeidv1alpha1.SpiffeIdSynced, corev1.ConditionTrue, reason, message) {
+		changed = true
+	}
+	if status.SetCondition(spiffeidv1alpha1.SpiffeIdDegraded, corev1.ConditionFalse, ReasonEntrySynced, "") {
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+
+	now := v1.Now()
+	status.LastSyncTime = &now
+	return r.update(reqLogger, instance)
+}
+
+// SetFailed records a failed reconcile along with the reason and error. ObservedGeneration is left alone, as it
+// only moves once a generation has been applied to the spire entry, and Ready is False while the entry is missing
+// or behind the spec. Failing to write the status is logged but not returned, as the original error is the one
+// worth requeueing for.
+func (r *StatusUpdater) SetFailed(reqLogger logr.Logger, instance spiffeidv1alpha1.CommonSpiffeId, reason string, cause error) {
+	metrics.SetOutOfSync(r.Controller, keyOf(instance), true)
+
+	status := instance.GetStatus()
+	changed := false
+	if len(status.EntryId) == 0 || status.ObservedGeneration != instance.GetGeneration() {
+		if status.SetCondition(spiffeidv1alpha1.SpiffeIdReady, corev1.ConditionFalse, reason, cause.Error()) {
+			changed = true
+		}
+	}
+	if status.SetCondition(spiffeidv1alpha1.SpiffeIdSynced, corev1.ConditionFalse, reason, cause.Error()) {
+		changed = true
+	}
+	if status.SetCondition(spiffeidv1alpha1.SpiffeIdDegraded, corev1.ConditionTrue, reason, cause.Error()) {
+		changed = true
+	}
+	if !changed {
+		return
+	}
+
+	_ = r.update(reqLogger, instance)
+}
+
+// ClearEntry records that the instance no longer has a spire entry, after the entry has been deleted.
+func (r *StatusUpdater) ClearEntry(reqLogger logr.Logger, instance spiffeidv1alpha1.CommonSpiffeId) error {
+	status := instance.GetStatus()
+	if len(status.EntryId) == 0 {
+		return nil
+	}
+	status.EntryId = ""
+	status.FederatesWith = nil
+	return r.update(reqLogger, instance)
+}
+
+// Forget stops counting a deleted instance as out of sync.
+func (r *StatusUpdater) Forget(instance spiffeidv1alpha1.CommonSpiffeId) {
+	metrics.ForgetOutOfSync(r.Controller, keyOf(instance))
+}
+
+func keyOf(instance v1.Object) types.NamespacedName {
+	return types.NamespacedName{Namespace: instance.GetNamespace(), Name: instance.GetName()}
+}
+
+func (r *StatusUpdater) update(reqLogger logr.Logger, instance spiffeidv1alpha1.CommonSpiffeId) error {
+	err := r.Client.Status().Update(context.TODO(), instance)
+	if err != nil {
+		reqLogger.Error(err, "Failed to update SpiffeId status", "entryID", instance.GetStatus().EntryId)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package spiremgr
+
+import (
+	"fmt"
+	spiffeidv1alpha1 "github.com/transferwise/spire-k8s-operator/pkg/apis/spiffeid/v1alpha1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"net/url"
+	"strings"
+)
+
+// Validator checks SpiffeIds against the operator's configuration. It is shared by the reconcilers and the
+// admission webhook so that both reject the same objects for the same reasons.
+type Validator struct {
+	TrustDomain string
+	// Patterns the spiffe IDs of namespaced SpiffeIds must match. Empty allows any ID.
+	AllowablePatterns []string
+}
+
+// Validate returns all the problems with a SpiffeId or ClusterSpiffeId.
+func (v *Validator) Validate(instance spiffeidv1alpha1.CommonSpiffeId) field.ErrorList {
+	specPath := field.NewPath("spec")
+	spec := instance.GetSpec()
+
+	allErrs := ValidateSpec(spec, specPath)
+	allErrs = append(allErrs, ValidateSelector(&spec.Selector, instance.GetNamespace(), specPath.Child("selector"))...)
+
+	if u, err := ParseSpiffeId(spec.SpiffeId); err == nil && len(v.TrustDomain) > 0 && u.Host != v.TrustDomain {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("spiffeId"), spec.SpiffeId, fmt.Sprintf("must be in the %s trust domain", v.TrustDomain)))
+	}
+
+	return allErrs
+}
+
+// CheckPolicy returns the ways in which a SpiffeId breaks the operator's policy, such as requesting a spiffe
+// ID its namespace isn't allowed to use. Cluster scoped IDs are managed by cluster admins and aren't restricted.
+func (v *Validator) CheckPolicy(instance spiffeidv1alpha1.CommonSpiffeId) field.ErrorList {
+	allErrs := field.ErrorList{}
+
+	namespace := instance.GetNamespace()
+	if len(namespace) == 0 || len(v.AllowablePatterns) == 0 {
+		return allErrs
+	}
+
+	spiffeId := instance.GetSpec().SpiffeId
+	expanded := make([]string, 0, len(v.AllowablePatterns))
+	for _, pattern := range v.AllowablePatterns {
+		expandedPattern := ExpandPattern(pattern, v.TrustDomain, namespace)
+		if MatchPattern(expandedPattern, spiffeId) {
+			return allErrs
+		}
+		expanded = append(expanded, expandedPattern)
+	}
+
+	msg := fmt.Sprintf("spiffe IDs in namespace %s must match one of: %s", namespace, strings.Join(expanded, ", "))
+	return append(allErrs, field.Forbidden(field.NewPath("spec", "spiffeId"), msg))
+}
+
+// ValidateSpec checks a SpiffeIdSpec for problems the spire server would reject, or which would produce
+// unusable SVIDs.
+func ValidateSpec(spec *spiffeidv1alpha1.SpiffeIdSpec, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+
+	if _, err := ParseSpiffeId(spec.SpiffeId); err != nil {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("spiffeId"), spec.SpiffeId, err.Error()))
+	}
+
+	if spec.Ttl < 0 {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("ttl"), spec.Ttl, "must be greater than or equal to 0"))
+	}
+
+	seen := map[string]bool{}
+	for i, dnsName := range spec.DnsNames {
+		idxPath := fldPath.Child("dnsNames").Index(i)
+		if seen[dnsName] {
+			allErrs = append(allErrs, field.Duplicate(idxPath, dnsName))
+			continue
+		}
+		seen[dnsName] = true
+		for _, msg := range validateDnsName(dnsName) {
+			allErrs = append(allErrs, field.Invalid(idxPath, dnsName, msg))
+		}
+	}
+
+	seen = map[string]bool{}
+	for i, trustDomain := range spec.FederatesWith {
+		idxPath := fldPath.Child("federatesWith").Index(i)
+		if seen[trustDomain] {
+			allErrs = append(allErrs, field.Duplicate(idxPath, trustDomain))
+			continue
+		}
+		seen[trustDomain] = true
+		if err := ValidateTrustDomainId(trustDomain); err != nil {
+			allErrs = append(allErrs, field.Invalid(idxPath, trustDomain, err.Error()))
+		}
+	}
+
+	return allErrs
+}
+
+// ValidateSelector checks that a selector will produce a usable set of spire selectors. Namespace is empty for
+// cluster scoped IDs. Namespaced IDs always get a namespace selector, so only cluster scoped IDs can end up
+// with no selectors at all.
+func ValidateSelector(selector *spiffeidv1alpha1.Selector, namespace string, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+
+	if len(namespace) == 0 {
+		if len(selector.PodLabel) == 0 && len(selector.PodName) == 0 && len(selector.Namespace) == 0 &&
+			len(selector.ServiceAccount) == 0 && len(selector.Arbitrary) == 0 {
+			allErrs = append(allErrs, field.Required(fldPath, "at least one selector is required"))
+		}
+	}
+
+	for k, v := range selector.PodLabel {
+		for _, msg := range validation.IsQualifiedName(k) {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("podLabel"), k, msg))
+		}
+		for _, msg := range validation.IsValidLabelValue(v) {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("podLabel").Key(k), v, msg))
+		}
+	}
+
+	for i, arbitrary := range selector.Arbitrary {
+		if err := ValidateArbitrarySelector(arbitrary); err != nil {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("arbitrary").Index(i), arbitrary, err.Error()))
+		}
+	}
+
+	return allErrs
+}
+
+// ValidateArbitrarySelector checks that a raw selector has the type:value form spire expects, e.g. k8s:ns:default
+func ValidateArbitrarySelector(selector string) error {
+	parts := strings.SplitN(selector, ":", 2)
+	if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		return fmt.Errorf("must be of the form type:value")
+	}
+	if strings.ContainsAny(selector, " \t\r\n") {
+		return fmt.Errorf("must not contain whitespace")
+	}
+	return nil
+}
+
+// ValidateTrustDomainId checks that id is the SPIFFE ID of a trust domain, e.g. spiffe://example.org
+func ValidateTrustDomainId(id string) error {
+	u, err := ParseSpiffeId(id)
+	if err != nil {
+		return err
+	}
+	if len(u.Path) > 0 {
+		return fmt.Errorf("must be a trust domain ID without a path, e.g. spiffe://%s", u.Host)
+	}
+	return nil
+}
+
+// ParseSpiffeId parses and checks a SPIFFE ID, e.g. spiffe://example.org/ns/default/sa/default
+func ParseSpiffeId(id string) (*url.URL, error) {
+	if len(id) == 0 {
+		return nil, fmt.Errorf("must not be empty")
+	}
+	u, err := url.Parse(id)
+	if err != nil {
+		return nil, fmt.Errorf("not a valid URI: %v", err)
+	}
+	if u.Scheme != "spiffe" {
+		return nil, fmt.Errorf("scheme must be spiffe")
+	}
+	if len(u.Host) == 0 {
+		return nil, fmt.Errorf("trust domain must not be empty")
+	}
+	if u.User != nil || len(u.Port()) > 0 {
+		return nil, fmt.Errorf("trust domain must not contain user info or a port")
+	}
+	if len(u.RawQuery) > 0 || len(u.Fragment) > 0 {
+		return nil, fmt.Errorf("must not contain a query or fragment")
+	}
+	// Pattern matching works on the segments as written, so they mustn't be able to climb out of a prefix
+	if len(u.Path) > 0 {
+		for _, segment := range strings.Split(strings.TrimPrefix(u.Path, "/"), "/") {
+			if len(segment) == 0 || segment == "." || segment == ".." {
+				return nil, fmt.Errorf("path must not have empty, . or .. segments")
+			}
+		}
+	}
+	return u, nil
+}
+
+func validateDnsName(dnsName string) []string {
+	// A single leading wildcard label is allowed, e.g. *.example.org
+	name := strings.TrimPrefix(dnsName, "*.")
+	return validation.IsDNS1123Subdomain(name)
+}
@@ -0,0 +1,257 @@
+//go:build integration
+// +build integration
+
+// Package testenv runs the operator's controllers against a local kube-apiserver and etcd started by
+// controller-runtime's envtest, with an in-memory spire server in place of a real one. It's only built with the
+// integration tag, for the integration tests of the controller packages.
+package testenv
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/spiffe/spire/proto/spire/api/registration"
+	"github.com/spiffe/spire/proto/spire/common"
+	"github.com/transferwise/spire-k8s-operator/pkg/apis"
+	spiffeidv1alpha1 "github.com/transferwise/spire-k8s-operator/pkg/apis/spiffeid/v1alpha1"
+	"github.com/transferwise/spire-k8s-operator/pkg/controller/clusterspiffeid"
+	"github.com/transferwise/spire-k8s-operator/pkg/controller/clusterspiffeidtemplate"
+	"github.com/transferwise/spire-k8s-operator/pkg/controller/pod"
+	SpiffeId "github.com/transferwise/spire-k8s-operator/pkg/controller/spiffeid"
+	"github.com/transferwise/spire-k8s-operator/pkg/spiremgr"
+	"github.com/transferwise/spire-k8s-operator/pkg/spiremgr/fakespire"
+	"google.golang.org/grpc"
+	corev1 "k8s.io/api/core/v1"
+	k8errors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/envtest"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+const (
+	DefaultTrustDomain = "example.org"
+	DefaultCluster     = "envtest"
+
+	// CRDDir is deploy/crds relative to the controller packages, where their tests run
+	CRDDir = "../../../deploy/crds"
+
+	pollInterval = 100 * time.Millisecond
+)
+
+// Environment is a running kube-apiserver with the operator's CRDs installed, the operator's controllers and a
+// fake spire server.
+type Environment struct {
+	// Config for talking to the kube-apiserver
+	Config *rest.Config
+	// Client which reads directly from the kube-apiserver, rather than a cache
+	Client client.Client
+	// Spire server the controllers create entries in
+	Spire *fakespire.Server
+
+	TrustDomain string
+	Cluster     string
+	// How long WaitFor waits before giving up
+	Timeout time.Duration
+
+	env       *envtest.Environment
+	scheme    *runtime.Scheme
+	spireConn *grpc.ClientConn
+	stop      chan struct{}
+	done      chan error
+}
+
+// Start starts the kube-apiserver, installs the CRDs found in crdDir (usually CRDDir) and starts the
+// controllers. The kube-apiserver and etcd binaries are found using the KUBEBUILDER_ASSETS environment variable.
+func Start(crdDir string) (*Environment, error) {
+	e := &Environment{
+		Spire:       fakespire.New(),
+		TrustDomain: DefaultTrustDomain,
+		Cluster:     DefaultCluster,
+		Timeout:     30 * time.Second,
+		env: &envtest.Environment{
+			CRDDirectoryPaths: []string{filepath.Clean(crdDir)},
+		},
+	}
+
+	cfg, err := e.env.Start()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start kube-apiserver: %v", err)
+	}
+	e.Config = cfg
+
+	e.scheme = runtime.NewScheme()
+	if err := scheme.AddToScheme(e.scheme); err != nil {
+		e.Stop()
+		return nil, err
+	}
+	if err := apis.AddToScheme(e.scheme); err != nil {
+		e.Stop()
+		return nil, err
+	}
+
+	e.Client, err = client.New(cfg, client.Options{Scheme: e.scheme})
+	if err != nil {
+		e.Stop()
+		return nil, err
+	}
+
+	e.spireConn, err = e.Spire.Start()
+	if err != nil {
+		e.Stop()
+		return nil, fmt.Errorf("failed to start fake spire server: %v", err)
+	}
+
+	if err := e.startManager(); err != nil {
+		e.Stop()
+		return nil, err
+	}
+	return e, nil
+}
+
+// Restart stops the controllers and starts them again with fresh state, as happens when the operator restarts.
+// The kube-apiserver and spire server keep running.
+func (e *Environment) Restart() error {
+	if err := e.stopManager(); err != nil {
+		return err
+	}
+	return e.startManager()
+}
+
+// Stop stops the controllers, the spire server and the kube-apiserver.
+func (e *Environment) Stop() error {
+	if err := e.stopManager(); err != nil {
+		return err
+	}
+	if e.spireConn != nil {
+		e.spireConn.Close()
+	}
+	e.Spire.Stop()
+	return e.env.Stop()
+}
+
+// WaitFor polls the condition until it returns true, returns an error, or e.Timeout passes.
+func (e *Environment) WaitFor(description string, condition wait.ConditionFunc) error {
+	if err := wait.PollImmediate(pollInterval, e.Timeout, condition); err != nil {
+		return fmt.Errorf("timed out waiting for %s: %v", description, err)
+	}
+	return nil
+}
+
+func (e *Environment) startManager() error {
+	mgr, err := manager.New(e.Config, manager.Options{
+		Scheme:             e.scheme,
+		MetricsBindAddress: "0",
+	})
+	if err != nil {
+		return err
+	}
+
+	backend := &spiremgr.RegistrationBackend{Client: registration.NewRegistrationClient(e.spireConn)}
+
+	if err := clusterspiffeid.Add(mgr, backend, clusterspiffeid.ReconcileClusterSpiffeIdConfig{
+		TrustDomain: e.TrustDomain,
+		Cluster:     e.Cluster,
+	}); err != nil {
+		return err
+	}
+	if err := SpiffeId.Add(mgr, backend, SpiffeId.ReconcileSpiffeIdConfig{
+		TrustDomain: e.TrustDomain,
+		Cluster:     e.Cluster,
+	}); err != nil {
+		return err
+	}
+	if err := pod.Add(mgr, pod.PodReconcilerConfig{
+		TrustDomain: e.TrustDomain,
+		Mode:        pod.PodReconcilerModeServiceAccount,
+	}); err != nil {
+		return err
+	}
+
+	if err := clusterspiffeidtemplate.Add(mgr, clusterspiffeidtemplate.ReconcileClusterSpiffeIdTemplateConfig{
+		TrustDomain: e.TrustDomain,
+	}); err != nil {
+		return err
+	}
+
+	e.stop = make(chan struct{})
+	e.done = make(chan error, 1)
+	go func() {
+		e.done <- mgr.Start(e.stop)
+	}()
+	return nil
+}
+
+func (e *Environment) stopManager() error {
+	if e.stop == nil {
+		return nil
+	}
+	close(e.stop)
+	err := <-e.done
+	e.stop = nil
+	e.done = nil
+	return err
+}
+
+// CreateNamespace creates a namespace, which may already exist, and returns its name.
+func (e *Environment) CreateNamespace(name string) (string, error) {
+	err := e.Client.Create(context.TODO(), &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}})
+	if err != nil && !k8errors.IsAlreadyExists(err) {
+		return "", err
+	}
+	return name, nil
+}
+
+// NewSpiffeId returns a SpiffeId in the namespace selecting pods labelled with app: name.
+func (e *Environment) NewSpiffeId(namespace string, name string) *spiffeidv1alpha1.SpiffeId {
+	return &spiffeidv1alpha1.SpiffeId{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Spec: spiffeidv1alpha1.SpiffeIdSpec{
+			SpiffeId: fmt.Sprintf("spiffe://%s/ns/%s/%s", e.TrustDomain, namespace, name),
+			Selector: spiffeidv1alpha1.Selector{
+				PodLabel: map[string]string{"app": name},
+			},
+		},
+	}
+}
+
+// WaitForEntry waits until the instance reports an entry ID in its status which exists in the spire server,
+// refreshing the instance as it goes, and returns the entry.
+func (e *Environment) WaitForEntry(instance spiffeidv1alpha1.CommonSpiffeId) (*common.RegistrationEntry, error) {
+	var entry *common.RegistrationEntry
+	err := e.WaitFor(fmt.Sprintf("entry for %s", instance.GetName()), func() (bool, error) {
+		if err := e.Client.Get(context.TODO(), KeyOf(instance), instance); err != nil {
+			return false, err
+		}
+		entryId := instance.GetStatus().EntryId
+		if len(entryId) == 0 {
+			return false, nil
+		}
+		entry = e.Spire.Entry(entryId)
+		return entry != nil, nil
+	})
+	return entry, err
+}
+
+// WaitForDeletion waits until the object no longer exists.
+func (e *Environment) WaitForDeletion(obj runtime.Object, key types.NamespacedName) error {
+	return e.WaitFor(fmt.Sprintf("%s to be deleted", key), func() (bool, error) {
+		err := e.Client.Get(context.TODO(), key, obj)
+		if k8errors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	})
+}
+
+// KeyOf returns the namespace and name of an object.
+func KeyOf(instance metav1.Object) types.NamespacedName {
+	return types.NamespacedName{Namespace: instance.GetNamespace(), Name: instance.GetName()}
+}
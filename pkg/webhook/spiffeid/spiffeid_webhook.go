@@ -0,0 +1,109 @@
+package spiffeid
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+
+	spiffeidv1alpha1 "github.com/transferwise/spire-k8s-operator/pkg/apis/spiffeid/v1alpha1"
+	"github.com/transferwise/spire-k8s-operator/pkg/spiremgr"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+const (
+	SpiffeIdPath        = "/validate-spiffeid"
+	ClusterSpiffeIdPath = "/validate-clusterspiffeid"
+)
+
+var log = logf.Log.WithName("webhook_spiffeid")
+
+type SpiffeIdValidatorConfig struct {
+	TrustDomain       string
+	AllowablePatterns []string
+}
+
+// Add registers the SpiffeId and ClusterSpiffeId validating webhooks with the Manager's webhook server.
+func Add(mgr manager.Manager, conf SpiffeIdValidatorConfig) error {
+	decoder, err := admission.NewDecoder(mgr.GetScheme())
+	if err != nil {
+		return err
+	}
+	validator := spiremgr.Validator{TrustDomain: conf.TrustDomain, AllowablePatterns: conf.AllowablePatterns}
+	policy := spiremgr.PolicyEvaluator{Client: mgr.GetClient()}
+
+	server := mgr.GetWebhookServer()
+	server.Register(SpiffeIdPath, &webhook.Admission{Handler: &spiffeIdValidator{
+		decoder:   decoder,
+		validator: validator,
+		policy:    policy,
+		newObject: func() spiffeidv1alpha1.CommonSpiffeId { return &spiffeidv1alpha1.SpiffeId{} },
+	}})
+	server.Register(ClusterSpiffeIdPath, &webhook.Admission{Handler: &spiffeIdValidator{
+		decoder:   decoder,
+		validator: validator,
+		policy:    policy,
+		newObject: func() spiffeidv1alpha1.CommonSpiffeId { return &spiffeidv1alpha1.ClusterSpiffeId{} },
+	}})
+	return nil
+}
+
+// spiffeIdValidator rejects SpiffeIds which the reconciler would be unable to create entries for
+type spiffeIdValidator struct {
+	decoder   *admission.Decoder
+	validator spiremgr.Validator
+	policy    spiremgr.PolicyEvaluator
+	newObject func() spiffeidv1alpha1.CommonSpiffeId
+}
+
+// blank assignment to verify that spiffeIdValidator implements admission.Handler
+var _ admission.Handler = &spiffeIdValidator{}
+
+func (v *spiffeIdValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	reqLogger := log.WithValues("Request.Namespace", req.Namespace, "Request.Name", req.Name, "Request.Operation", req.Operation)
+
+	if req.Operation == admissionv1beta1.Delete {
+		return admission.Allowed("")
+	}
+
+	instance := v.newObject()
+	if err := v.decoder.Decode(req, instance); err != nil {
+		reqLogger.Error(err, "Failed to decode SpiffeId")
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	if req.Operation == admissionv1beta1.Update {
+		// Objects being deleted must always be allowed through so that their finalizers can be removed
+		if instance.GetDeletionTimestamp() != nil {
+			return admission.Allowed("")
+		}
+		// Don't block metadata or status updates to objects created before validation was enabled
+		old := v.newObject()
+		if err := json.Unmarshal(req.OldObject.Raw, old); err != nil {
+			reqLogger.Error(err, "Failed to decode old SpiffeId")
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		if reflect.DeepEqual(old.GetSpec(), instance.GetSpec()) {
+			return admission.Allowed("")
+		}
+	}
+
+	errs := v.validator.Validate(instance)
+	errs = append(errs, v.validator.CheckPolicy(instance)...)
+	denials, err := v.policy.Evaluate(instance)
+	if err != nil {
+		reqLogger.Error(err, "Failed to evaluate SpiffeIdPolicies")
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	errs = append(errs, denials...)
+	if len(errs) > 0 {
+		reqLogger.Info("Rejected invalid SpiffeId", "error", errs.ToAggregate().Error())
+		return admission.Denied(errs.ToAggregate().Error())
+	}
+
+	return admission.Allowed("")
+}
@@ -0,0 +1,128 @@
+package spiffeid
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/transferwise/spire-k8s-operator/pkg/apis"
+	spiffeidv1alpha1 "github.com/transferwise/spire-k8s-operator/pkg/apis/spiffeid/v1alpha1"
+	"github.com/transferwise/spire-k8s-operator/pkg/spiremgr"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func TestHandle(t *testing.T) {
+	valid := spiffeidv1alpha1.SpiffeIdSpec{
+		SpiffeId: "spiffe://example.org/ns/default/app/web",
+		Selector: spiffeidv1alpha1.Selector{PodLabel: map[string]string{"app": "web"}},
+	}
+	foreign := valid
+	foreign.SpiffeId = "spiffe://other.org/ns/default/app/web"
+	badArbitrary := valid
+	badArbitrary.Selector = spiffeidv1alpha1.Selector{Arbitrary: []string{"k8s:ns:default", "no-type"}}
+	now := metav1.Now()
+
+	tests := []struct {
+		name      string
+		operation admissionv1beta1.Operation
+		// whether the object is a ClusterSpiffeId rather than a SpiffeId
+		cluster bool
+		spec    spiffeidv1alpha1.SpiffeIdSpec
+		// spec of the object being updated
+		oldSpec  *spiffeidv1alpha1.SpiffeIdSpec
+		deleting bool
+		want     bool
+	}{
+		{name: "valid", operation: admissionv1beta1.Create, spec: valid, want: true},
+		{name: "foreign trust domain", operation: admissionv1beta1.Create, spec: foreign},
+		{name: "cluster foreign trust domain", operation: admissionv1beta1.Create, cluster: true, spec: foreign},
+		{
+			name:      "cluster without selectors",
+			operation: admissionv1beta1.Create,
+			cluster:   true,
+			spec:      spiffeidv1alpha1.SpiffeIdSpec{SpiffeId: valid.SpiffeId},
+		},
+		{name: "bad arbitrary selector", operation: admissionv1beta1.Create, cluster: true, spec: badArbitrary},
+		{name: "update to invalid spec", operation: admissionv1beta1.Update, spec: foreign, oldSpec: &valid},
+		// Objects created before validation was enabled can still have their metadata and status updated
+		{name: "update leaving invalid spec unchanged", operation: admissionv1beta1.Update, spec: foreign, oldSpec: &foreign, want: true},
+		{name: "update while deleting", operation: admissionv1beta1.Update, spec: foreign, oldSpec: &valid, deleting: true, want: true},
+		{name: "delete", operation: admissionv1beta1.Delete, spec: foreign, want: true},
+	}
+
+	scheme := runtime.NewScheme()
+	if err := apis.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	decoder, err := admission.NewDecoder(scheme)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newObject := func() spiffeidv1alpha1.CommonSpiffeId { return &spiffeidv1alpha1.SpiffeId{} }
+			if tt.cluster {
+				newObject = func() spiffeidv1alpha1.CommonSpiffeId { return &spiffeidv1alpha1.ClusterSpiffeId{} }
+			}
+			v := &spiffeIdValidator{
+				decoder:   decoder,
+				validator: spiremgr.Validator{TrustDomain: "example.org"},
+				policy:    spiremgr.PolicyEvaluator{Client: fake.NewFakeClientWithScheme(scheme)},
+				newObject: newObject,
+			}
+
+			req := admission.Request{AdmissionRequest: admissionv1beta1.AdmissionRequest{
+				Name:      "web",
+				Operation: tt.operation,
+			}}
+			if !tt.cluster {
+				req.Namespace = "default"
+			}
+			object := newTestObject(tt.cluster, tt.spec)
+			if tt.deleting {
+				object.SetDeletionTimestamp(&now)
+			}
+			if tt.operation == admissionv1beta1.Delete {
+				req.OldObject = rawObject(t, object)
+			} else {
+				req.Object = rawObject(t, object)
+			}
+			if tt.oldSpec != nil {
+				req.OldObject = rawObject(t, newTestObject(tt.cluster, *tt.oldSpec))
+			}
+
+			resp := v.Handle(context.TODO(), req)
+			if resp.Allowed != tt.want {
+				t.Errorf("Handle() allowed = %v, want %v: %v", resp.Allowed, tt.want, resp.Result)
+			}
+		})
+	}
+}
+
+func newTestObject(cluster bool, spec spiffeidv1alpha1.SpiffeIdSpec) spiffeidv1alpha1.CommonSpiffeId {
+	if cluster {
+		return &spiffeidv1alpha1.ClusterSpiffeId{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "spiffeid.spiffe.io/v1alpha1", Kind: "ClusterSpiffeId"},
+			ObjectMeta: metav1.ObjectMeta{Name: "web"},
+			Spec:       spec,
+		}
+	}
+	return &spiffeidv1alpha1.SpiffeId{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "spiffeid.spiffe.io/v1alpha1", Kind: "SpiffeId"},
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+		Spec:       spec,
+	}
+}
+
+func rawObject(t *testing.T, object spiffeidv1alpha1.CommonSpiffeId) runtime.RawExtension {
+	raw, err := json.Marshal(object)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return runtime.RawExtension{Raw: raw}
+}